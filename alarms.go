@@ -0,0 +1,261 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+const (
+	// How often an alarm repeats, unless it says.
+	defaultAlarmEvery = 30 * time.Second
+
+	// How often an alarm may repeat at most.
+	minAlarmEvery = 5 * time.Second
+
+	// How long an alarm with an escalation sound waits for an ack, unless
+	// it says.
+	defaultEscalateAfter = 5 * time.Minute
+
+	// How many acknowledged alarms are kept for the API.
+	maxAckedAlarms = 50
+)
+
+var errNoAlarm = errors.New("no such alarm")
+
+// alarm is a running or acknowledged alarm.
+type alarm struct {
+	// The alarm as reported to clients. Guarded by Alarms.mu.
+	jukebox.Alarm
+
+	every         time.Duration
+	escalateAfter time.Duration
+
+	// Hub of the room the alarm rings in.
+	hub *Hub
+
+	// Closed when the alarm is acknowledged.
+	done chan struct{}
+}
+
+// Alarms holds the alarms of every room.
+type Alarms struct {
+	mu     sync.Mutex
+	alarms map[string]*alarm
+}
+
+func newAlarms() *Alarms {
+	return &Alarms{alarms: make(map[string]*alarm)}
+}
+
+// start checks a request for an alarm and starts ringing it in a room.
+func (as *Alarms) start(hub *Hub, req *jukebox.Alarm) (*jukebox.Alarm, error) {
+	a := &alarm{hub: hub, done: make(chan struct{})}
+	a.Sound = req.Sound
+	a.Zones = req.Zones
+	a.EscalateTo = req.EscalateTo
+	a.Text = req.Text
+
+	if _, err := hub.library.resolve(a.Sound); err != nil {
+		return nil, err
+	}
+	if err := validateOptions(jukebox.PlayOptions{Zones: a.Zones}); err != nil {
+		return nil, err
+	}
+	if len(a.Text) > maxChatLength {
+		return nil, fmt.Errorf("alarm text is limited to %d characters", maxChatLength)
+	}
+	a.every = defaultAlarmEvery
+	if req.Every != "" {
+		d, err := time.ParseDuration(req.Every)
+		if err != nil || d < minAlarmEvery {
+			return nil, fmt.Errorf("invalid interval %q; the least is %v", req.Every, minAlarmEvery)
+		}
+		a.every = d
+	}
+	a.Every = a.every.String()
+	if a.EscalateTo != "" {
+		if _, err := hub.library.resolve(a.EscalateTo); err != nil {
+			return nil, err
+		}
+		a.escalateAfter = defaultEscalateAfter
+		if req.EscalateAfter != "" {
+			d, err := time.ParseDuration(req.EscalateAfter)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid escalation delay %q", req.EscalateAfter)
+			}
+			a.escalateAfter = d
+		}
+		a.EscalateAfter = a.escalateAfter.String()
+	}
+	a.ID = newID()
+	a.Room = hub.room
+	a.Started = time.Now()
+
+	as.mu.Lock()
+	as.alarms[a.ID] = a
+	snapshot := a.Alarm
+	as.mu.Unlock()
+
+	log.Println("Started alarm", a.ID, "in room", a.Room, "with", a.Sound)
+	hub.broadcast <- []*jukebox.Event{{Type: jukebox.EventAlarm, Text: "alarm started", Alarm: &snapshot}}
+	go as.run(a)
+	return &snapshot, nil
+}
+
+// run rings an alarm until it is acknowledged.
+func (as *Alarms) run(a *alarm) {
+	ticker := time.NewTicker(a.every)
+	defer ticker.Stop()
+	for {
+		as.ring(a)
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ring plays an alarm's sound once, escalating it first if it has gone
+// unacknowledged for too long.
+//
+// The lock is held until the hub has taken the plays, so that an
+// acknowledgement either stops them or is broadcast after them.
+func (as *Alarms) ring(a *alarm) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if a.AckedAt != nil {
+		return
+	}
+	escalated := false
+	if a.EscalateTo != "" && !a.Escalated && time.Since(a.Started) >= a.escalateAfter {
+		a.Escalated = true
+		escalated = true
+	}
+	snapshot := a.Alarm
+
+	var events []*jukebox.Event
+	sound := snapshot.Sound
+	if snapshot.Escalated {
+		sound = snapshot.EscalateTo
+	}
+	if escalated {
+		events = append(events, &jukebox.Event{
+			Type:  jukebox.EventAlarm,
+			Text:  "alarm escalated to " + sound,
+			Alarm: &snapshot,
+		})
+	}
+	plays, err := a.hub.library.resolve(sound)
+	if err != nil {
+		log.Println("Alarm", snapshot.ID, "failed:", err)
+		return
+	}
+	for _, e := range plays {
+		e.Group = snapshot.ID
+		e.Zones = snapshot.Zones
+		e.Priority = true
+		e.Text = snapshot.Text
+		e.Alarm = &snapshot
+	}
+	a.hub.broadcast <- append(events, plays...)
+}
+
+// acknowledge stops an alarm, recording who acknowledged it. Acknowledging
+// an alarm again changes nothing.
+//
+// Clients may only acknowledge the alarms of their own room, given as room;
+// API callers give an empty room and may acknowledge any alarm.
+func (as *Alarms) acknowledge(id string, room string, by string) (*jukebox.Alarm, error) {
+	if by == "" {
+		by = "anonymous"
+	}
+	as.mu.Lock()
+	a, ok := as.alarms[id]
+	if !ok || (room != "" && a.Room != room) {
+		as.mu.Unlock()
+		return nil, errNoAlarm
+	}
+	if a.AckedAt != nil {
+		snapshot := a.Alarm
+		as.mu.Unlock()
+		return &snapshot, nil
+	}
+	now := time.Now()
+	a.AckedBy = by
+	a.AckedAt = &now
+	close(a.done)
+	snapshot := a.Alarm
+	as.prune()
+	as.mu.Unlock()
+
+	log.Println("Alarm", id, "acknowledged by", by)
+	a.hub.broadcast <- []*jukebox.Event{
+		{Type: jukebox.EventSkip, Group: id},
+		{Type: jukebox.EventAlarm, Text: "alarm acknowledged by " + by, Alarm: &snapshot},
+	}
+	return &snapshot, nil
+}
+
+// prune forgets the oldest acknowledged alarms beyond maxAckedAlarms. The
+// caller must hold as.mu.
+func (as *Alarms) prune() {
+	var acked []*alarm
+	for _, a := range as.alarms {
+		if a.AckedAt != nil {
+			acked = append(acked, a)
+		}
+	}
+	if len(acked) <= maxAckedAlarms {
+		return
+	}
+	sort.Slice(acked, func(i, j int) bool { return acked[i].AckedAt.Before(*acked[j].AckedAt) })
+	for _, a := range acked[:len(acked)-maxAckedAlarms] {
+		delete(as.alarms, a.ID)
+	}
+}
+
+// get returns an alarm by ID.
+func (as *Alarms) get(id string) (*jukebox.Alarm, bool) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	a, ok := as.alarms[id]
+	if !ok {
+		return nil, false
+	}
+	snapshot := a.Alarm
+	return &snapshot, true
+}
+
+// all returns every alarm held, newest first.
+func (as *Alarms) all() []*jukebox.Alarm {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	alarms := make([]*jukebox.Alarm, 0, len(as.alarms))
+	for _, a := range as.alarms {
+		snapshot := a.Alarm
+		alarms = append(alarms, &snapshot)
+	}
+	sort.Slice(alarms, func(i, j int) bool { return alarms[i].Started.After(alarms[j].Started) })
+	return alarms
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+func TestAlarms(t *testing.T) {
+	rooms := testRooms(t)
+	h, err := rooms.get(defaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := rooms.get("ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := connect(t, h, "handle=alice")
+	outsider := connect(t, ops, "handle=mallory")
+	if err := h.handle(alice, []byte(`{"type":"dnd","dnd":{"for":"1h"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.handle(alice, []byte(`{"type":"prefs","prefs":{"mute":["tada"]}}`)); err != nil {
+		t.Fatal(err)
+	}
+	received(t, alice)
+
+	started, err := rooms.alarms.start(h, &jukebox.Alarm{Sound: "tada", EscalateTo: "bell", EscalateAfter: "1h", Text: "database down"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForPlays(t, rooms, defaultRoom, 2)
+	received(t, alice)
+	rooms.alarms.mu.Lock()
+	a := rooms.alarms.alarms[started.ID]
+	rooms.alarms.mu.Unlock()
+	ack := []byte(`{"type":"acknowledge","alarm":{"id":"` + started.ID + `"}}`)
+
+	tests := []struct {
+		name string
+
+		// Either ring the alarm again, after backdating it past its
+		// escalation delay if asked, or handle a message from a client.
+		ring     bool
+		escalate bool
+		client   *Client
+		message  []byte
+		err      error
+
+		// What the room hears, and what alice is sent.
+		want  []string
+		alice []string
+	}{
+		{name: "repeat", ring: true, want: []string{"play:tada"}, alice: []string{"play:tada"}},
+		{name: "escalate", ring: true, escalate: true, want: []string{"alarm:", "play:bell"}, alice: []string{"alarm:", "play:bell"}},
+		{name: "repeat escalated", ring: true, want: []string{"play:bell"}, alice: []string{"play:bell"}},
+		{name: "ack from another room", client: outsider, message: ack, err: errNoAlarm},
+		{name: "ack unknown alarm", client: alice, message: []byte(`{"type":"acknowledge","alarm":{"id":"nope"}}`), err: errNoAlarm},
+		{name: "ack", client: alice, message: ack, want: []string{"skip:", "alarm:"}, alice: []string{"skip:", "alarm:"}},
+		{name: "ack again", message: ack},
+		{name: "ring after ack", ring: true},
+	}
+	for _, tt := range tests {
+		settle(h)
+		before := len(h.since(0))
+		switch {
+		case tt.ring:
+			if tt.escalate {
+				rooms.alarms.mu.Lock()
+				a.Started = a.Started.Add(-time.Hour)
+				rooms.alarms.mu.Unlock()
+			}
+			rooms.alarms.ring(a)
+		case tt.client != nil:
+			if err := tt.client.hub.handle(tt.client, tt.message); err != tt.err {
+				t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			}
+		default:
+			if err := h.handle(nil, tt.message); err != tt.err {
+				t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			}
+		}
+		settle(h)
+		added := h.since(0)[before:]
+		if got := summarize(added); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: room heard %q, want %q", tt.name, got, tt.want)
+		}
+		if got := summarize(received(t, alice)); !reflect.DeepEqual(got, tt.alice) {
+			t.Errorf("%s: alice got %q, want %q", tt.name, got, tt.alice)
+		}
+		for _, e := range added {
+			if e.Type == jukebox.EventPlay && (!e.Priority || e.Group != started.ID || e.Alarm == nil || e.Text != "database down") {
+				t.Errorf("%s: play %+v is not marked as the alarm's", tt.name, e)
+			}
+		}
+	}
+
+	got, ok := rooms.alarms.get(started.ID)
+	if !ok || got.AckedBy != "alice" || got.AckedAt == nil || !got.Escalated {
+		t.Errorf("alarm after acks: %+v", got)
+	}
+	if received(t, outsider) != nil {
+		t.Errorf("another room heard the alarm")
+	}
+}
+
+func TestAlarmRequests(t *testing.T) {
+	rooms := testRooms(t)
+	h, err := rooms.get(defaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		req jukebox.Alarm
+		err string
+	}{
+		{req: jukebox.Alarm{Sound: "xylophone"}, err: `unknown sound "xylophone"`},
+		{req: jukebox.Alarm{Sound: "tada", Every: "1s"}, err: `invalid interval "1s"; the least is 5s`},
+		{req: jukebox.Alarm{Sound: "tada", Every: "often"}, err: `invalid interval "often"; the least is 5s`},
+		{req: jukebox.Alarm{Sound: "tada", Zones: []string{"no good"}}, err: `invalid zone "no good"`},
+		{req: jukebox.Alarm{Sound: "tada", EscalateTo: "xylophone"}, err: `unknown sound "xylophone"`},
+		{req: jukebox.Alarm{Sound: "tada", EscalateTo: "bell", EscalateAfter: "-1m"}, err: `invalid escalation delay "-1m"`},
+	}
+	for _, tt := range tests {
+		if _, err := rooms.alarms.start(h, &tt.req); err == nil || err.Error() != tt.err {
+			t.Errorf("%+v: error %v, want %q", tt.req, err, tt.err)
+		}
+	}
+	if len(rooms.alarms.all()) != 0 {
+		t.Errorf("rejected alarms were kept")
+	}
+}
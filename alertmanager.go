@@ -0,0 +1,296 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// How long to gather alerts before playing one sound for them, unless the
+// config says.
+const defaultAlertGroupWait = 10 * time.Second
+
+// Alert statuses sent by Alertmanager.
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// Severities from most to least urgent. A group of alerts plays the sound
+// for its most urgent one; unknown severities rank last.
+var severityOrder = []string{"critical", "error", "warning", "info"}
+
+// Alertmanager receives notifications from Prometheus Alertmanager's
+// webhook receiver and plays sounds for them.
+type Alertmanager struct {
+	// Token, if set, must be sent as a bearer token, which Alertmanager
+	// does with the authorization setting of its http_config.
+	Token string `json:"token,omitempty"`
+
+	// Firing and Resolved map severity labels to sounds. The "default"
+	// entry covers alerts whose severity is missing or not listed; if it is
+	// also missing, those alerts are silent.
+	Firing   map[string]string `json:"firing"`
+	Resolved map[string]string `json:"resolved"`
+
+	// GroupWait is how long to gather alerts for a room before playing one
+	// sound for all of them.
+	GroupWait duration `json:"groupWait,omitempty"`
+
+	// Where alerts that match no route play.
+	Target
+
+	// Routes send alerts to rooms by their labels. The first route that
+	// matches an alert wins.
+	Routes []*AlertRoute `json:"routes,omitempty"`
+
+	rooms   *Rooms
+	mu      sync.Mutex
+	pending map[*AlertRoute]*alertBatch
+}
+
+// AlertRoute sends alerts whose labels match to a room.
+type AlertRoute struct {
+	// Match requires labels to equal these values.
+	Match map[string]string `json:"match,omitempty"`
+
+	// MatchRE requires labels to match these regular expressions, which are
+	// anchored at both ends as in Alertmanager.
+	MatchRE map[string]string `json:"matchRe,omitempty"`
+
+	// Where the alerts play.
+	Target
+
+	re map[string]*regexp.Regexp
+}
+
+// alertNotification is the body of an Alertmanager webhook.
+type alertNotification struct {
+	Version string  `json:"version"`
+	Status  string  `json:"status"`
+	Alerts  []alert `json:"alerts"`
+}
+
+// alert is one alert in a notification.
+type alert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// alertBatch gathers the alerts for one route until it plays.
+type alertBatch struct {
+	firing   []string
+	resolved []string
+	sound    string
+	rank     int
+}
+
+// check validates the receiver's settings and prepares its routes, and has
+// the library check its sounds once it is loaded.
+func (am *Alertmanager) check(library *Library) error {
+	if am.Token == "" {
+		log.Println("Warning: the Alertmanager receiver has no token, so anyone can call it")
+	}
+	if err := am.Target.validate(); err != nil {
+		return err
+	}
+	for severity, sound := range am.Firing {
+		library.expect(sound, "Alertmanager firing "+severity+" alerts")
+	}
+	for severity, sound := range am.Resolved {
+		library.expect(sound, "Alertmanager resolved "+severity+" alerts")
+	}
+	for i, route := range am.Routes {
+		if err := route.Target.validate(); err != nil {
+			return fmt.Errorf("route %d: %v", i+1, err)
+		}
+		route.re = make(map[string]*regexp.Regexp)
+		for label, expr := range route.MatchRE {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return fmt.Errorf("route %d: %v", i+1, err)
+			}
+			route.re[label] = re
+		}
+	}
+	return nil
+}
+
+// matches reports whether a route applies to an alert's labels.
+func (route *AlertRoute) matches(labels map[string]string) bool {
+	for label, v := range route.Match {
+		if labels[label] != v {
+			return false
+		}
+	}
+	for label, re := range route.re {
+		if !re.MatchString(labels[label]) {
+			return false
+		}
+	}
+	return true
+}
+
+// route returns the first route for an alert, or nil for the default room.
+func (am *Alertmanager) route(labels map[string]string) *AlertRoute {
+	for _, route := range am.Routes {
+		if route.matches(labels) {
+			return route
+		}
+	}
+	return nil
+}
+
+// sound picks the sound for an alert and ranks its urgency, where lower is
+// more urgent and resolved alerts rank below firing ones.
+func (am *Alertmanager) sound(a alert) (string, int) {
+	sounds, base := am.Firing, 0
+	if a.Status == alertResolved {
+		sounds, base = am.Resolved, len(severityOrder)+1
+	}
+	severity := a.Labels["severity"]
+	rank := len(severityOrder)
+	for i, s := range severityOrder {
+		if s == severity {
+			rank = i
+			break
+		}
+	}
+	if sound, ok := sounds[severity]; ok && severity != "" {
+		return sound, base + rank
+	}
+	return sounds["default"], base + rank
+}
+
+// receive adds a notification's alerts to their routes' batches, starting a
+// timer for each new batch.
+func (am *Alertmanager) receive(n *alertNotification) int {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if am.pending == nil {
+		am.pending = make(map[*AlertRoute]*alertBatch)
+	}
+
+	wait := time.Duration(am.GroupWait)
+	if wait == 0 {
+		wait = defaultAlertGroupWait
+	}
+	queued := 0
+	for _, a := range n.Alerts {
+		if a.Status == "" {
+			a.Status = n.Status
+		}
+		sound, rank := am.sound(a)
+		if sound == "" {
+			continue
+		}
+		route := am.route(a.Labels)
+		batch, ok := am.pending[route]
+		if !ok {
+			batch = &alertBatch{rank: -1}
+			am.pending[route] = batch
+			time.AfterFunc(wait, func() { am.flush(route) })
+		}
+		name := a.Labels["alertname"]
+		if name == "" {
+			name = "alert"
+		}
+		if a.Status == alertResolved {
+			batch.resolved = append(batch.resolved, name)
+		} else {
+			batch.firing = append(batch.firing, name)
+		}
+		if batch.rank < 0 || rank < batch.rank {
+			batch.sound, batch.rank = sound, rank
+		}
+		queued++
+	}
+	return queued
+}
+
+// flush plays one sound for a route's batch of alerts.
+func (am *Alertmanager) flush(route *AlertRoute) {
+	am.mu.Lock()
+	batch := am.pending[route]
+	delete(am.pending, route)
+	am.mu.Unlock()
+	if batch == nil {
+		return
+	}
+
+	target := am.Target
+	if route != nil {
+		target = route.Target
+	}
+	text := batch.text()
+	if err := am.rooms.notify(target.Room, batch.sound, jukebox.PlayOptions{Zones: target.Zones}, text); err != nil {
+		log.Println("Alertmanager could not play", batch.sound+":", err)
+	}
+}
+
+// text summarizes a batch, such as "2 firing: DiskFull, HighLatency".
+func (batch *alertBatch) text() string {
+	var parts []string
+	for _, group := range []struct {
+		status string
+		names  []string
+	}{{alertFiring, batch.firing}, {alertResolved, batch.resolved}} {
+		if len(group.names) == 0 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%d %s: %s", len(group.names), group.status, strings.Join(unique(group.names), ", ")))
+	}
+	return clip(strings.Join(parts, "; "))
+}
+
+// serveAlertmanager handles a notification from Alertmanager's webhook
+// receiver.
+func serveAlertmanager(am *Alertmanager, w http.ResponseWriter, r *http.Request) {
+	if am == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if am.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+am.Token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var n alertNotification
+	if err := json.Unmarshal(body, &n); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]int{"queued": am.receive(&n)})
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertRoute(t *testing.T) {
+	am := &Alertmanager{
+		Target: Target{Room: "ops"},
+		Routes: []*AlertRoute{
+			{Match: map[string]string{"team": "db"}, Target: Target{Room: "db"}},
+			{MatchRE: map[string]string{"service": "api|web"}, Target: Target{Room: "web"}},
+			{Match: map[string]string{"team": "web"}, MatchRE: map[string]string{"env": "prod.*"}, Target: Target{Room: "web-prod"}},
+		},
+	}
+	if err := am.check(testLibrary(t)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		labels map[string]string
+		room   string
+	}{
+		{labels: map[string]string{"team": "db"}, room: "db"},
+		{labels: map[string]string{"team": "db", "service": "api"}, room: "db"},
+		{labels: map[string]string{"service": "api"}, room: "web"},
+		{labels: map[string]string{"service": "web"}, room: "web"},
+		{labels: map[string]string{"service": "api2"}},
+		{labels: map[string]string{"service": "webapi"}},
+		{labels: map[string]string{"team": "web", "env": "production"}, room: "web-prod"},
+		{labels: map[string]string{"team": "web", "env": "staging"}},
+		{labels: map[string]string{"team": "web"}},
+		{labels: map[string]string{}},
+	}
+	for _, tt := range tests {
+		route := am.route(tt.labels)
+		room := ""
+		if route != nil {
+			room = route.Room
+		}
+		if room != tt.room {
+			t.Errorf("route(%v) goes to %q, want %q", tt.labels, room, tt.room)
+		}
+	}
+
+	bad := &Alertmanager{Routes: []*AlertRoute{{MatchRE: map[string]string{"service": "("}}}}
+	if err := bad.check(testLibrary(t)); err == nil {
+		t.Error("check accepted an invalid matchRe")
+	}
+}
+
+func TestAlertSound(t *testing.T) {
+	am := &Alertmanager{
+		Firing:   map[string]string{"critical": "tada", "warning": "bell", "default": "drama"},
+		Resolved: map[string]string{"critical": "bezos"},
+	}
+	tests := []struct {
+		status   string
+		severity string
+		sound    string
+	}{
+		{status: alertFiring, severity: "critical", sound: "tada"},
+		{status: alertFiring, severity: "warning", sound: "bell"},
+		{status: alertFiring, severity: "info", sound: "drama"},
+		{status: alertFiring, severity: "", sound: "drama"},
+		{status: alertResolved, severity: "critical", sound: "bezos"},
+		{status: alertResolved, severity: "warning"},
+	}
+	for _, tt := range tests {
+		sound, _ := am.sound(alert{Status: tt.status, Labels: map[string]string{"severity": tt.severity}})
+		if sound != tt.sound {
+			t.Errorf("sound(%s %s) = %q, want %q", tt.status, tt.severity, sound, tt.sound)
+		}
+	}
+}
+
+func TestAlertBatching(t *testing.T) {
+	rooms := testRooms(t)
+	am := &Alertmanager{
+		Firing:    map[string]string{"critical": "tada", "warning": "bell", "default": "drama"},
+		Resolved:  map[string]string{"default": "bezos"},
+		GroupWait: duration(50 * time.Millisecond),
+		Routes:    []*AlertRoute{{Match: map[string]string{"team": "db"}, Target: Target{Room: "db"}}},
+	}
+	if err := am.check(testLibrary(t)); err != nil {
+		t.Fatal(err)
+	}
+	am.rooms = rooms
+
+	notifications := []string{
+		`{"status": "firing", "alerts": [
+			{"labels": {"alertname": "HighLatency", "severity": "warning"}},
+			{"labels": {"alertname": "DiskFull", "severity": "info"}}
+		]}`,
+		`{"status": "firing", "alerts": [
+			{"labels": {"alertname": "InstanceDown", "severity": "critical"}},
+			{"status": "resolved", "labels": {"alertname": "HighLatency", "severity": "warning"}},
+			{"labels": {"alertname": "DiskFull", "severity": "info"}}
+		]}`,
+		`{"status": "firing", "alerts": [
+			{"labels": {"alertname": "ReplicationLag", "severity": "warning", "team": "db"}}
+		]}`,
+	}
+	queued := 0
+	for _, body := range notifications {
+		r := httptest.NewRequest("POST", "/alertmanager", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		serveAlertmanager(am, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		var resp map[string]int
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		queued += resp["queued"]
+	}
+	if queued != 6 {
+		t.Errorf("queued %d alerts, want 6", queued)
+	}
+
+	// Each route's alerts play once, with the sound of the most urgent.
+	events := waitForPlays(t, rooms, defaultRoom, 1)
+	if len(events) == 1 {
+		e := events[0]
+		if want := "4 firing: DiskFull, HighLatency, InstanceDown; 1 resolved: HighLatency"; e.Sound != "tada" || e.Text != want {
+			t.Errorf("main room played %s %q, want tada %q", e.Sound, e.Text, want)
+		}
+	}
+	events = waitForPlays(t, rooms, "db", 1)
+	if len(events) == 1 {
+		e := events[0]
+		if want := "1 firing: ReplicationLag"; e.Sound != "bell" || e.Text != want {
+			t.Errorf("db room played %s %q, want bell %q", e.Sound, e.Text, want)
+		}
+	}
+
+	// A new batch starts once the last one has played.
+	am.receive(&alertNotification{Status: alertResolved, Alerts: []alert{{Labels: map[string]string{"alertname": "InstanceDown"}}}})
+	events = waitForPlays(t, rooms, defaultRoom, 2)
+	if len(events) == 2 {
+		if e := events[1]; e.Sound != "bezos" || e.Text != "1 resolved: InstanceDown" {
+			t.Errorf("main room played %s %q, want bezos for the resolved alert", e.Sound, e.Text)
+		}
+	}
+}
+
+func TestServeAlertmanagerToken(t *testing.T) {
+	am := &Alertmanager{Token: "t0ken", Firing: map[string]string{"default": "tada"}, rooms: testRooms(t)}
+	for _, tt := range []struct {
+		auth   string
+		status int
+	}{
+		{auth: "Bearer t0ken", status: http.StatusOK},
+		{auth: "Bearer guess", status: http.StatusUnauthorized},
+		{auth: "t0ken", status: http.StatusUnauthorized},
+		{status: http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("POST", "/alertmanager", bytes.NewReader([]byte(`{"status": "firing", "alerts": []}`)))
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		serveAlertmanager(am, w, r)
+		if w.Code != tt.status {
+			t.Errorf("Authorization %q: status %d, want %d", tt.auth, w.Code, tt.status)
+		}
+	}
+}
+
+func TestAlertmanagerCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		am    *Alertmanager
+		err   string
+		sound string
+	}{
+		{name: "fine", am: &Alertmanager{Token: "t0ken", Target: Target{Room: "ops"}, Firing: map[string]string{"critical": "drama"}, Resolved: map[string]string{"default": "tada"}}},
+		{name: "bad room", am: &Alertmanager{Target: Target{Room: "no good"}}, err: `invalid room "no good"`},
+		{name: "bad route zone", am: &Alertmanager{Routes: []*AlertRoute{{}, {Target: Target{Zones: []string{"no good"}}}}}, err: `route 2: invalid zone "no good"`},
+		{name: "unknown sound", am: &Alertmanager{Resolved: map[string]string{"default": "xylophone"}}, sound: `Alertmanager resolved default alerts plays "xylophone", which will fail: unknown sound`},
+	}
+	for _, tt := range tests {
+		library := testLibrary(t)
+		sounds := library.sounds
+		library.sounds = nil
+		err := tt.am.check(library)
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		library.mu.Lock()
+		library.sounds = sounds
+		problems := library.checkExpected()
+		library.mu.Unlock()
+		if (len(problems) == 0) != (tt.sound == "") || (len(problems) > 0 && !strings.HasPrefix(problems[0], tt.sound)) {
+			t.Errorf("%s: got problems %q, want %q", tt.name, problems, tt.sound)
+		}
+	}
+}
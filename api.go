@@ -0,0 +1,531 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Maximum size of a request body accepted by the API.
+const maxBodySize = 1 << 16
+
+// Page sizes for search results.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// writeJSON sends v as a JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Could not write response:", err)
+	}
+}
+
+// readBody reads a size-limited request body.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	return ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+}
+
+// authorize checks the request's API key, writing an error if it is missing
+// or wrong. Any request is allowed when no keys are configured.
+func authorize(keys []string, w http.ResponseWriter, r *http.Request) bool {
+	if len(keys) == 0 || authenticated(keys, r) {
+		return true
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// authenticated reports whether the request carries one of the API keys,
+// which is never the case when no keys are configured.
+//
+// The key may be given as a bearer token or in an X-API-Key header.
+func authenticated(keys []string, r *http.Request) bool {
+	given := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		given = strings.TrimPrefix(auth, "Bearer ")
+	}
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(k)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// serveHistory returns a room's recent events, optionally only those after
+// the sequence number given as "since".
+func serveHistory(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hub, ok := rooms.forRequest(w, r)
+	if !ok {
+		return
+	}
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+	writeJSON(w, hub.since(since))
+}
+
+// serveRooms handles room status and settings.
+//
+//	GET /api/rooms                  status of every room in use
+//	GET /api/rooms/{room}           status of one room
+//	GET /api/rooms/{room}/settings  settings of one room
+//	GET /api/rooms/{room}/zones     zones of the room's speakers
+//	PUT /api/rooms/{room}/settings  change some or all settings of one room
+func serveRooms(rooms *Rooms, keys []string, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/rooms"), "/"), "/")
+	if parts[0] == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		statuses := []*Status{}
+		for _, h := range rooms.all() {
+			statuses = append(statuses, h.Status())
+		}
+		writeJSON(w, statuses)
+		return
+	}
+	if !validRoom.MatchString(parts[0]) || len(parts) > 2 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	hub, ok := rooms.find(parts[0])
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	sub := ""
+	if len(parts) == 2 {
+		sub = parts[1]
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		writeJSON(w, hub.Status())
+	case sub == "settings" && r.Method == http.MethodGet:
+		writeJSON(w, hub.Settings())
+	case sub == "zones" && r.Method == http.MethodGet:
+		writeJSON(w, hub.Zones())
+	case sub == "settings" && r.Method == http.MethodPut:
+		if !authorize(keys, w, r) {
+			return
+		}
+		// Fields missing from the body keep their current values.
+		settings := hub.Settings()
+		bb, err := readBody(w, r)
+		if err == nil {
+			err = json.Unmarshal(bb, &settings)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hub.setSettings(settings)
+		log.Printf("Updated settings for room %s: %+v", hub.room, settings)
+		writeJSON(w, settings)
+	case sub == "" || sub == "settings" || sub == "zones":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// serveQueue plays a JSON list of sounds in order as one group.
+func serveQueue(hub *Hub, keys []string, w http.ResponseWriter, r *http.Request) {
+	var names []string
+	bb, err := readBody(w, r)
+	if err == nil {
+		err = json.Unmarshal(bb, &names)
+	}
+	if err != nil || len(names) == 0 {
+		http.Error(w, "Expected a JSON list of sounds", http.StatusBadRequest)
+		return
+	}
+	opts, err := optionsFromRequest(r, authenticated(keys, r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Println("Requested to queue sounds:", names, "in room:", hub.room)
+	if err := hub.queue(names, opts); err != nil {
+		writePlayError(w, err)
+	}
+}
+
+// writePlayError reports a sound that could not be played, along with any
+// suggested alternatives.
+func writePlayError(w http.ResponseWriter, err error) {
+	code := http.StatusNotFound
+	if re, ok := err.(*ResolveError); ok && re.Ambiguous {
+		code = http.StatusConflict
+	}
+	switch err {
+	case errNoSpeakers:
+		code = http.StatusServiceUnavailable
+	case errNoWhispers, errPriority:
+		code = http.StatusForbidden
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	writeJSON(w, errorEvent(err))
+}
+
+// queryInt parses a non-negative integer query parameter.
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", key, v)
+	}
+	return n, nil
+}
+
+// serveSounds handles searching the library and looking up single sounds.
+//
+//	GET /api/sounds?q=...&tag=...&offset=0&limit=50  ranked search
+//	GET /api/sounds/{name}                           one sound
+//	GET /api/sounds/{name}/icon                      icon from its cover art
+func serveSounds(library *Library, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := library.load(); err != nil {
+		log.Println(err)
+		http.Error(w, "Could not load library", http.StatusInternalServerError)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sounds"), "/")
+	if strings.HasSuffix(name, "/icon") {
+		serveIcon(library, w, strings.TrimSuffix(name, "/icon"))
+		return
+	}
+	if name != "" {
+		serveSound(library, w, name)
+		return
+	}
+
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit == 0 || limit > maxPageSize {
+		limit = maxPageSize
+	}
+	q := r.URL.Query()
+	writeJSON(w, library.search(q.Get("q"), q["tag"], offset, limit))
+}
+
+// serveSound writes the metadata for one sound.
+func serveSound(library *Library, w http.ResponseWriter, name string) {
+	s, ok := library.sound(name)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// serveIcon writes the icon made from a sound's cover art.
+func serveIcon(library *Library, w http.ResponseWriter, name string) {
+	s, ok := library.sound(name)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	icon, ok := library.icon(s.Name)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, _ = w.Write(icon)
+}
+
+// serveMacros handles listing, defining and removing macros.
+//
+//	GET    /api/macros         list macros
+//	POST   /api/macros         define a macro from "name = steps"
+//	PUT    /api/macros/{name}  define a macro from "steps"
+//	DELETE /api/macros/{name}  remove a macro
+func serveMacros(library *Library, w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/macros"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		if err := library.load(); err != nil {
+			log.Println(err)
+			http.Error(w, "Could not load library", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, library.Macros())
+	case r.Method == http.MethodPost && name == "", r.Method == http.MethodPut && name != "":
+		bb, err := readBody(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var m *Macro
+		if name == "" {
+			m, err = parseMacroLine(string(bb))
+		} else {
+			m, err = parseMacro(name, string(bb))
+		}
+		if err == nil {
+			err = library.defineMacro(m)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("Defined macro:", m.Name, "=", m.Definition)
+		writeJSON(w, m)
+	case r.Method == http.MethodDelete && name != "":
+		if !library.removeMacro(name) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveTriggers lists, shows, defines and deletes chat triggers.
+func serveTriggers(triggers *Triggers, w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/triggers"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		writeJSON(w, triggers.all())
+	case r.Method == http.MethodGet:
+		tr, ok := triggers.get(name)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, tr)
+	case r.Method == http.MethodPost && name == "", r.Method == http.MethodPut && name != "":
+		bb, err := readBody(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tr := &Trigger{}
+		if err := json.Unmarshal(bb, tr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if name != "" {
+			tr.Name = name
+		}
+		if err := triggers.define(tr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("Defined trigger:", tr.Name, "->", tr.Sound)
+		writeJSON(w, tr)
+	case r.Method == http.MethodDelete && name != "":
+		if !triggers.remove(name) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveAlarms lists, shows, starts and acknowledges alarms:
+//
+//	GET  /api/alarms
+//	POST /api/alarms?room=<room>
+//	GET  /api/alarms/{id}
+//	POST /api/alarms/{id}/ack?by=<name>
+func serveAlarms(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/alarms"), "/"), "/")
+	id, sub := parts[0], ""
+	if len(parts) > 1 {
+		sub = strings.Join(parts[1:], "/")
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, rooms.alarms.all())
+	case id == "" && r.Method == http.MethodPost:
+		hub, ok := rooms.forRequest(w, r)
+		if !ok {
+			return
+		}
+		bb, err := readBody(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req jukebox.Alarm
+		if err := json.Unmarshal(bb, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		alarm, err := rooms.alarms.start(hub, &req)
+		if _, ok := err.(*ResolveError); ok {
+			writePlayError(w, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, alarm)
+	case id != "" && sub == "" && r.Method == http.MethodGet:
+		alarm, ok := rooms.alarms.get(id)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, alarm)
+	case id != "" && sub == "ack" && r.Method == http.MethodPost:
+		alarm, err := rooms.alarms.acknowledge(id, "", r.URL.Query().Get("by"))
+		if err == errNoAlarm {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, alarm)
+	case id != "" && (sub == "" || sub == "ack"):
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// serveHeartbeats lists, shows, defines, deletes and pings heartbeats:
+//
+//	GET    /api/heartbeats
+//	GET    /api/heartbeats/{name}
+//	PUT    /api/heartbeats/{name}
+//	DELETE /api/heartbeats/{name}
+//	POST   /api/heartbeats/{name}/ping
+func serveHeartbeats(heartbeats *Heartbeats, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/heartbeats"), "/"), "/")
+	name, sub := parts[0], ""
+	if len(parts) > 1 {
+		sub = strings.Join(parts[1:], "/")
+	}
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		writeJSON(w, heartbeats.all())
+	case name != "" && sub == "" && r.Method == http.MethodGet:
+		hb, ok := heartbeats.get(name)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, hb)
+	case name != "" && sub == "" && r.Method == http.MethodPut:
+		bb, err := readBody(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hb := &Heartbeat{}
+		if err := json.Unmarshal(bb, hb); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hb.Name = name
+		if err := heartbeats.define(hb); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("Defined heartbeat:", hb.Name, "every", time.Duration(hb.Interval))
+		writeJSON(w, hb)
+	case name != "" && sub == "" && r.Method == http.MethodDelete:
+		if !heartbeats.remove(name) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case name != "" && sub == "ping" && r.Method == http.MethodPost:
+		hb, ok := heartbeats.ping(name)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, hb)
+	case name != "" && (sub == "" || sub == "ping"):
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// serveChecks shows the uptime checks and their status.
+func serveChecks(checks *Checks, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/checks"), "/")
+	all := checks.all()
+	if name == "" {
+		writeJSON(w, all)
+		return
+	}
+	for _, c := range all {
+		if c.Name == name {
+			writeJSON(w, c)
+			return
+		}
+	}
+	http.Error(w, "Not found", http.StatusNotFound)
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+const (
+	// Longest chat message allowed, in characters.
+	maxChatLength = 500
+
+	// Longest reaction allowed, in bytes. Emoji built from several code
+	// points, such as flags and families, need a few dozen.
+	maxReactionLength = 32
+)
+
+// chat checks a chat message or reaction from a client and broadcasts it,
+// followed by any plays that a chat message triggers. Like plays, chat
+// messages and reactions are numbered and kept in the room's history.
+func (h *Hub) chat(client *Client, cmd *jukebox.Event) error {
+	text := strings.TrimSpace(cmd.Text)
+	if text == "" {
+		return errors.New("empty message")
+	}
+	if !utf8.ValidString(text) || strings.IndexFunc(text, unicode.IsControl) >= 0 {
+		return errors.New("message contains invalid characters")
+	}
+
+	e := &jukebox.Event{Type: cmd.Type, Text: text}
+	if client != nil {
+		e.From = client.handle
+	}
+	switch cmd.Type {
+	case jukebox.EventChat:
+		if utf8.RuneCountInString(text) > maxChatLength {
+			return fmt.Errorf("chat messages are limited to %d characters", maxChatLength)
+		}
+	case jukebox.EventReaction:
+		if len(text) > maxReactionLength || strings.IndexFunc(text, unicode.IsSpace) >= 0 {
+			return fmt.Errorf("invalid reaction %q", text)
+		}
+		if !h.played(cmd.Ref) {
+			return fmt.Errorf("no recent play #%d to react to", cmd.Ref)
+		}
+		e.Ref = cmd.Ref
+	}
+	events := []*jukebox.Event{e}
+	if e.Type == jukebox.EventChat {
+		events = append(events, h.triggered(e)...)
+	}
+	h.broadcast <- events
+	return nil
+}
+
+// clip shortens text that goes along with a play to at most maxChatLength
+// characters, marking the cut with an ellipsis.
+func clip(text string) string {
+	if r := []rune(text); len(r) > maxChatLength {
+		return string(r[:maxChatLength-1]) + "…"
+	}
+	return text
+}
+
+// played reports whether a sequence number belongs to a remembered play.
+func (h *Hub) played(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	events := h.since(seq - 1)
+	return len(events) > 0 && events[0].Seq == seq && events[0].Type == jukebox.EventPlay
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+func TestChat(t *testing.T) {
+	rooms := testRooms(t)
+	h, err := rooms.get(defaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := connect(t, h, "handle=alice")
+	if err := h.play("tada", jukebox.PlayOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		client *Client
+		cmd    jukebox.Event
+		err    string
+
+		// The event added to the history, if any.
+		want *jukebox.Event
+	}{
+		{
+			client: alice,
+			cmd:    jukebox.Event{Type: jukebox.EventChat, Text: "  ship it  "},
+			want:   &jukebox.Event{Type: jukebox.EventChat, Text: "ship it", From: "alice"},
+		},
+		{
+			cmd:  jukebox.Event{Type: jukebox.EventChat, Text: "anyone?"},
+			want: &jukebox.Event{Type: jukebox.EventChat, Text: "anyone?"},
+		},
+		{
+			cmd:  jukebox.Event{Type: jukebox.EventChat, Text: strings.Repeat("é", maxChatLength)},
+			want: &jukebox.Event{Type: jukebox.EventChat, Text: strings.Repeat("é", maxChatLength)},
+		},
+		{cmd: jukebox.Event{Type: jukebox.EventChat, Text: strings.Repeat("a", maxChatLength+1)}, err: "chat messages are limited to 500 characters"},
+		{cmd: jukebox.Event{Type: jukebox.EventChat, Text: " \t "}, err: "empty message"},
+		{cmd: jukebox.Event{Type: jukebox.EventChat, Text: "ding\adong"}, err: "message contains invalid characters"},
+		{
+			client: alice,
+			cmd:    jukebox.Event{Type: jukebox.EventReaction, Text: "👍", Ref: 1},
+			want:   &jukebox.Event{Type: jukebox.EventReaction, Text: "👍", From: "alice", Ref: 1},
+		},
+		{
+			cmd:  jukebox.Event{Type: jukebox.EventReaction, Text: "👨‍👩‍👧‍👦", Ref: 1},
+			want: &jukebox.Event{Type: jukebox.EventReaction, Text: "👨‍👩‍👧‍👦", Ref: 1},
+		},
+		{cmd: jukebox.Event{Type: jukebox.EventReaction, Text: strings.Repeat("👍", 9), Ref: 1}, err: `invalid reaction "` + strings.Repeat("👍", 9) + `"`},
+		{cmd: jukebox.Event{Type: jukebox.EventReaction, Text: "so good", Ref: 1}, err: `invalid reaction "so good"`},
+		{cmd: jukebox.Event{Type: jukebox.EventReaction, Text: "👍", Ref: 2}, err: "no recent play #2 to react to"},
+		{cmd: jukebox.Event{Type: jukebox.EventReaction, Text: "👍", Ref: 99}, err: "no recent play #99 to react to"},
+		{cmd: jukebox.Event{Type: jukebox.EventReaction, Text: "👍"}, err: "no recent play #0 to react to"},
+	}
+	for _, tt := range tests {
+		settle(h)
+		before := len(h.since(0))
+		message, err := json.Marshal(tt.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = h.handle(tt.client, message)
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s %q: error %v, want %q", tt.cmd.Type, tt.cmd.Text, err, tt.err)
+		}
+		settle(h)
+		added := h.since(0)[before:]
+		switch {
+		case tt.want == nil && len(added) == 0:
+		case tt.want == nil || len(added) != 1:
+			t.Errorf("%s %q: added %q", tt.cmd.Type, tt.cmd.Text, summarize(added))
+		default:
+			got := added[0]
+			if got.Type != tt.want.Type || got.Text != tt.want.Text || got.From != tt.want.From || got.Ref != tt.want.Ref || got.Seq == 0 {
+				t.Errorf("%s %q: added %+v, want %+v", tt.cmd.Type, tt.cmd.Text, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults for uptime checks that leave settings out.
+const (
+	defaultCheckInterval  = time.Minute
+	defaultCheckTimeout   = 10 * time.Second
+	defaultCheckFailures  = 2
+	defaultCheckSuccesses = 2
+)
+
+// How often a check may probe at most.
+const minCheckInterval = 5 * time.Second
+
+// checkClient fetches URLs for checks. It does not follow redirects, so a
+// check sees the status its URL itself returns.
+var checkClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Check statuses.
+const (
+	// checkUnknown has not been probed enough to tell.
+	checkUnknown = "unknown"
+
+	checkUp   = "up"
+	checkDown = "down"
+)
+
+// Check polls a URL or TCP endpoint and plays a sound when it goes down or
+// comes back up.
+type Check struct {
+	Name string `json:"name"`
+
+	// URL to fetch, or TCP address such as "db:5432" to connect to.
+	URL string `json:"url,omitempty"`
+	TCP string `json:"tcp,omitempty"`
+
+	// How often to probe, and how long to wait for an answer.
+	Interval duration `json:"interval,omitempty"`
+	Timeout  duration `json:"timeout,omitempty"`
+
+	// ExpectStatus is the HTTP status an up endpoint returns. Zero means
+	// any status below 400.
+	ExpectStatus int `json:"expectStatus,omitempty"`
+
+	// Failures and Successes are how many probes in a row it takes to go
+	// down and to come back up, which keeps a flapping endpoint quiet.
+	Failures  int `json:"failures,omitempty"`
+	Successes int `json:"successes,omitempty"`
+
+	// Where the sounds play.
+	Target
+
+	// Sounds to play on going down and on coming back up.
+	DownSound string `json:"downSound,omitempty"`
+	UpSound   string `json:"upSound,omitempty"`
+
+	// Status is one of checkUnknown, checkUp and checkDown.
+	Status string `json:"status"`
+
+	// Error from the last probe, if it failed.
+	Error string `json:"error,omitempty"`
+
+	// When the last probe finished and when the status last changed.
+	LastCheck *time.Time `json:"lastCheck,omitempty"`
+	Changed   *time.Time `json:"changed,omitempty"`
+
+	// Probes in a row that disagree with the status, and whether they
+	// found the endpoint up.
+	streak   int
+	streakUp bool
+}
+
+// validate checks a check's settings and fills in defaults.
+func (c *Check) validate() error {
+	if !validLabel.MatchString(c.Name) {
+		return fmt.Errorf("invalid check name %q", c.Name)
+	}
+	if (c.URL == "") == (c.TCP == "") {
+		return fmt.Errorf("check %s needs either a url or a tcp address", c.Name)
+	}
+	if c.Interval == 0 {
+		c.Interval = duration(defaultCheckInterval)
+	}
+	if time.Duration(c.Interval) < minCheckInterval {
+		return fmt.Errorf("check %s probes too often; the least interval is %v", c.Name, minCheckInterval)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = duration(defaultCheckTimeout)
+	}
+	if c.Failures <= 0 {
+		c.Failures = defaultCheckFailures
+	}
+	if c.Successes <= 0 {
+		c.Successes = defaultCheckSuccesses
+	}
+	c.Status = checkUnknown
+	return c.Target.validate()
+}
+
+// Checks runs the uptime checks.
+type Checks struct {
+	// HTTPClient fetches URLs; nil means checkClient.
+	HTTPClient *http.Client
+
+	// Dial connects to TCP addresses; nil means a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// notify plays one of a check's sounds.
+	notify func(c *Check, sound string, text string)
+
+	mu     sync.Mutex
+	checks []*Check
+}
+
+// newChecks validates the checks in the config, and has the library check
+// their sounds once it is loaded.
+func newChecks(library *Library, defs []*Check, notify func(c *Check, sound string, text string)) (*Checks, error) {
+	seen := make(map[string]bool)
+	for _, c := range defs {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("duplicate check %s", c.Name)
+		}
+		seen[c.Name] = true
+		for _, sound := range []string{c.DownSound, c.UpSound} {
+			if sound != "" {
+				library.expect(sound, "check "+c.Name)
+			}
+		}
+	}
+	return &Checks{checks: defs, notify: notify}, nil
+}
+
+// run starts probing every check.
+func (cs *Checks) run() {
+	for _, c := range cs.checks {
+		go cs.watch(c)
+	}
+}
+
+// watch probes a check on its interval until the process exits.
+func (cs *Checks) watch(c *Check) {
+	ticker := time.NewTicker(time.Duration(c.Interval))
+	defer ticker.Stop()
+	for {
+		cs.checkOnce(c)
+		<-ticker.C
+	}
+}
+
+// checkOnce probes a check and plays a sound if its status changed.
+func (cs *Checks) checkOnce(c *Check) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout))
+	err := cs.probe(ctx, c)
+	cancel()
+	if sound, text := cs.record(c, err, time.Now()); sound != "" && cs.notify != nil {
+		cs.notify(c, sound, text)
+	}
+}
+
+// probe reports whether a check's endpoint is up, returning nil if so.
+func (cs *Checks) probe(ctx context.Context, c *Check) error {
+	if c.TCP != "" {
+		dial := cs.Dial
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		conn, err := dial(ctx, "tcp", c.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	hc := cs.HTTPClient
+	if hc == nil {
+		hc = checkClient
+	}
+	resp, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if c.ExpectStatus != 0 && resp.StatusCode != c.ExpectStatus {
+		return fmt.Errorf("got status %d, want %d", resp.StatusCode, c.ExpectStatus)
+	}
+	if c.ExpectStatus == 0 && resp.StatusCode >= 400 {
+		return fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// record applies the result of a probe to a check's status. If the status
+// changed, it returns the sound to play and text saying why.
+//
+// A check goes down after Failures failed probes in a row, and back up
+// after Successes good ones. The first verdict, from unknown, plays only
+// if the endpoint is down.
+func (cs *Checks) record(c *Check, err error, now time.Time) (string, string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c.LastCheck = &now
+	c.Error = ""
+	if err != nil {
+		c.Error = err.Error()
+	}
+
+	up := err == nil
+	if (up && c.Status == checkUp) || (!up && c.Status == checkDown) {
+		c.streak = 0
+		return "", ""
+	}
+	if c.streak > 0 && c.streakUp != up {
+		c.streak = 0
+	}
+	c.streak++
+	c.streakUp = up
+	need := c.Successes
+	if !up {
+		need = c.Failures
+	}
+	if c.streak < need {
+		return "", ""
+	}
+
+	was := c.Status
+	c.streak = 0
+	c.Changed = &now
+	if up {
+		c.Status = checkUp
+		log.Println("Check", c.Name, "is up")
+		if was == checkUnknown {
+			return "", ""
+		}
+		return c.UpSound, "check " + c.Name + " is back up"
+	}
+	c.Status = checkDown
+	log.Println("Check", c.Name, "is down:", c.Error)
+	return c.DownSound, clip("check " + c.Name + " is down: " + c.Error)
+}
+
+// all returns a copy of every check, sorted by name.
+func (cs *Checks) all() []Check {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	checks := make([]Check, 0, len(cs.checks))
+	for _, c := range cs.checks {
+		checks = append(checks, *c)
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	return checks
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckProbe(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/moved":
+			http.Redirect(w, r, "/broken", http.StatusFound)
+		case "/slow":
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name  string
+		check Check
+		err   string
+	}{
+		{name: "ok", check: Check{URL: srv.URL + "/ok"}},
+		{name: "any good status", check: Check{URL: srv.URL + "/created"}},
+		{name: "bad status", check: Check{URL: srv.URL + "/broken"}, err: "got status 500"},
+		{name: "expected status", check: Check{URL: srv.URL + "/created", ExpectStatus: 201}},
+		{name: "status mismatch", check: Check{URL: srv.URL + "/ok", ExpectStatus: 201}, err: "got status 200, want 201"},
+		{name: "expected error status", check: Check{URL: srv.URL + "/broken", ExpectStatus: 500}},
+		{name: "redirect not followed", check: Check{URL: srv.URL + "/moved"}},
+		{name: "redirect status", check: Check{URL: srv.URL + "/moved", ExpectStatus: 301}, err: "got status 302, want 301"},
+		{name: "timeout", check: Check{URL: srv.URL + "/slow", Timeout: duration(50 * time.Millisecond)}, err: "deadline exceeded"},
+		{name: "tcp", check: Check{TCP: ln.Addr().String()}},
+		{name: "tcp refused", check: Check{TCP: refused}, err: "refused"},
+	}
+	for _, tt := range tests {
+		c := tt.check
+		c.Name, c.Failures, c.Successes = "test", 1, 1
+		if err := c.validate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		cs := &Checks{checks: []*Check{&c}}
+		cs.checkOnce(&c)
+		switch {
+		case tt.err == "" && (c.Status != checkUp || c.Error != ""):
+			t.Errorf("%s: status %s, error %q; want up", tt.name, c.Status, c.Error)
+		case tt.err != "" && (c.Status != checkDown || !strings.Contains(c.Error, tt.err)):
+			t.Errorf("%s: status %s, error %q; want down with %q", tt.name, c.Status, c.Error, tt.err)
+		}
+	}
+}
+
+func TestCheckRecord(t *testing.T) {
+	down := errors.New("connection refused")
+	tests := []struct {
+		name      string
+		failures  int
+		successes int
+		results   []error
+		status    string
+		sounds    []string
+	}{
+		{name: "first verdict up is quiet", results: []error{nil, nil}, status: checkUp},
+		{name: "one success is not enough", results: []error{nil}, status: checkUnknown},
+		{name: "first verdict down plays", results: []error{down, down}, status: checkDown, sounds: []string{"down"}},
+		{name: "one failure is a blip", results: []error{nil, nil, down, nil, nil}, status: checkUp},
+		{name: "failures in a row go down", results: []error{nil, nil, down, down}, status: checkDown, sounds: []string{"down"}},
+		{name: "flapping stays up", results: []error{nil, nil, down, nil, down, nil, down}, status: checkUp},
+		{name: "staying down plays once", results: []error{nil, nil, down, down, down, down}, status: checkDown, sounds: []string{"down"}},
+		{name: "more failures needed", failures: 3, results: []error{nil, nil, down, down}, status: checkUp},
+		{name: "enough failures", failures: 3, results: []error{nil, nil, down, down, down}, status: checkDown, sounds: []string{"down"}},
+		{name: "one success recovers", successes: 1, results: []error{down, down, nil}, status: checkUp, sounds: []string{"down", "up"}},
+		{name: "recovery needs successes", results: []error{nil, nil, down, down, nil, down, nil, nil}, status: checkUp, sounds: []string{"down", "up"}},
+	}
+	for _, tt := range tests {
+		c := &Check{
+			Name:      "test",
+			URL:       "http://example.com/",
+			Failures:  tt.failures,
+			Successes: tt.successes,
+			DownSound: "down",
+			UpSound:   "up",
+		}
+		if err := c.validate(); err != nil {
+			t.Fatal(err)
+		}
+		cs := &Checks{checks: []*Check{c}}
+		var sounds []string
+		now := time.Now()
+		for _, err := range tt.results {
+			if sound, _ := cs.record(c, err, now); sound != "" {
+				sounds = append(sounds, sound)
+			}
+			now = now.Add(time.Minute)
+		}
+		if c.Status != tt.status || strings.Join(sounds, ",") != strings.Join(tt.sounds, ",") {
+			t.Errorf("%s: status %s, played %v; want %s, %v", tt.name, c.Status, sounds, tt.status, tt.sounds)
+		}
+	}
+}
+
+func TestCheckValidate(t *testing.T) {
+	tests := []struct {
+		check Check
+		err   string
+	}{
+		{check: Check{Name: "web", URL: "http://example.com/"}},
+		{check: Check{Name: "db", TCP: "db:5432", Interval: duration(minCheckInterval)}},
+		{check: Check{Name: "no good", URL: "http://example.com/"}, err: `invalid check name "no good"`},
+		{check: Check{Name: "both", URL: "http://example.com/", TCP: "db:5432"}, err: "check both needs either a url or a tcp address"},
+		{check: Check{Name: "neither"}, err: "check neither needs either a url or a tcp address"},
+		{check: Check{Name: "eager", URL: "http://example.com/", Interval: duration(time.Second)}, err: "check eager probes too often; the least interval is 5s"},
+		{check: Check{Name: "lost", URL: "http://example.com/", Target: Target{Room: "no good"}}, err: `invalid room "no good"`},
+		{check: Check{Name: "zoned", URL: "http://example.com/", Target: Target{Zones: []string{"no good"}}}, err: `invalid zone "no good"`},
+	}
+	for _, tt := range tests {
+		err := tt.check.validate()
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.check.Name, err, tt.err)
+		}
+	}
+}
+
+func TestCheckDownText(t *testing.T) {
+	c := &Check{Name: "web", URL: "http://example.com/", Failures: 1, DownSound: "down"}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	cs := &Checks{checks: []*Check{c}}
+	_, text := cs.record(c, errors.New(strings.Repeat("x", 2*maxChatLength)), time.Now())
+	if r := []rune(text); len(r) != maxChatLength || !strings.HasPrefix(text, "check web is down: xxx") || !strings.HasSuffix(text, "…") {
+		t.Errorf("down text is %d characters: %q", len(r), text)
+	}
+}
+
+func TestCheckSoundsChecked(t *testing.T) {
+	library := testLibrary(t)
+	sounds := library.sounds
+	library.sounds = nil
+	_, err := newChecks(library, []*Check{
+		{Name: "web", URL: "http://example.com/", DownSound: "drama", UpSound: "tada"},
+		{Name: "db", TCP: "db:5432", DownSound: "xylophone"},
+	}, func(c *Check, sound, text string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	library.mu.Lock()
+	defer library.mu.Unlock()
+	library.sounds = sounds
+	problems := library.checkExpected()
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], `check db plays "xylophone", which will fail: unknown sound`) {
+		t.Errorf("got problems %q", problems)
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Server used by client subcommands when none is configured.
+const defaultServer = "http://localhost:8080"
+
+// command is a client subcommand of the jukebox binary.
+type command struct {
+	// Arguments shown in usage, after the command name.
+	args string
+
+	// One-line description of the command.
+	summary string
+
+	// run executes the command and returns the process exit status.
+	run func(args []string) int
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"play":    {"<sound> [--room name] [--zone name]... [--to handle] [--priority] [--server url]", "play a sound or macro", runPlay},
+		"list":    {"[--tag tag] [--json]", "list the sounds in the library", runList},
+		"history": {"[--room name] [--json]", "show recent events in a room", runHistory},
+		"tail":    {"[--room name] [--json]", "stream events from a room", runTail},
+		"alarm":   {"<sound> [--room name] [--every 30s] [--zone name]... [--escalate sound] [--after 5m] [--text text]", "repeat a sound until acknowledged", runAlarm},
+		"ack":     {"<alarm id> [--as name]", "acknowledge an alarm", runAck},
+	}
+}
+
+// usage describes the server flags and the client subcommands.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage:\n  %s [flags]\n        run the server\n", os.Args[0])
+	for _, name := range []string{"play", "list", "history", "tail", "alarm", "ack"} {
+		c := commands[name]
+		fmt.Fprintf(out, "  %s %s %s\n        %s\n", os.Args[0], name, c.args, c.summary)
+	}
+	fmt.Fprintln(out, "\nServer flags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "\nClients read JUKEBOX_SERVER, JUKEBOX_ROOM and JUKEBOX_API_KEY from the environment,")
+	fmt.Fprintln(out, "falling back to server, room and apiKey in $JUKEBOX_CONFIG or <user config dir>/jukebox/config.json.")
+}
+
+// clientConfig holds the settings shared by client subcommands.
+type clientConfig struct {
+	Server string `json:"server"`
+	Room   string `json:"room"`
+	APIKey string `json:"apiKey"`
+
+	// Print JSON rather than text.
+	json bool
+}
+
+// newClientFlags returns a flag set for a subcommand, along with the config
+// that its common flags will fill in.
+//
+// Settings come from the config file, then the environment, then flags.
+func newClientFlags(name string) (*flag.FlagSet, *clientConfig) {
+	cfg := &clientConfig{Server: defaultServer}
+	path := os.Getenv("JUKEBOX_CONFIG")
+	if path == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			path = filepath.Join(dir, "jukebox", "config.json")
+		}
+	}
+	if bb, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(bb, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring %s: %v\n", path, err)
+		}
+	}
+	if v := os.Getenv("JUKEBOX_SERVER"); v != "" {
+		cfg.Server = v
+	}
+	if v := os.Getenv("JUKEBOX_ROOM"); v != "" {
+		cfg.Room = v
+	}
+	if v := os.Getenv("JUKEBOX_API_KEY"); v != "" {
+		cfg.APIKey = v
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&cfg.Server, "server", cfg.Server, "jukebox server URL")
+	fs.StringVar(&cfg.Room, "room", cfg.Room, "room name")
+	fs.BoolVar(&cfg.json, "json", false, "print JSON instead of text")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n", os.Args[0], name, commands[name].args)
+		fs.PrintDefaults()
+	}
+	return fs, cfg
+}
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// parseArgs parses flags that may appear before, between or after
+// positional arguments, and returns the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		// Errors exit, since flag sets are created with ExitOnError.
+		_ = fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// client returns an API client for the configured server and room.
+func (cfg *clientConfig) client() *jukebox.Client {
+	c := jukebox.NewClient(cfg.Server)
+	c.Room = cfg.Room
+	c.APIKey = cfg.APIKey
+	return c
+}
+
+// fail reports an error from a subcommand.
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	return 1
+}
+
+// interrupted returns a context that is canceled on an interrupt signal.
+func interrupted() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+	return ctx
+}
+
+// printJSON writes a value as indented JSON.
+func printJSON(v interface{}) {
+	bb, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+	fmt.Printf("%s\n", bb)
+}
+
+// formatEvent renders an event as a single line of text.
+func formatEvent(e *jukebox.Event) string {
+	var b strings.Builder
+	if e.Seq > 0 {
+		fmt.Fprintf(&b, "#%d ", e.Seq)
+	}
+	if !e.Time.IsZero() {
+		b.WriteString(e.Time.Local().Format("15:04:05") + " ")
+	}
+	if e.Room != "" {
+		b.WriteString("[" + e.Room + "] ")
+	}
+	b.WriteString(e.Type)
+	if e.From != "" {
+		b.WriteString(" <" + e.From + ">")
+	}
+	if e.Ref > 0 {
+		fmt.Fprintf(&b, " re #%d", e.Ref)
+	}
+	if e.Sound != "" {
+		b.WriteString(" " + e.Sound)
+	}
+	if e.Text != "" {
+		b.WriteString(" " + e.Text)
+	}
+	if e.Wait > 0 {
+		fmt.Fprintf(&b, " after %dms", e.Wait)
+	}
+	if e.Group != "" {
+		b.WriteString(" (group " + e.Group + ")")
+	}
+	if e.Replayed {
+		b.WriteString(" [replayed]")
+	}
+	return b.String()
+}
+
+func runPlay(args []string) int {
+	fs, cfg := newClientFlags("play")
+	var zones stringList
+	fs.Var(&zones, "zone", "zone to play in; may be repeated (default all)")
+	to := fs.String("to", "", "whisper to the participant with this handle")
+	priority := fs.Bool("priority", false, "play even for clients in do-not-disturb")
+	names := parseArgs(fs, args)
+	if len(names) != 1 {
+		fs.Usage()
+		return 2
+	}
+	opts := &jukebox.PlayOptions{Zones: zones, To: *to, Priority: *priority}
+	if err := cfg.client().Play(interrupted(), names[0], opts); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func runList(args []string) int {
+	fs, cfg := newClientFlags("list")
+	var tag string
+	fs.StringVar(&tag, "tag", "", "only list sounds with this tag")
+	if len(parseArgs(fs, args)) != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	sounds, err := cfg.client().List(interrupted(), tag)
+	if err != nil {
+		return fail(err)
+	}
+
+	if cfg.json {
+		printJSON(sounds)
+		return 0
+	}
+	for _, s := range sounds {
+		line := s.Name
+		if len(s.Aliases) > 0 {
+			line += " (" + strings.Join(s.Aliases, ", ") + ")"
+		}
+		if len(s.Tags) > 0 {
+			line += " [" + strings.Join(s.Tags, ", ") + "]"
+		}
+		if s.Audio != nil {
+			line += fmt.Sprintf(" %.1fs", float64(s.Audio.Duration)/1000)
+		}
+		fmt.Println(line)
+	}
+	return 0
+}
+
+func runHistory(args []string) int {
+	fs, cfg := newClientFlags("history")
+	if len(parseArgs(fs, args)) != 0 {
+		fs.Usage()
+		return 2
+	}
+	events, err := cfg.client().History(interrupted())
+	if err != nil {
+		return fail(err)
+	}
+	if cfg.json {
+		printJSON(events)
+		return 0
+	}
+	for _, e := range events {
+		fmt.Println(formatEvent(e))
+	}
+	return 0
+}
+
+func runTail(args []string) int {
+	fs, cfg := newClientFlags("tail")
+	if len(parseArgs(fs, args)) != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	ctx := interrupted()
+	err := cfg.client().Subscribe(ctx, func(e *jukebox.Event) {
+		if !cfg.json {
+			fmt.Println(formatEvent(e))
+			return
+		}
+		bb, err := json.Marshal(e)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return
+		}
+		fmt.Printf("%s\n", bb)
+	}, func(err error) {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+	})
+	if err == context.Canceled {
+		return 0
+	}
+	return fail(err)
+}
+
+func runAlarm(args []string) int {
+	fs, cfg := newClientFlags("alarm")
+	alarm := &jukebox.Alarm{}
+	var zones stringList
+	fs.StringVar(&alarm.Every, "every", "", "how often to repeat the sound (default 30s)")
+	fs.Var(&zones, "zone", "zone to play in; may be repeated (default all)")
+	fs.StringVar(&alarm.EscalateTo, "escalate", "", "sound to switch to if nobody acknowledges the alarm")
+	fs.StringVar(&alarm.EscalateAfter, "after", "", "how long to wait before escalating (default 5m)")
+	fs.StringVar(&alarm.Text, "text", "", "what the alarm is about")
+	names := parseArgs(fs, args)
+	if len(names) != 1 {
+		fs.Usage()
+		return 2
+	}
+	alarm.Sound = names[0]
+	alarm.Zones = zones
+
+	started, err := cfg.client().StartAlarm(interrupted(), alarm)
+	if err != nil {
+		return fail(err)
+	}
+	if cfg.json {
+		printJSON(started)
+		return 0
+	}
+	fmt.Println(started.ID)
+	return 0
+}
+
+func runAck(args []string) int {
+	fs, cfg := newClientFlags("ack")
+	by := fs.String("as", os.Getenv("USER"), "name to record as acknowledging the alarm")
+	ids := parseArgs(fs, args)
+	if len(ids) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	alarm, err := cfg.client().Acknowledge(interrupted(), ids[0], *by)
+	if err != nil {
+		return fail(err)
+	}
+	if cfg.json {
+		printJSON(alarm)
+		return 0
+	}
+	fmt.Printf("Alarm %s acknowledged by %s at %s\n", alarm.ID, alarm.AckedBy, alarm.AckedAt.Local().Format("15:04:05"))
+	return 0
+}
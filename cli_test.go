@@ -0,0 +1,92 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestClientFlagPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	file := `{"server": "http://file:8080", "room": "file-room", "apiKey": "file-key"}`
+	tests := []struct {
+		name   string
+		file   string
+		env    map[string]string
+		args   []string
+		want   clientConfig
+		params []string
+	}{
+		{
+			name: "defaults",
+			want: clientConfig{Server: defaultServer},
+		},
+		{
+			name: "config file",
+			file: file,
+			want: clientConfig{Server: "http://file:8080", Room: "file-room", APIKey: "file-key"},
+		},
+		{
+			name: "environment over config file",
+			file: file,
+			env:  map[string]string{"JUKEBOX_SERVER": "http://env:8080", "JUKEBOX_API_KEY": "env-key"},
+			want: clientConfig{Server: "http://env:8080", Room: "file-room", APIKey: "env-key"},
+		},
+		{
+			name: "flags over environment",
+			file: file,
+			env:  map[string]string{"JUKEBOX_SERVER": "http://env:8080", "JUKEBOX_ROOM": "env-room"},
+			args: []string{"--server", "http://flag:8080", "--room=flag-room"},
+			want: clientConfig{Server: "http://flag:8080", Room: "flag-room", APIKey: "file-key"},
+		},
+		{
+			name:   "flags among arguments",
+			env:    map[string]string{"JUKEBOX_ROOM": "env-room"},
+			args:   []string{"tada", "--json", "bell", "--room", "flag-room", "--", "--not-a-flag"},
+			want:   clientConfig{Server: defaultServer, Room: "flag-room", json: true},
+			params: []string{"tada", "bell", "--not-a-flag"},
+		},
+		{
+			name: "broken config file",
+			file: `{"server": `,
+			env:  map[string]string{"JUKEBOX_ROOM": "env-room"},
+			want: clientConfig{Server: defaultServer, Room: "env-room"},
+		},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, "missing.json")
+		if tt.file != "" {
+			path = filepath.Join(dir, tt.name+".json")
+			if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		t.Setenv("JUKEBOX_CONFIG", path)
+		for _, k := range []string{"JUKEBOX_SERVER", "JUKEBOX_ROOM", "JUKEBOX_API_KEY"} {
+			t.Setenv(k, tt.env[k])
+		}
+		fs, cfg := newClientFlags("play")
+		params := parseArgs(fs, tt.args)
+		if *cfg != tt.want {
+			t.Errorf("%d. %s: got %+v, want %+v", i, tt.name, *cfg, tt.want)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("%d. %s: arguments %q, want %q", i, tt.name, params, tt.params)
+		}
+	}
+}
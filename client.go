@@ -6,11 +6,14 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/merenbach/sound-machine/jukebox"
 )
 
 const (
@@ -23,8 +26,9 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer, with room for a chat message
+	// of maxChatLength characters.
+	maxMessageSize = 4096
 )
 
 var (
@@ -37,15 +41,119 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-// Client is a middleman between the websocket connection and the hub.
+// Client is a middleman between a connection and the hub.
+//
+// The hub only ever deals with the send channel, so the same client can be
+// carried over a websocket, a Server-Sent Events stream or long polling.
 type Client struct {
 	hub *Hub
 
-	// The websocket connection.
-	conn *websocket.Conn
-
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// Whether to replay the events after since when registering.
+	resume bool
+
+	// Sequence number of the last event the peer saw before reconnecting.
+	since uint64
+
+	// Role of the peer, either jukebox.RoleSpeaker or jukebox.RoleController.
+	role string
+
+	// Zone labels of a speaker, such as "kitchen".
+	zones []string
+
+	// Presence handle of the participant, such as "alice", if given.
+	handle string
+
+	// Preferences filtering the plays sent to the peer, or nil. Only the
+	// hub's goroutine may change them once the client is registered.
+	prefs *jukebox.Preferences
+
+	// Events of the participant's theme, resolved before registering so
+	// that the hub's goroutine never waits on the library.
+	theme []*jukebox.Event
+
+	// Do-not-disturb state, or nil. Only the hub's goroutine may use it.
+	dnd *dnd
+}
+
+func newClient(hub *Hub) *Client {
+	return &Client{hub: hub, send: make(chan []byte, 256), role: jukebox.RoleSpeaker}
+}
+
+// newClientFromRequest creates a client configured by the query of the
+// request that opened its connection:
+//
+//	since  sequence number of the last event seen, to resume after
+//	role   "speaker" (the default) or "controller"
+//	zone   a zone label for a speaker; may be repeated
+//	handle the participant's presence handle, which restores any
+//	       preferences saved for it
+//
+// The Last-Event-ID header of a reconnecting EventSource also sets since.
+func newClientFromRequest(hub *Hub, r *http.Request) (*Client, error) {
+	c := newClient(hub)
+	q := r.URL.Query()
+
+	since := q.Get("since")
+	if since == "" {
+		since = r.Header.Get("Last-Event-ID")
+	}
+	if since != "" {
+		n, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sequence number %q", since)
+		}
+		c.resume, c.since = true, n
+	}
+
+	switch role := q.Get("role"); role {
+	case "", jukebox.RoleSpeaker:
+	case jukebox.RoleController:
+		c.role = jukebox.RoleController
+	default:
+		return nil, fmt.Errorf("invalid role %q", role)
+	}
+
+	for _, z := range q["zone"] {
+		if !validLabel.MatchString(z) {
+			return nil, fmt.Errorf("invalid zone %q", z)
+		}
+		c.zones = append(c.zones, z)
+	}
+
+	if handle := q.Get("handle"); handle != "" {
+		if !validLabel.MatchString(handle) {
+			return nil, fmt.Errorf("invalid handle %q", handle)
+		}
+		c.handle = handle
+		c.prefs = hub.prefs.get(handle)
+	}
+	if c.prefs != nil && c.prefs.Theme != "" {
+		events, err := hub.library.resolve(c.prefs.Theme)
+		if err != nil {
+			log.Println(err)
+		}
+		c.theme = events
+	}
+	return c, nil
+}
+
+// dispatch acts on a message from the peer, reporting any failure back to it.
+func (c *Client) dispatch(message []byte) {
+	if err := c.hub.handle(c, message); err != nil {
+		log.Println(err)
+		c.hub.direct <- delivery{client: c, event: errorEvent(err)}
+	}
+}
+
+// wsClient is a client connected over a websocket.
+type wsClient struct {
+	*Client
+
+	// The websocket connection.
+	conn *websocket.Conn
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -53,9 +161,9 @@ type Client struct {
 // The application runs readPump in a per-connection goroutine. The application
 // ensures that there is at most one reader on a connection by executing all
 // reads from this goroutine.
-func (c *Client) readPump() {
+func (c *wsClient) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		c.hub.unregister <- c.Client
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
@@ -70,7 +178,7 @@ func (c *Client) readPump() {
 			break
 		}
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.hub.broadcast <- message
+		c.dispatch(message)
 	}
 }
 
@@ -79,7 +187,7 @@ func (c *Client) readPump() {
 // A goroutine running writePump is started for each connection. The
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
-func (c *Client) writePump() {
+func (c *wsClient) writePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
@@ -122,13 +230,18 @@ func (c *Client) writePump() {
 
 // serveWs handles websocket requests from the peer.
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	c, err := newClientFromRequest(hub, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client
+	client := &wsClient{Client: c, conn: conn}
+	client.hub.register <- client.Client
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
@@ -0,0 +1,92 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Config holds optional server settings read from a JSON file.
+type Config struct {
+	// Macros maps macro names to definitions, e.g. "tada, wait 500ms, yeah x2".
+	Macros map[string]string `json:"macros"`
+
+	// APIKeys, if any, are required to play sounds or change macros over HTTP.
+	APIKeys []string `json:"apiKeys"`
+
+	// Rooms maps room names to their initial settings.
+	Rooms map[string]RoomSettings `json:"rooms"`
+
+	// Triggers play sounds when chat messages match them.
+	Triggers []*Trigger `json:"triggers"`
+
+	// Heartbeats play sounds when the jobs that ping them stop.
+	Heartbeats []*Heartbeat `json:"heartbeats"`
+
+	// Checks poll endpoints and play sounds when they go down or come up.
+	Checks []*Check `json:"checks"`
+
+	// Watches tail log files and play sounds for matching lines.
+	Watches []*Watch `json:"watches"`
+
+	// Hooks map webhook IDs to the rules for their payloads.
+	Hooks map[string]*Hook `json:"hooks"`
+
+	// GitHub and GitLab receive webhooks from those forges.
+	GitHub *Forge `json:"github"`
+	GitLab *Forge `json:"gitlab"`
+
+	// Alertmanager receives notifications from Prometheus Alertmanager.
+	Alertmanager *Alertmanager `json:"alertmanager"`
+}
+
+// loadConfig reads a JSON config file. An empty path yields an empty config.
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	bb, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bb, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// duration is a time.Duration written in JSON as a string such as "10m".
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(bb []byte) error {
+	var s string
+	if err := json.Unmarshal(bb, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = duration(v)
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Most plays a client is told it missed in one summary.
+const maxMissed = 100
+
+// dnd is a client's do-not-disturb state, owned by the hub's goroutine.
+type dnd struct {
+	// End of a do-not-disturb period that was set for a duration.
+	until time.Time
+
+	// Daily quiet hours, or nil.
+	quiet *quietHours
+
+	// Sounds held back, oldest first, and how many there were in all.
+	missed []string
+	count  int
+}
+
+// dndRequest is a request from a client to change its do-not-disturb state.
+type dndRequest struct {
+	client *Client
+	dnd    *dnd
+}
+
+// quietHours is a daily span of time, in minutes since local midnight. A
+// span that ends before it starts runs past midnight.
+type quietHours struct {
+	start, end int
+}
+
+// parseQuietHours parses a span such as "18:00-09:00".
+func parseQuietHours(s string) (*quietHours, error) {
+	var h1, m1, h2, m2 int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q", s)
+	}
+	for _, n := range []int{h1, h2} {
+		if n < 0 || n > 23 {
+			return nil, fmt.Errorf("invalid schedule %q", s)
+		}
+	}
+	for _, n := range []int{m1, m2} {
+		if n < 0 || n > 59 {
+			return nil, fmt.Errorf("invalid schedule %q", s)
+		}
+	}
+	return &quietHours{start: h1*60 + m1, end: h2*60 + m2}, nil
+}
+
+// String formats the span as it is parsed.
+func (q *quietHours) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", q.start/60, q.start%60, q.end/60, q.end%60)
+}
+
+// contains reports whether a time falls within the span.
+func (q *quietHours) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if q.start <= q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// parseDND turns a client's request into do-not-disturb state.
+func parseDND(req *jukebox.DoNotDisturb, now time.Time) (*dnd, error) {
+	d := &dnd{}
+	if req == nil {
+		return d, nil
+	}
+	if req.For != "" {
+		dur, err := time.ParseDuration(req.For)
+		if err != nil || dur <= 0 {
+			return nil, fmt.Errorf("invalid duration %q", req.For)
+		}
+		d.until = now.Add(dur)
+	} else if req.Until != nil {
+		d.until = *req.Until
+	}
+	if req.Schedule != "" {
+		q, err := parseQuietHours(req.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		d.quiet = q
+	}
+	return d, nil
+}
+
+// on reports whether do-not-disturb is in effect at a time.
+func (d *dnd) on(t time.Time) bool {
+	return t.Before(d.until) || (d.quiet != nil && d.quiet.contains(t))
+}
+
+// state describes the do-not-disturb settings to the client.
+func (d *dnd) state() *jukebox.DoNotDisturb {
+	s := &jukebox.DoNotDisturb{}
+	if !d.until.IsZero() && time.Now().Before(d.until) {
+		until := d.until
+		s.Until = &until
+	}
+	if d.quiet != nil {
+		s.Schedule = d.quiet.String()
+	}
+	return s
+}
+
+// hold notes a play held back from the client.
+func (d *dnd) hold(e *jukebox.Event) {
+	d.count++
+	if len(d.missed) < maxMissed {
+		d.missed = append(d.missed, e.Sound)
+	}
+}
+
+// quiet reports whether a client should be spared a play for now.
+func (c *Client) quiet(e *jukebox.Event) bool {
+	return c.dnd != nil && !e.Priority && c.dnd.on(time.Now())
+}
+
+// setDND replaces a client's do-not-disturb state and tells it about it,
+// along with anything it missed if do-not-disturb has ended.
+func (h *Hub) setDND(req dndRequest) {
+	client := req.client
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	old := client.dnd
+	client.dnd = req.dnd
+	if old != nil {
+		client.dnd.missed, client.dnd.count = old.missed, old.count
+	}
+	h.deliver(client, encodeEvent(&jukebox.Event{
+		Type: jukebox.EventDND,
+		Room: h.room,
+		Time: time.Now(),
+		DND:  client.dnd.state(),
+	}))
+	h.checkDND(client, time.Now())
+}
+
+// checkDND sends a client a summary of the plays it missed once its
+// do-not-disturb has ended.
+func (h *Hub) checkDND(client *Client, now time.Time) {
+	d := client.dnd
+	if d == nil {
+		return
+	}
+	if d.count == 0 || d.on(now) {
+		return
+	}
+	h.deliver(client, encodeEvent(&jukebox.Event{
+		Type:   jukebox.EventDND,
+		Room:   h.room,
+		Time:   now,
+		DND:    d.state(),
+		Text:   fmt.Sprintf("missed %d plays", d.count),
+		Missed: d.missed,
+	}))
+	d.missed, d.count = nil, 0
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+func TestDoNotDisturb(t *testing.T) {
+	rooms := testRooms(t)
+	h, err := rooms.get(defaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := connect(t, h, "handle=alice"), connect(t, h, "handle=bob")
+	received(t, alice)
+	received(t, bob)
+
+	tests := []struct {
+		name     string
+		message  string
+		priority bool
+		err      string
+
+		// What alice and bob are sent, and the plays alice is told were missed.
+		alice  string
+		bob    string
+		missed []string
+	}{
+		{name: "start", message: `{"type":"dnd","dnd":{"for":"30m"}}`, alice: "dnd:"},
+		{name: "play", message: "tada", bob: "play:tada"},
+		{name: "macro", message: "celebrate", bob: "play:tada play:bell play:bell"},
+		{name: "priority", message: "drama", priority: true, alice: "play:drama", bob: "play:drama"},
+		{name: "client priority", message: `{"type":"play","sound":"bell","priority":true}`, err: errPriority.Error()},
+		{name: "bad duration", message: `{"type":"dnd","dnd":{"for":"-5m"}}`, err: `invalid duration "-5m"`},
+		{name: "bad schedule", message: `{"type":"dnd","dnd":{"schedule":"25:00-09:00"}}`, err: `invalid schedule "25:00-09:00"`},
+		{name: "end", message: `{"type":"dnd"}`, alice: "dnd: dnd:", missed: []string{"tada", "tada", "bell", "bell"}},
+		{name: "after", message: "bell", alice: "play:bell", bob: "play:bell"},
+	}
+	for _, tt := range tests {
+		if tt.priority {
+			err = h.play(tt.message, jukebox.PlayOptions{Priority: true})
+		} else {
+			err = h.handle(alice, []byte(tt.message))
+		}
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+		events := received(t, alice)
+		if got := strings.Join(summarize(events), " "); got != tt.alice {
+			t.Errorf("%s: alice got %q, want %q", tt.name, got, tt.alice)
+		}
+		if got := strings.Join(summarize(received(t, bob)), " "); got != tt.bob {
+			t.Errorf("%s: bob got %q, want %q", tt.name, got, tt.bob)
+		}
+		var missed []string
+		for _, e := range events {
+			missed = append(missed, e.Missed...)
+		}
+		if !reflect.DeepEqual(missed, tt.missed) {
+			t.Errorf("%s: alice missed %q, want %q", tt.name, missed, tt.missed)
+		}
+	}
+}
+
+func TestPriorityOptions(t *testing.T) {
+	tests := []struct {
+		query         string
+		authenticated bool
+		want          bool
+		err           error
+	}{
+		{query: "", want: false},
+		{query: "priority=false", want: false},
+		{query: "priority=true", authenticated: true, want: true},
+		{query: "priority=1", authenticated: true, want: true},
+		{query: "priority=true", err: errPriority},
+	}
+	for _, tt := range tests {
+		opts, err := optionsFromRequest(httptest.NewRequest("POST", "/play/tada?"+tt.query, nil), tt.authenticated)
+		if err != tt.err || opts.Priority != tt.want {
+			t.Errorf("%q (authenticated %v): priority %v, %v; want %v, %v", tt.query, tt.authenticated, opts.Priority, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	tests := []struct {
+		schedule string
+		at       string
+		want     bool
+	}{
+		{schedule: "09:00-17:00", at: "08:59", want: false},
+		{schedule: "09:00-17:00", at: "09:00", want: true},
+		{schedule: "09:00-17:00", at: "17:00", want: false},
+		{schedule: "18:00-09:00", at: "23:30", want: true},
+		{schedule: "18:00-09:00", at: "03:00", want: true},
+		{schedule: "18:00-09:00", at: "12:00", want: false},
+	}
+	for _, tt := range tests {
+		q, err := parseQuietHours(tt.schedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at, err := time.Parse("15:04", tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.contains(at); got != tt.want {
+			t.Errorf("%s contains %s = %v, want %v", tt.schedule, tt.at, got, tt.want)
+		}
+		if q.String() != tt.schedule {
+			t.Errorf("%s formats as %s", tt.schedule, q)
+		}
+	}
+}
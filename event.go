@@ -0,0 +1,53 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// errorEvent describes a failed request to the client that made it.
+func errorEvent(err error) *jukebox.Event {
+	e := &jukebox.Event{Type: jukebox.EventError, Text: err.Error(), Time: time.Now()}
+	if re, ok := err.(*ResolveError); ok {
+		e.Suggestions = re.Suggestions
+	}
+	return e
+}
+
+// encodeEvent marshals an event for the wire.
+func encodeEvent(e *jukebox.Event) []byte {
+	bb, err := json.Marshal(e)
+	if err != nil {
+		log.Println("Could not encode event:", err)
+		return nil
+	}
+	return bb
+}
+
+// newID returns a random identifier suitable for event groups.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+var (
+	errNoSpeakers = errors.New("no speakers are connected to this room")
+	errNoWhispers = errors.New("whispers are disabled in this room")
+	errPriority   = errors.New("priority plays need an API key")
+)
+
+// How a client should see an event.
+const (
+	// viewNone means the client is not sent the event at all.
+	viewNone = iota
+
+	// viewFull means the client is sent the event as is.
+	viewFull
+
+	// viewAnnounce means the client is told about a play without being asked
+	// to play it.
+	viewAnnounce
+
+	// viewHeld means the client is in do-not-disturb, so the play is held
+	// back until it ends.
+	viewHeld
+)
+
+// view decides how a client should see an event.
+func (c *Client) view(e *jukebox.Event) int {
+	if e.To != "" && e.To != c.handle {
+		return viewNone
+	}
+	if e.Type != jukebox.EventPlay {
+		return viewFull
+	}
+	if !c.wants(e) {
+		return viewNone
+	}
+	if c.role == jukebox.RoleController {
+		return viewAnnounce
+	}
+	if len(e.Zones) > 0 && !c.inZone(e.Zones) {
+		return viewAnnounce
+	}
+	if c.quiet(e) {
+		return viewHeld
+	}
+	return viewFull
+}
+
+// inZone reports whether the client carries any of the given zone labels.
+func (c *Client) inZone(zones []string) bool {
+	for _, z := range zones {
+		for _, cz := range c.zones {
+			if z == cz {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyOptions narrows where a batch of play events is heard.
+func applyOptions(events []*jukebox.Event, opts jukebox.PlayOptions) {
+	for _, e := range events {
+		e.Zones = opts.Zones
+		e.To = opts.To
+		e.Priority = opts.Priority
+	}
+}
+
+// validateOptions checks the labels in a play's options.
+func validateOptions(opts jukebox.PlayOptions) error {
+	for _, z := range opts.Zones {
+		if !validLabel.MatchString(z) {
+			return fmt.Errorf("invalid zone %q", z)
+		}
+	}
+	if opts.To != "" && !validLabel.MatchString(opts.To) {
+		return fmt.Errorf("invalid handle %q", opts.To)
+	}
+	return nil
+}
+
+// Target is where the server plays sounds on its own behalf, such as for a
+// heartbeat or a webhook: a room, and optionally some of its zones.
+type Target struct {
+	// Room to play in; empty means the default room.
+	Room string `json:"room,omitempty"`
+
+	// Zones whose speakers should play the sounds; empty means all of them.
+	Zones []string `json:"zones,omitempty"`
+}
+
+// validate checks the room name and zone labels.
+func (t Target) validate() error {
+	if t.Room != "" && !validRoom.MatchString(t.Room) {
+		return fmt.Errorf("invalid room %q", t.Room)
+	}
+	return validateOptions(jukebox.PlayOptions{Zones: t.Zones})
+}
+
+// optionsFromRequest reads play options from a request's query: any number
+// of "zone" parameters, a handle to whisper to as "to", and "priority", which
+// only requests carrying an API key may set.
+func optionsFromRequest(r *http.Request, authenticated bool) (jukebox.PlayOptions, error) {
+	q := r.URL.Query()
+	opts := jukebox.PlayOptions{Zones: q["zone"], To: q.Get("to")}
+	if v := q.Get("priority"); v != "" {
+		priority, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid priority %q", v)
+		}
+		if priority && !authenticated {
+			return opts, errPriority
+		}
+		opts.Priority = priority
+	}
+	return opts, validateOptions(opts)
+}
+
+// announcement returns a copy of a play event for clients that should only
+// display it.
+func announcement(e *jukebox.Event) *jukebox.Event {
+	a := *e
+	a.Type = jukebox.EventAnnounce
+	return &a
+}
@@ -0,0 +1,202 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSpeakerRoles(t *testing.T) {
+	rooms := testRooms(t)
+	rooms.settings = map[string]RoomSettings{"quiet": {RequireSpeaker: true}}
+	h, err := rooms.get("quiet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller := connect(t, h, "role=controller")
+	settle(h)
+	if err := h.handle(nil, []byte("tada")); err != errNoSpeakers {
+		t.Errorf("play without speakers: got %v, want errNoSpeakers", err)
+	}
+	speaker := connect(t, h, "role=speaker")
+	other := connect(t, h, "")
+	settle(h)
+	if st := h.Status(); st.Speakers != 2 || st.Controllers != 1 {
+		t.Errorf("status counts %d speakers and %d controllers, want 2 and 1", st.Speakers, st.Controllers)
+	}
+	if err := h.handle(nil, []byte("tada")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		client *Client
+		want   []string
+	}{
+		{name: "controller", client: controller, want: []string{"announce:tada"}},
+		{name: "speaker", client: speaker, want: []string{"play:tada"}},
+		{name: "default role", client: other, want: []string{"play:tada"}},
+	}
+	for _, tt := range tests {
+		if got := summarize(received(t, tt.client)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := summarize(h.since(0)); !reflect.DeepEqual(got, []string{"play:tada"}) {
+		t.Errorf("history %q, want the play alone", got)
+	}
+
+	h.unregister <- speaker
+	h.unregister <- other
+	settle(h)
+	if err := h.handle(nil, []byte(`{"type":"play","sound":"bell"}`)); err != errNoSpeakers {
+		t.Errorf("play after speakers left: got %v, want errNoSpeakers", err)
+	}
+}
+
+func TestZones(t *testing.T) {
+	rooms := testRooms(t)
+	h, err := rooms.get(defaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := []*Client{
+		connect(t, h, "zone=desk"),
+		connect(t, h, "zone=desk&zone=lobby"),
+		connect(t, h, ""),
+		connect(t, h, "role=controller&zone=desk"),
+	}
+	for _, c := range clients {
+		received(t, c)
+	}
+
+	tests := []struct {
+		message string
+		err     string
+
+		// What each client is sent, in order of clients.
+		want []string
+	}{
+		{
+			message: "tada",
+			want:    []string{"play:tada", "play:tada", "play:tada", "announce:tada"},
+		},
+		{
+			message: `{"type":"play","sound":"bell","zones":["desk"]}`,
+			want:    []string{"play:bell", "play:bell", "announce:bell", "announce:bell"},
+		},
+		{
+			message: `{"type":"play","sound":"drama","zones":["lobby","attic"]}`,
+			want:    []string{"announce:drama", "play:drama", "announce:drama", "announce:drama"},
+		},
+		{
+			message: `{"type":"play","sound":"bell","zones":["attic"]}`,
+			want:    []string{"announce:bell", "announce:bell", "announce:bell", "announce:bell"},
+		},
+		{
+			message: `{"type":"play","sound":"bell","zones":["no good"]}`,
+			err:     `invalid zone "no good"`,
+			want:    []string{"", "", "", ""},
+		},
+	}
+	for _, tt := range tests {
+		err := h.handle(nil, []byte(tt.message))
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.message, err, tt.err)
+		}
+		for i, c := range clients {
+			got := strings.Join(summarize(received(t, c)), " ")
+			if got != tt.want[i] {
+				t.Errorf("%s: client %d got %q, want %q", tt.message, i, got, tt.want[i])
+			}
+		}
+	}
+	if got := h.Zones(); !reflect.DeepEqual(got, []Zone{{"desk", 2}, {"lobby", 1}}) {
+		t.Errorf("zones %+v, want desk on 2 speakers and lobby on 1", got)
+	}
+}
+
+func TestWhispers(t *testing.T) {
+	rooms := testRooms(t)
+	rooms.settings = map[string]RoomSettings{"hushed": {DisableWhispers: true}}
+	h, err := rooms.get(defaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := []*Client{
+		connect(t, h, "handle=alice"),
+		connect(t, h, "handle=alice&role=controller"),
+		connect(t, h, "handle=bob"),
+		connect(t, h, ""),
+	}
+	for _, c := range clients {
+		received(t, c)
+	}
+
+	tests := []struct {
+		message string
+		err     string
+
+		// What each client is sent, in order of clients.
+		want []string
+	}{
+		{
+			message: `{"type":"play","sound":"tada","to":"alice"}`,
+			want:    []string{"play:tada", "announce:tada", "", ""},
+		},
+		{
+			message: `{"type":"play","sound":"bell","to":"bob","zones":["attic"]}`,
+			want:    []string{"", "", "announce:bell", ""},
+		},
+		{
+			message: `{"type":"play","sound":"bell","to":"carol"}`,
+			err:     `"carol" is not in this room`,
+			want:    []string{"", "", "", ""},
+		},
+		{
+			message: `{"type":"play","sound":"bell","to":"al ice"}`,
+			err:     `invalid handle "al ice"`,
+			want:    []string{"", "", "", ""},
+		},
+	}
+	for _, tt := range tests {
+		err := h.handle(nil, []byte(tt.message))
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.message, err, tt.err)
+		}
+		for i, c := range clients {
+			got := strings.Join(summarize(received(t, c)), " ")
+			if got != tt.want[i] {
+				t.Errorf("%s: client %d got %q, want %q", tt.message, i, got, tt.want[i])
+			}
+		}
+	}
+	if got := h.since(0); len(got) != 0 {
+		t.Errorf("whispers were remembered: %q", summarize(got))
+	}
+
+	hushed, err := rooms.get("hushed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect(t, hushed, "handle=alice")
+	settle(hushed)
+	if err := hushed.handle(nil, []byte(`{"type":"play","sound":"tada","to":"alice"}`)); err != errNoWhispers {
+		t.Errorf("whisper in hushed room: got %v, want errNoWhispers", err)
+	}
+}
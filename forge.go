@@ -0,0 +1,296 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Kinds of forge events that can play sounds.
+const (
+	forgePush     = "push"
+	forgeMerged   = "merged"
+	forgeFailed   = "failed"
+	forgeRelease  = "release"
+	forgeDeployed = "deployed"
+)
+
+// Branch whose pushes count, unless a forge says.
+const defaultForgeBranch = "main"
+
+// Forge receives webhooks from GitHub or GitLab and plays a sound for each
+// kind of event it cares about.
+type Forge struct {
+	// Secret is the GitHub webhook secret that signs payloads.
+	Secret string `json:"secret,omitempty"`
+
+	// Token is the GitLab secret token sent with each payload.
+	Token string `json:"token,omitempty"`
+
+	// Where the sounds play.
+	Target
+
+	// Branch whose pushes, merges and failures count; empty means "main".
+	Branch string `json:"branch,omitempty"`
+
+	// Sounds maps event kinds to sounds: "push", "merged", "failed",
+	// "release" and "deployed". Kinds left out are ignored.
+	Sounds map[string]string `json:"sounds"`
+}
+
+// forgeEvent is a webhook boiled down to what the jukebox plays.
+type forgeEvent struct {
+	kind string
+	text string
+}
+
+// check validates the settings of the forge named, "github" or "gitlab",
+// and has the library check its sounds once it is loaded.
+func (f *Forge) check(library *Library, name string) error {
+	if err := f.Target.validate(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for kind, sound := range f.Sounds {
+		switch kind {
+		case forgePush, forgeMerged, forgeFailed, forgeRelease, forgeDeployed:
+		default:
+			return fmt.Errorf("%s: unknown event kind %q", name, kind)
+		}
+		library.expect(sound, name+" "+kind+" event")
+	}
+	switch {
+	case name == "github" && f.Secret == "":
+		log.Println("Warning: github webhooks have no secret, so anyone can call them")
+	case name == "gitlab" && f.Token == "":
+		log.Println("Warning: gitlab webhooks have no token, so anyone can call them")
+	}
+	return nil
+}
+
+func (f *Forge) branch() string {
+	if f.Branch == "" {
+		return defaultForgeBranch
+	}
+	return f.Branch
+}
+
+// parseGitHub reads a GitHub webhook of the type given in X-GitHub-Event.
+// It returns nil for events the jukebox does not play.
+func parseGitHub(event string, body []byte, branch string) (*forgeEvent, error) {
+	var p struct {
+		Action string `json:"action"`
+		Ref    string `json:"ref"`
+		Pusher struct {
+			Name string `json:"name"`
+		} `json:"pusher"`
+		Commits    []json.RawMessage `json:"commits"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+		PullRequest struct {
+			Number int    `json:"number"`
+			Title  string `json:"title"`
+			Merged bool   `json:"merged"`
+			Base   struct {
+				Ref string `json:"ref"`
+			} `json:"base"`
+		} `json:"pull_request"`
+		WorkflowRun struct {
+			Name       string `json:"name"`
+			HeadBranch string `json:"head_branch"`
+			Conclusion string `json:"conclusion"`
+		} `json:"workflow_run"`
+		Release struct {
+			TagName string `json:"tag_name"`
+			Name    string `json:"name"`
+		} `json:"release"`
+		Deployment struct {
+			Environment string `json:"environment"`
+			Ref         string `json:"ref"`
+		} `json:"deployment"`
+		DeploymentStatus struct {
+			State string `json:"state"`
+		} `json:"deployment_status"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	repo := p.Repository.FullName
+
+	switch event {
+	case "push":
+		if p.Ref != "refs/heads/"+branch {
+			return nil, nil
+		}
+		return &forgeEvent{forgePush, fmt.Sprintf("%s pushed %d commits to %s in %s", p.Pusher.Name, len(p.Commits), branch, repo)}, nil
+	case "pull_request":
+		if p.Action != "closed" || !p.PullRequest.Merged || p.PullRequest.Base.Ref != branch {
+			return nil, nil
+		}
+		return &forgeEvent{forgeMerged, fmt.Sprintf("%s#%d merged: %s", repo, p.PullRequest.Number, p.PullRequest.Title)}, nil
+	case "workflow_run":
+		if p.Action != "completed" || p.WorkflowRun.Conclusion != "failure" || p.WorkflowRun.HeadBranch != branch {
+			return nil, nil
+		}
+		return &forgeEvent{forgeFailed, fmt.Sprintf("%s failed on %s in %s", p.WorkflowRun.Name, branch, repo)}, nil
+	case "release":
+		if p.Action != "published" {
+			return nil, nil
+		}
+		return &forgeEvent{forgeRelease, fmt.Sprintf("%s %s released", repo, releaseName(p.Release.Name, p.Release.TagName))}, nil
+	case "deployment_status":
+		if p.DeploymentStatus.State != "success" {
+			return nil, nil
+		}
+		return &forgeEvent{forgeDeployed, fmt.Sprintf("%s deployed %s to %s", repo, p.Deployment.Ref, p.Deployment.Environment)}, nil
+	}
+	return nil, nil
+}
+
+// parseGitLab reads a GitLab webhook, whose type is given by object_kind.
+// It returns nil for events the jukebox does not play.
+func parseGitLab(body []byte, branch string) (*forgeEvent, error) {
+	var p struct {
+		ObjectKind   string            `json:"object_kind"`
+		Ref          string            `json:"ref"`
+		UserName     string            `json:"user_name"`
+		TotalCommits int               `json:"total_commits_count"`
+		Commits      []json.RawMessage `json:"commits"`
+		Project      struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+		} `json:"project"`
+		ObjectAttributes struct {
+			IID          int    `json:"iid"`
+			Title        string `json:"title"`
+			Action       string `json:"action"`
+			Status       string `json:"status"`
+			Ref          string `json:"ref"`
+			TargetBranch string `json:"target_branch"`
+		} `json:"object_attributes"`
+		Action      string `json:"action"`
+		Name        string `json:"name"`
+		Tag         string `json:"tag"`
+		Status      string `json:"status"`
+		Environment string `json:"environment"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	project := p.Project.PathWithNamespace
+
+	switch p.ObjectKind {
+	case "push":
+		if p.Ref != "refs/heads/"+branch {
+			return nil, nil
+		}
+		n := p.TotalCommits
+		if n == 0 {
+			n = len(p.Commits)
+		}
+		return &forgeEvent{forgePush, fmt.Sprintf("%s pushed %d commits to %s in %s", p.UserName, n, branch, project)}, nil
+	case "merge_request":
+		if p.ObjectAttributes.Action != "merge" || p.ObjectAttributes.TargetBranch != branch {
+			return nil, nil
+		}
+		return &forgeEvent{forgeMerged, fmt.Sprintf("%s!%d merged: %s", project, p.ObjectAttributes.IID, p.ObjectAttributes.Title)}, nil
+	case "pipeline":
+		if p.ObjectAttributes.Status != "failed" || p.ObjectAttributes.Ref != branch {
+			return nil, nil
+		}
+		return &forgeEvent{forgeFailed, fmt.Sprintf("pipeline failed on %s in %s", branch, project)}, nil
+	case "release":
+		if p.Action != "create" {
+			return nil, nil
+		}
+		return &forgeEvent{forgeRelease, fmt.Sprintf("%s %s released", project, releaseName(p.Name, p.Tag))}, nil
+	case "deployment":
+		if p.Status != "success" {
+			return nil, nil
+		}
+		return &forgeEvent{forgeDeployed, fmt.Sprintf("%s deployed %s to %s", project, p.Ref, p.Environment)}, nil
+	}
+	return nil, nil
+}
+
+// releaseName prefers a release's name to its tag.
+func releaseName(name, tag string) string {
+	if name != "" {
+		return name
+	}
+	return tag
+}
+
+// serveForge handles a webhook from GitHub or GitLab, named by forge, after
+// checking its signature or token.
+func serveForge(rooms *Rooms, forge string, f *Forge, w http.ResponseWriter, r *http.Request) {
+	if f == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var e *forgeEvent
+	switch forge {
+	case "github":
+		if f.Secret != "" && !validSignature(f.Secret, body, r.Header.Get("X-Hub-Signature-256")) {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+		event := r.Header.Get("X-GitHub-Event")
+		if event == "ping" {
+			writeJSON(w, &HookMatch{})
+			return
+		}
+		e, err = parseGitHub(event, body, f.branch())
+	case "gitlab":
+		if f.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(f.Token)) != 1 {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		e, err = parseGitLab(body, f.branch())
+	}
+	if err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m := &HookMatch{}
+	if e != nil && f.Sounds[e.kind] != "" {
+		m = &HookMatch{Matched: true, Sound: f.Sounds[e.kind], Target: f.Target, Text: e.text}
+		if m.Room == "" {
+			m.Room = defaultRoom
+		}
+		log.Println("Forge", forge, e.kind, "event playing", m.Sound, "in room", m.Room)
+		if err := rooms.notify(m.Room, m.Sound, jukebox.PlayOptions{Zones: m.Zones}, m.Text); err != nil {
+			m.Error = err.Error()
+		}
+	}
+	writeJSON(w, m)
+}
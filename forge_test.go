@@ -0,0 +1,276 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readFixture returns a webhook payload from testdata/forge.
+func readFixture(t *testing.T, forge, name string) []byte {
+	bb, err := ioutil.ReadFile(filepath.Join("testdata", "forge", forge, name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bb
+}
+
+func TestParseForge(t *testing.T) {
+	tests := []struct {
+		forge   string
+		fixture string
+		branch  string
+		kind    string
+		text    string
+	}{
+		{forge: "github", fixture: "push", kind: forgePush, text: "merenbach pushed 2 commits to main in merenbach/sound-machine"},
+		{forge: "github", fixture: "push", branch: "develop"},
+		{forge: "github", fixture: "pull_request", kind: forgeMerged, text: "merenbach/sound-machine#42 merged: Play a sound when builds break"},
+		{forge: "github", fixture: "pull_request", branch: "develop"},
+		{forge: "github", fixture: "workflow_run", kind: forgeFailed, text: "CI failed on main in merenbach/sound-machine"},
+		{forge: "github", fixture: "workflow_run", branch: "develop"},
+		{forge: "github", fixture: "release", kind: forgeRelease, text: "merenbach/sound-machine v1.2.0 released"},
+		{forge: "github", fixture: "deployment_status", kind: forgeDeployed, text: "merenbach/sound-machine deployed v1.2.0 to production"},
+		{forge: "gitlab", fixture: "push", kind: forgePush, text: "John Smith pushed 1 commits to main in merenbach/sound-machine"},
+		{forge: "gitlab", fixture: "push", branch: "develop"},
+		{forge: "gitlab", fixture: "merge_request", kind: forgeMerged, text: "merenbach/sound-machine!7 merged: Play a sound when builds break"},
+		{forge: "gitlab", fixture: "merge_request", branch: "develop"},
+		{forge: "gitlab", fixture: "pipeline", kind: forgeFailed, text: "pipeline failed on main in merenbach/sound-machine"},
+		{forge: "gitlab", fixture: "pipeline", branch: "develop"},
+		{forge: "gitlab", fixture: "release", kind: forgeRelease, text: "merenbach/sound-machine Release 1.2 released"},
+		{forge: "gitlab", fixture: "deployment", kind: forgeDeployed, text: "merenbach/sound-machine deployed v1.2.0 to production"},
+	}
+	for _, tt := range tests {
+		body := readFixture(t, tt.forge, tt.fixture)
+		branch := tt.branch
+		if branch == "" {
+			branch = defaultForgeBranch
+		}
+		var e *forgeEvent
+		var err error
+		if tt.forge == "github" {
+			e, err = parseGitHub(tt.fixture, body, branch)
+		} else {
+			e, err = parseGitLab(body, branch)
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.forge, tt.fixture, err)
+			continue
+		}
+		switch {
+		case tt.kind == "" && e != nil:
+			t.Errorf("%s %s on %s: got %+v, want nothing", tt.forge, tt.fixture, branch, *e)
+		case tt.kind != "" && e == nil:
+			t.Errorf("%s %s on %s: got nothing, want %s %q", tt.forge, tt.fixture, branch, tt.kind, tt.text)
+		case tt.kind != "" && (e.kind != tt.kind || e.text != tt.text):
+			t.Errorf("%s %s on %s: got %s %q, want %s %q", tt.forge, tt.fixture, branch, e.kind, e.text, tt.kind, tt.text)
+		}
+	}
+}
+
+func TestParseForgeIgnored(t *testing.T) {
+	// A GitHub event named by a header that does not match the payload, and
+	// kinds of events that are never played.
+	for _, event := range []string{"issues", "star", "pull_request"} {
+		e, err := parseGitHub(event, readFixture(t, "github", "push"), defaultForgeBranch)
+		if e != nil || err != nil {
+			t.Errorf("parseGitHub(%q) = %v, %v; want nothing", event, e, err)
+		}
+	}
+	e, err := parseGitLab([]byte(`{"object_kind": "note"}`), defaultForgeBranch)
+	if e != nil || err != nil {
+		t.Errorf("parseGitLab(note) = %v, %v; want nothing", e, err)
+	}
+	if _, err := parseGitHub("push", []byte("{"), defaultForgeBranch); err == nil {
+		t.Error("parseGitHub accepted invalid JSON")
+	}
+	if _, err := parseGitLab([]byte("{"), defaultForgeBranch); err == nil {
+		t.Error("parseGitLab accepted invalid JSON")
+	}
+}
+
+func TestServeForge(t *testing.T) {
+	rooms := testRooms(t)
+	github := &Forge{Secret: "s3cret", Target: Target{Room: "ci"}, Sounds: map[string]string{forgePush: "tada"}}
+	gitlab := &Forge{Token: "t0ken", Sounds: map[string]string{forgeFailed: "bell"}}
+
+	pushBody := readFixture(t, "github", "push")
+	tests := []struct {
+		name    string
+		forge   string
+		f       *Forge
+		body    []byte
+		headers map[string]string
+		status  int
+		sound   string
+		room    string
+	}{
+		{
+			name:    "github signed",
+			forge:   "github",
+			f:       github,
+			body:    pushBody,
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("s3cret", pushBody)},
+			status:  http.StatusOK,
+			sound:   "tada",
+			room:    "ci",
+		},
+		{
+			name:    "github signed with another secret",
+			forge:   "github",
+			f:       github,
+			body:    pushBody,
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("guess", pushBody)},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "github unsigned",
+			forge:   "github",
+			f:       github,
+			body:    pushBody,
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "github ping",
+			forge:   "github",
+			f:       github,
+			body:    []byte(`{"zen": "Keep it logically awesome."}`),
+			headers: map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": sign("s3cret", []byte(`{"zen": "Keep it logically awesome."}`))},
+			status:  http.StatusOK,
+		},
+		{
+			name:    "github kind without a sound",
+			forge:   "github",
+			f:       github,
+			body:    readFixture(t, "github", "release"),
+			headers: map[string]string{"X-GitHub-Event": "release", "X-Hub-Signature-256": sign("s3cret", readFixture(t, "github", "release"))},
+			status:  http.StatusOK,
+		},
+		{
+			name:    "gitlab token",
+			forge:   "gitlab",
+			f:       gitlab,
+			body:    readFixture(t, "gitlab", "pipeline"),
+			headers: map[string]string{"X-Gitlab-Token": "t0ken"},
+			status:  http.StatusOK,
+			sound:   "bell",
+			room:    defaultRoom,
+		},
+		{
+			name:    "gitlab wrong token",
+			forge:   "gitlab",
+			f:       gitlab,
+			body:    readFixture(t, "gitlab", "pipeline"),
+			headers: map[string]string{"X-Gitlab-Token": "t0ke"},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:   "gitlab no token",
+			forge:  "gitlab",
+			f:      gitlab,
+			body:   readFixture(t, "gitlab", "pipeline"),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "invalid JSON",
+			forge:   "gitlab",
+			f:       gitlab,
+			body:    []byte("{"),
+			headers: map[string]string{"X-Gitlab-Token": "t0ken"},
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:   "not configured",
+			forge:  "gitlab",
+			body:   readFixture(t, "gitlab", "pipeline"),
+			status: http.StatusNotFound,
+		},
+	}
+	played := make(map[string]int)
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/forge/"+tt.forge, bytes.NewReader(tt.body))
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		serveForge(rooms, tt.forge, tt.f, w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var m HookMatch
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if m.Matched != (tt.sound != "") || m.Sound != tt.sound || m.Room != tt.room || m.Error != "" {
+			t.Errorf("%s: got %+v, want %q in %q", tt.name, m, tt.sound, tt.room)
+		}
+		if m.Matched {
+			played[m.Room]++
+		}
+	}
+
+	// Only the accepted webhooks reached their rooms.
+	for _, room := range []string{"ci", defaultRoom} {
+		waitForPlays(t, rooms, room, played[room])
+	}
+}
+
+func TestForgeCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		forge Forge
+		err   string
+		sound string
+	}{
+		{name: "github", forge: Forge{Target: Target{Room: "ci"}, Sounds: map[string]string{forgePush: "tada"}}},
+		{name: "gitlab", forge: Forge{Target: Target{Room: "no good"}}, err: `gitlab: invalid room "no good"`},
+		{name: "gitlab", forge: Forge{Target: Target{Zones: []string{"no good"}}}, err: `gitlab: invalid zone "no good"`},
+		{name: "github", forge: Forge{Sounds: map[string]string{"starred": "tada"}}, err: `github: unknown event kind "starred"`},
+		{name: "github", forge: Forge{Sounds: map[string]string{forgeFailed: "xylophone"}}, sound: `github failed event plays "xylophone", which will fail: unknown sound`},
+	}
+	for _, tt := range tests {
+		library := testLibrary(t)
+		sounds := library.sounds
+		library.sounds = nil
+		err := tt.forge.check(library, tt.name)
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		library.mu.Lock()
+		library.sounds = sounds
+		problems := library.checkExpected()
+		library.mu.Unlock()
+		if (len(problems) == 0) != (tt.sound == "") || (len(problems) > 0 && !strings.HasPrefix(problems[0], tt.sound)) {
+			t.Errorf("%s: got problems %q, want %q", tt.name, problems, tt.sound)
+		}
+	}
+}
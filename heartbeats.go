@@ -0,0 +1,304 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// How often heartbeats are checked for missed pings.
+const heartbeatPeriod = time.Second
+
+// Heartbeat statuses.
+const (
+	// heartbeatNew has never been pinged, so it cannot be late.
+	heartbeatNew = "new"
+
+	// heartbeatUp was last pinged in time.
+	heartbeatUp = "up"
+
+	// heartbeatDown missed its interval plus grace.
+	heartbeatDown = "down"
+)
+
+// Heartbeat is a dead man's switch: a job pings it on a schedule, and a
+// sound plays if the pings stop.
+type Heartbeat struct {
+	Name string `json:"name"`
+
+	// Interval is how often pings are expected, and Grace how late one may
+	// be before the heartbeat goes down.
+	Interval duration `json:"interval"`
+	Grace    duration `json:"grace,omitempty"`
+
+	// Where the sounds play.
+	Target
+
+	// Sound to play when the heartbeat goes down, and optionally when it
+	// comes back up.
+	Sound         string `json:"sound"`
+	RecoverySound string `json:"recoverySound,omitempty"`
+
+	// Status is one of heartbeatNew, heartbeatUp and heartbeatDown.
+	Status string `json:"status"`
+
+	// When the last ping arrived and when the status last changed.
+	LastPing *time.Time `json:"lastPing,omitempty"`
+	Changed  *time.Time `json:"changed,omitempty"`
+
+	// API is set on heartbeats defined over the API rather than in the
+	// config, which are kept across restarts until removed the same way.
+	API bool `json:"api,omitempty"`
+}
+
+// check validates a heartbeat's settings.
+func (hb *Heartbeat) check() error {
+	if !validLabel.MatchString(hb.Name) {
+		return fmt.Errorf("invalid heartbeat name %q", hb.Name)
+	}
+	if hb.Interval <= 0 {
+		return fmt.Errorf("heartbeat %s needs an interval", hb.Name)
+	}
+	if hb.Sound == "" {
+		return fmt.Errorf("heartbeat %s has no sound", hb.Name)
+	}
+	return hb.validate()
+}
+
+// checkSaved validates a heartbeat read back from the state file, where it
+// was saved under name.
+func (hb *Heartbeat) checkSaved(name string) error {
+	if hb == nil || hb.Name != name {
+		return fmt.Errorf("heartbeat %q is saved under the wrong name", name)
+	}
+	if err := hb.check(); err != nil {
+		return err
+	}
+	switch hb.Status {
+	case heartbeatNew:
+	case heartbeatUp, heartbeatDown:
+		if hb.LastPing == nil {
+			return fmt.Errorf("heartbeat %s is %s but was never pinged", hb.Name, hb.Status)
+		}
+	default:
+		return fmt.Errorf("heartbeat %s has invalid status %q", hb.Name, hb.Status)
+	}
+	return nil
+}
+
+// deadline returns when the heartbeat goes down without another ping.
+func (hb *Heartbeat) deadline() time.Time {
+	return hb.LastPing.Add(time.Duration(hb.Interval + hb.Grace))
+}
+
+// Heartbeats holds the heartbeat monitors and saves their state.
+type Heartbeats struct {
+	rooms *Rooms
+
+	// File the heartbeats are saved to, or "" to keep them in memory.
+	path string
+
+	mu    sync.Mutex
+	beats map[string]*Heartbeat
+}
+
+// newHeartbeats loads any saved heartbeats and adds those in the config,
+// keeping the saved state of each. Saved heartbeats that are invalid, or
+// that came from the config and are no longer in it, are dropped.
+func newHeartbeats(rooms *Rooms, path string, defs []*Heartbeat) (*Heartbeats, error) {
+	hs := &Heartbeats{rooms: rooms, path: path, beats: make(map[string]*Heartbeat)}
+	var saved map[string]*Heartbeat
+	if err := loadState(path, &saved); err != nil {
+		return nil, err
+	}
+	for name, hb := range saved {
+		if err := hb.checkSaved(name); err != nil {
+			log.Println("Dropping saved heartbeat:", err)
+			continue
+		}
+		hs.beats[name] = hb
+	}
+	configured := make(map[string]bool)
+	for _, hb := range defs {
+		if err := hb.check(); err != nil {
+			return nil, err
+		}
+		hb.API = false
+		hs.keepState(hb)
+		hs.beats[hb.Name] = hb
+		configured[hb.Name] = true
+		rooms.library.expect(hb.Sound, "heartbeat "+hb.Name)
+		if hb.RecoverySound != "" {
+			rooms.library.expect(hb.RecoverySound, "heartbeat "+hb.Name)
+		}
+	}
+	for name, hb := range hs.beats {
+		if !hb.API && !configured[name] {
+			log.Println("Dropping heartbeat", name, "which is no longer in the config")
+			delete(hs.beats, name)
+		}
+	}
+	return hs, nil
+}
+
+// keepState copies the state of any heartbeat with the same name into a
+// new definition. The caller must hold hs.mu or be the only user of hs.
+func (hs *Heartbeats) keepState(hb *Heartbeat) {
+	hb.Status, hb.LastPing, hb.Changed = heartbeatNew, nil, nil
+	if old, ok := hs.beats[hb.Name]; ok {
+		hb.Status, hb.LastPing, hb.Changed = old.Status, old.LastPing, old.Changed
+	}
+}
+
+// save writes the heartbeats out. The caller must hold hs.mu.
+func (hs *Heartbeats) save() {
+	if err := saveState(hs.path, hs.beats); err != nil {
+		log.Println("Could not save heartbeats:", err)
+	}
+}
+
+// all returns a copy of every heartbeat, sorted by name.
+func (hs *Heartbeats) all() []Heartbeat {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	beats := make([]Heartbeat, 0, len(hs.beats))
+	for _, hb := range hs.beats {
+		beats = append(beats, *hb)
+	}
+	sort.Slice(beats, func(i, j int) bool { return beats[i].Name < beats[j].Name })
+	return beats
+}
+
+// get returns a copy of a heartbeat.
+func (hs *Heartbeats) get(name string) (Heartbeat, bool) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hb, ok := hs.beats[name]
+	if !ok {
+		return Heartbeat{}, false
+	}
+	return *hb, true
+}
+
+// define checks a heartbeat against the library and adds or replaces it.
+func (hs *Heartbeats) define(hb *Heartbeat) error {
+	if err := hb.check(); err != nil {
+		return err
+	}
+	for _, name := range []string{hb.Sound, hb.RecoverySound} {
+		if name == "" {
+			continue
+		}
+		if _, err := hs.rooms.library.resolve(name); err != nil {
+			return err
+		}
+	}
+	hb.API = true
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.keepState(hb)
+	hs.beats[hb.Name] = hb
+	hs.save()
+	return nil
+}
+
+// remove deletes a heartbeat, reporting whether it existed.
+func (hs *Heartbeats) remove(name string) bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	_, ok := hs.beats[name]
+	delete(hs.beats, name)
+	hs.save()
+	return ok
+}
+
+// ping records a ping, bringing the heartbeat back up if it was down.
+func (hs *Heartbeats) ping(name string) (Heartbeat, bool) {
+	hs.mu.Lock()
+	hb, ok := hs.beats[name]
+	if !ok {
+		hs.mu.Unlock()
+		return Heartbeat{}, false
+	}
+	now := time.Now()
+	recovered := hb.Status == heartbeatDown
+	hb.LastPing = &now
+	if hb.Status != heartbeatUp {
+		hb.Status = heartbeatUp
+		hb.Changed = &now
+	}
+	hs.save()
+	copied := *hb
+	hs.mu.Unlock()
+
+	if recovered {
+		log.Println("Heartbeat", name, "is back up")
+		if copied.RecoverySound != "" {
+			hs.play(&copied, copied.RecoverySound, "heartbeat "+name+" is back")
+		}
+	}
+	return copied, true
+}
+
+// run checks the heartbeats for missed pings until the process exits.
+func (hs *Heartbeats) run() {
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		hs.check(now)
+	}
+}
+
+// check plays the sounds of the heartbeats that have missed their deadlines.
+func (hs *Heartbeats) check(now time.Time) {
+	for _, hb := range hs.expire(now) {
+		log.Println("Heartbeat", hb.Name, "missed its deadline")
+		hs.play(&hb, hb.Sound, "heartbeat "+hb.Name+" missed its deadline")
+	}
+}
+
+// expire marks the heartbeats whose deadlines have passed as down, and
+// returns copies of them.
+func (hs *Heartbeats) expire(now time.Time) []Heartbeat {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	var expired []Heartbeat
+	for _, hb := range hs.beats {
+		if hb.Status != heartbeatUp || now.Before(hb.deadline()) {
+			continue
+		}
+		changed := now
+		hb.Status = heartbeatDown
+		hb.Changed = &changed
+		expired = append(expired, *hb)
+	}
+	if len(expired) > 0 {
+		hs.save()
+	}
+	return expired
+}
+
+// play plays one of a heartbeat's sounds in its room.
+func (hs *Heartbeats) play(hb *Heartbeat, sound string, text string) {
+	if err := hs.rooms.notify(hb.Room, sound, jukebox.PlayOptions{Zones: hb.Zones}, text); err != nil {
+		log.Println("Heartbeat", hb.Name, "could not play", sound+":", err)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHeartbeats(t *testing.T) {
+	rooms := testRooms(t)
+	hs, err := newHeartbeats(rooms, "", []*Heartbeat{
+		{Name: "backup", Interval: duration(time.Minute), Grace: duration(30 * time.Second), Target: Target{Room: "ops"}, Sound: "tada", RecoverySound: "bell"},
+		{Name: "cron", Interval: duration(time.Minute), Sound: "drama"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	heard := func(room string) []string {
+		h, err := rooms.get(room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settle(h)
+		var s []string
+		for _, e := range h.since(0) {
+			s = append(s, e.Sound+": "+e.Text)
+		}
+		return s
+	}
+
+	base := time.Now()
+	tests := []struct {
+		// Either ping a heartbeat or check them all some time from now.
+		ping  string
+		check time.Duration
+
+		backup, cron string
+
+		// Everything each room has heard so far.
+		ops, main []string
+	}{
+		{check: 2 * time.Hour, backup: heartbeatNew, cron: heartbeatNew},
+		{ping: "backup", backup: heartbeatUp, cron: heartbeatNew},
+		{check: time.Minute, backup: heartbeatUp, cron: heartbeatNew},
+		{
+			check:  2 * time.Minute,
+			backup: heartbeatDown,
+			cron:   heartbeatNew,
+			ops:    []string{"tada: heartbeat backup missed its deadline"},
+		},
+		{
+			check:  3 * time.Minute,
+			backup: heartbeatDown,
+			cron:   heartbeatNew,
+			ops:    []string{"tada: heartbeat backup missed its deadline"},
+		},
+		{
+			ping:   "backup",
+			backup: heartbeatUp,
+			cron:   heartbeatNew,
+			ops:    []string{"tada: heartbeat backup missed its deadline", "bell: heartbeat backup is back"},
+		},
+		{
+			ping:   "cron",
+			backup: heartbeatUp,
+			cron:   heartbeatUp,
+			ops:    []string{"tada: heartbeat backup missed its deadline", "bell: heartbeat backup is back"},
+		},
+		{
+			check:  5 * time.Minute,
+			backup: heartbeatDown,
+			cron:   heartbeatDown,
+			ops:    []string{"tada: heartbeat backup missed its deadline", "bell: heartbeat backup is back", "tada: heartbeat backup missed its deadline"},
+			main:   []string{"drama: heartbeat cron missed its deadline"},
+		},
+		{
+			ping:   "cron",
+			backup: heartbeatDown,
+			cron:   heartbeatUp,
+			ops:    []string{"tada: heartbeat backup missed its deadline", "bell: heartbeat backup is back", "tada: heartbeat backup missed its deadline"},
+			main:   []string{"drama: heartbeat cron missed its deadline"},
+		},
+	}
+	for i, tt := range tests {
+		if tt.ping != "" {
+			if _, ok := hs.ping(tt.ping); !ok {
+				t.Fatalf("%d. could not ping %s", i, tt.ping)
+			}
+		} else {
+			hs.check(base.Add(tt.check))
+		}
+		backup, _ := hs.get("backup")
+		cron, _ := hs.get("cron")
+		if backup.Status != tt.backup || cron.Status != tt.cron {
+			t.Errorf("%d. backup is %s and cron %s, want %s and %s", i, backup.Status, cron.Status, tt.backup, tt.cron)
+		}
+		if got := heard("ops"); !reflect.DeepEqual(got, tt.ops) {
+			t.Errorf("%d. ops heard %q, want %q", i, got, tt.ops)
+		}
+		if got := heard(defaultRoom); !reflect.DeepEqual(got, tt.main) {
+			t.Errorf("%d. main heard %q, want %q", i, got, tt.main)
+		}
+	}
+	if _, ok := hs.ping("nope"); ok {
+		t.Errorf("pinged an unknown heartbeat")
+	}
+}
+
+func TestHeartbeatPersistence(t *testing.T) {
+	rooms := testRooms(t)
+	path := filepath.Join(t.TempDir(), "heartbeats.json")
+	cron := func(interval time.Duration) []*Heartbeat {
+		return []*Heartbeat{{Name: "cron", Interval: duration(interval), Sound: "drama"}}
+	}
+
+	hs, err := newHeartbeats(rooms, path, cron(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hs.define(&Heartbeat{Name: "api", Interval: duration(time.Hour), Sound: "tada"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hs.define(&Heartbeat{Name: "typo", Interval: duration(time.Hour), Sound: "xylophone"}); err == nil {
+		t.Errorf("defined a heartbeat with an unknown sound")
+	}
+	pinged, _ := hs.ping("cron")
+	hs.ping("api")
+
+	// A restart keeps the state of both, with the config's new interval.
+	hs, err = newHeartbeats(rooms, path, cron(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := hs.get("cron")
+	if got.Status != heartbeatUp || !got.LastPing.Equal(*pinged.LastPing) || got.Interval != duration(2*time.Minute) || got.API {
+		t.Errorf("cron after restart: %+v", got)
+	}
+	if got, ok := hs.get("api"); !ok || got.Status != heartbeatUp || !got.API {
+		t.Errorf("api after restart: %+v", got)
+	}
+
+	// Leaving the config drops cron, but not the heartbeat from the API.
+	hs, err = newHeartbeats(rooms, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := heartbeatNames(hs); !reflect.DeepEqual(names, []string{"api"}) {
+		t.Errorf("after leaving the config, heartbeats are %q", names)
+	}
+
+	saved := `{
+		"good": {"name": "good", "interval": "1m", "sound": "tada", "status": "new", "api": true},
+		"renamed": {"name": "other", "interval": "1m", "sound": "tada", "status": "new", "api": true},
+		"odd": {"name": "odd", "interval": "1m", "sound": "tada", "status": "sideways", "api": true},
+		"unpinged": {"name": "unpinged", "interval": "1m", "sound": "tada", "status": "up", "api": true},
+		"badroom": {"name": "badroom", "interval": "1m", "sound": "tada", "room": "no good", "status": "new", "api": true},
+		"null": null
+	}`
+	if err := ioutil.WriteFile(path, []byte(saved), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hs, err = newHeartbeats(rooms, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := heartbeatNames(hs); !reflect.DeepEqual(names, []string{"good"}) {
+		t.Errorf("loaded saved heartbeats %q, want only the valid one", names)
+	}
+}
+
+// heartbeatNames returns the names of every heartbeat, sorted.
+func heartbeatNames(hs *Heartbeats) []string {
+	var names []string
+	for _, hb := range hs.all() {
+		names = append(names, hb.Name)
+	}
+	return names
+}
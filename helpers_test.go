@@ -0,0 +1,102 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// testRooms returns rooms playing from testLibrary.
+func testRooms(t *testing.T) *Rooms {
+	prefs, err := newPrefStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	library := testLibrary(t)
+	triggers, err := newTriggers(library, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRooms(library, nil, prefs, triggers)
+}
+
+// waitForPlays returns a room's history once it holds n events, or fails if
+// it does not within a second.
+func waitForPlays(t *testing.T, rooms *Rooms, room string, n int) []*jukebox.Event {
+	h, err := rooms.get(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(h.since(0)) < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	events := h.since(0)
+	if len(events) != n {
+		t.Errorf("room %s heard %d events, want %d", room, len(events), n)
+	}
+	return events
+}
+
+// connect registers a client with a hub as if it had connected with a query
+// such as "role=controller&zone=desk".
+func connect(t *testing.T, h *Hub, query string) *Client {
+	c, err := newClientFromRequest(h, httptest.NewRequest("GET", "/ws?"+query, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.register <- c
+	return c
+}
+
+// settle waits until a hub has acted on everything sent to it so far.
+func settle(h *Hub) {
+	h.direct <- delivery{}
+}
+
+// received returns the events queued for a client since it was last called.
+func received(t *testing.T, c *Client) []*jukebox.Event {
+	settle(c.hub)
+	var events []*jukebox.Event
+	for {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				return events
+			}
+			var e jukebox.Event
+			if err := json.Unmarshal(message, &e); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, &e)
+		default:
+			return events
+		}
+	}
+}
+
+// summarize describes events as "type:sound" strings, for comparing them.
+func summarize(events []*jukebox.Event) []string {
+	var s []string
+	for _, e := range events {
+		s = append(s, e.Type+":"+e.Sound)
+	}
+	return s
+}
@@ -0,0 +1,331 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Largest webhook payload accepted, which is more than the API allows since
+// some tools send whole commit lists.
+const maxHookBodySize = 1 << 22
+
+// Header that carries a hook's HMAC signature, unless the hook names one.
+const defaultSignatureHeader = "X-Signature-256"
+
+// Hook receives JSON payloads at /hooks/{id} and plays a sound for the
+// first of its rules that matches.
+type Hook struct {
+	// Secret, if set, must be sent in the X-Hook-Secret header or the
+	// "secret" query parameter.
+	Secret string `json:"secret,omitempty"`
+
+	// HMACKey, if set, must have signed the payload with HMAC-SHA256. The
+	// hex signature, optionally prefixed with "sha256=", is sent in the
+	// header named by SignatureHeader.
+	HMACKey         string `json:"hmacKey,omitempty"`
+	SignatureHeader string `json:"signatureHeader,omitempty"`
+
+	Rules []*HookRule `json:"rules"`
+}
+
+// HookRule plays a sound when every one of its conditions holds.
+type HookRule struct {
+	When []*Condition `json:"when"`
+
+	// Sound or macro to play.
+	Sound string `json:"sound"`
+
+	// Where the sound plays.
+	Target
+
+	// Text to send with the play, in which ${path} is replaced by the
+	// payload's value at that dotted path.
+	Text string `json:"text,omitempty"`
+}
+
+// Condition tests the value at a dotted path in a payload, such as
+// "deployment.environment" or "commits.0.author.name". Every test given
+// must pass.
+type Condition struct {
+	Path string `json:"path"`
+
+	// Exists, if set, requires the path to be present or absent.
+	Exists *bool `json:"exists,omitempty"`
+
+	// Equals requires the value to equal a JSON string, number or boolean.
+	Equals interface{} `json:"equals,omitempty"`
+
+	// Regex requires the value, as text, to match a regular expression.
+	Regex string `json:"regex,omitempty"`
+
+	// Numeric comparisons, which the value must be a number to pass.
+	GT  *float64 `json:"gt,omitempty"`
+	GTE *float64 `json:"gte,omitempty"`
+	LT  *float64 `json:"lt,omitempty"`
+	LTE *float64 `json:"lte,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// checkHooks validates the hooks in the config, and has the library check the
+// sounds their rules play once it is loaded.
+func checkHooks(library *Library, hooks map[string]*Hook) error {
+	for id, hook := range hooks {
+		if !validLabel.MatchString(id) {
+			return fmt.Errorf("invalid hook ID %q", id)
+		}
+		if hook.Secret == "" && hook.HMACKey == "" {
+			log.Println("Warning: hook", id, "has no secret or HMAC key, so anyone can call it")
+		}
+		for i, rule := range hook.Rules {
+			if err := rule.compile(); err != nil {
+				return fmt.Errorf("hook %s, rule %d: %v", id, i+1, err)
+			}
+			library.expect(rule.Sound, fmt.Sprintf("hook %s (rule %d)", id, i+1))
+		}
+	}
+	return nil
+}
+
+// compile checks a rule and prepares its expressions.
+func (rule *HookRule) compile() error {
+	if rule.Sound == "" {
+		return fmt.Errorf("no sound")
+	}
+	for _, c := range rule.When {
+		if c.Path == "" {
+			return fmt.Errorf("condition has no path")
+		}
+		if c.Regex != "" {
+			re, err := regexp.Compile(c.Regex)
+			if err != nil {
+				return err
+			}
+			c.re = re
+		}
+	}
+	return rule.Target.validate()
+}
+
+// lookup returns the value at a dotted path in a decoded JSON payload.
+// Numeric segments index into arrays.
+func lookup(v interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// valueText renders a value found in a payload for matching or display.
+func valueText(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	case map[string]interface{}, []interface{}:
+		bb, _ := json.Marshal(v)
+		return string(bb)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// matches reports whether a condition holds for a payload.
+func (c *Condition) matches(payload interface{}) bool {
+	v, ok := lookup(payload, c.Path)
+	if c.Exists != nil && *c.Exists != ok {
+		return false
+	}
+	if !ok {
+		// Only an existence test can pass on a missing path.
+		return c.Exists != nil && !*c.Exists
+	}
+	if c.Equals != nil && !reflect.DeepEqual(c.Equals, v) {
+		return false
+	}
+	if c.re != nil && !c.re.MatchString(valueText(v)) {
+		return false
+	}
+	if c.GT != nil || c.GTE != nil || c.LT != nil || c.LTE != nil {
+		n, ok := v.(float64)
+		if !ok {
+			return false
+		}
+		if (c.GT != nil && !(n > *c.GT)) || (c.GTE != nil && !(n >= *c.GTE)) ||
+			(c.LT != nil && !(n < *c.LT)) || (c.LTE != nil && !(n <= *c.LTE)) {
+			return false
+		}
+	}
+	return true
+}
+
+var placeholder = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// render fills in a rule's text from a payload, cut short to the length of
+// a chat message since payload values can be any size.
+func (rule *HookRule) render(payload interface{}) string {
+	text := placeholder.ReplaceAllStringFunc(rule.Text, func(s string) string {
+		v, _ := lookup(payload, s[2:len(s)-1])
+		return valueText(v)
+	})
+	return clip(text)
+}
+
+// HookMatch reports the play a payload set off, if any, to the caller.
+type HookMatch struct {
+	Matched bool `json:"matched"`
+
+	// Rule is the number of the matching rule, counting from 1.
+	Rule  int    `json:"rule,omitempty"`
+	Sound string `json:"sound,omitempty"`
+	Target
+	Text string `json:"text,omitempty"`
+
+	// Error says why the sound could not be played, if it could not.
+	Error string `json:"error,omitempty"`
+}
+
+// evaluate returns the play for the first rule that a payload matches.
+func (hook *Hook) evaluate(payload interface{}) *HookMatch {
+	for i, rule := range hook.Rules {
+		ok := true
+		for _, c := range rule.When {
+			if !c.matches(payload) {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+		m := &HookMatch{Matched: true, Rule: i + 1, Sound: rule.Sound, Target: rule.Target, Text: rule.render(payload)}
+		if m.Room == "" {
+			m.Room = defaultRoom
+		}
+		return m
+	}
+	return &HookMatch{}
+}
+
+// verify checks a request's secret and signature against the hook's.
+func (hook *Hook) verify(r *http.Request, body []byte) bool {
+	if hook.Secret != "" {
+		given := r.Header.Get("X-Hook-Secret")
+		if given == "" {
+			given = r.URL.Query().Get("secret")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(hook.Secret)) != 1 {
+			return false
+		}
+	}
+	if hook.HMACKey != "" {
+		header := hook.SignatureHeader
+		if header == "" {
+			header = defaultSignatureHeader
+		}
+		if !validSignature(hook.HMACKey, body, r.Header.Get(header)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validSignature reports whether a hex HMAC-SHA256 signature, optionally
+// prefixed with "sha256=", matches a body.
+func validSignature(key string, body []byte, signature string) bool {
+	given, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return hmac.Equal(given, mac.Sum(nil))
+}
+
+// serveHook handles a webhook call at /hooks/{id}, or a dry run at
+// /hooks/{id}/test that reports what would play without playing it. Dry
+// runs skip the hook's own checks, since the caller is an API user.
+func serveHook(rooms *Rooms, hooks map[string]*Hook, keys []string, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/hooks"), "/"), "/")
+	hook, ok := hooks[parts[0]]
+	if !ok || len(parts) > 2 || (len(parts) == 2 && parts[1] != "test") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	dryRun := len(parts) == 2
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if dryRun && !authorize(keys, w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !dryRun && !hook.verify(r, body) {
+		http.Error(w, "Invalid secret or signature", http.StatusUnauthorized)
+		return
+	}
+	var payload interface{}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m := hook.evaluate(payload)
+	if m.Matched && !dryRun {
+		log.Println("Hook", parts[0], "matched rule", m.Rule, "playing", m.Sound, "in room", m.Room)
+		if err := rooms.notify(m.Room, m.Sound, jukebox.PlayOptions{Zones: m.Zones}, m.Text); err != nil {
+			m.Error = err.Error()
+		}
+	}
+	writeJSON(w, m)
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+const testPayload = `{
+	"action": "completed",
+	"deployment": {"environment": "production", "ref": "v1.2.0"},
+	"commits": [{"author": {"name": "alice"}}, {"author": {"name": "bob"}}],
+	"count": 3,
+	"draft": false,
+	"note": null
+}`
+
+// decodePayload decodes a JSON payload the way serveHook does.
+func decodePayload(t *testing.T, s string) interface{} {
+	var payload interface{}
+	if err := json.Unmarshal([]byte(s), &payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		path string
+		want interface{}
+		ok   bool
+	}{
+		{path: "action", want: "completed", ok: true},
+		{path: "deployment.environment", want: "production", ok: true},
+		{path: "commits.1.author.name", want: "bob", ok: true},
+		{path: "count", want: 3.0, ok: true},
+		{path: "draft", want: false, ok: true},
+		{path: "note", want: nil, ok: true},
+		{path: "commits.2.author.name"},
+		{path: "commits.-1"},
+		{path: "commits.first"},
+		{path: "action.length"},
+		{path: "deployment.url"},
+		{path: "missing"},
+	}
+	payload := decodePayload(t, testPayload)
+	for _, tt := range tests {
+		got, ok := lookup(payload, tt.path)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookup(%q) = %v, %v; want %v, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestConditionMatches(t *testing.T) {
+	yes, no := true, false
+	two, three := 2.0, 3.0
+	tests := []struct {
+		name string
+		cond Condition
+		want bool
+	}{
+		{name: "exists", cond: Condition{Path: "action", Exists: &yes}, want: true},
+		{name: "exists, missing", cond: Condition{Path: "missing", Exists: &yes}},
+		{name: "absent", cond: Condition{Path: "missing", Exists: &no}, want: true},
+		{name: "absent, present", cond: Condition{Path: "action", Exists: &no}},
+		{name: "null exists", cond: Condition{Path: "note", Exists: &yes}, want: true},
+		{name: "missing with no test", cond: Condition{Path: "missing"}},
+		{name: "equals string", cond: Condition{Path: "deployment.environment", Equals: "production"}, want: true},
+		{name: "equals other string", cond: Condition{Path: "deployment.environment", Equals: "staging"}},
+		{name: "equals number", cond: Condition{Path: "count", Equals: 3.0}, want: true},
+		{name: "equals bool", cond: Condition{Path: "draft", Equals: false}, want: true},
+		{name: "equals string as number", cond: Condition{Path: "count", Equals: "3"}},
+		{name: "regex", cond: Condition{Path: "deployment.ref", Regex: `^v\d+\.`}, want: true},
+		{name: "regex on number", cond: Condition{Path: "count", Regex: `^3$`}, want: true},
+		{name: "regex no match", cond: Condition{Path: "deployment.ref", Regex: `^release-`}},
+		{name: "gt", cond: Condition{Path: "count", GT: &two}, want: true},
+		{name: "gt equal", cond: Condition{Path: "count", GT: &three}},
+		{name: "gte", cond: Condition{Path: "count", GTE: &three}, want: true},
+		{name: "lt", cond: Condition{Path: "count", LT: &three}},
+		{name: "lte", cond: Condition{Path: "count", LTE: &three}, want: true},
+		{name: "range", cond: Condition{Path: "count", GT: &two, LTE: &three}, want: true},
+		{name: "numeric test on string", cond: Condition{Path: "action", GT: &two}},
+		{name: "every test must pass", cond: Condition{Path: "deployment.ref", Exists: &yes, Regex: `^v`, Equals: "v2.0.0"}},
+	}
+	payload := decodePayload(t, testPayload)
+	for _, tt := range tests {
+		c := tt.cond
+		rule := &HookRule{Sound: "tada", When: []*Condition{&c}}
+		if err := rule.compile(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := c.matches(payload); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// sign returns the hex HMAC-SHA256 of a body.
+func sign(key string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHookVerify(t *testing.T) {
+	body := []byte(testPayload)
+	tests := []struct {
+		name    string
+		hook    Hook
+		target  string
+		headers map[string]string
+		want    bool
+	}{
+		{name: "open", hook: Hook{}, want: true},
+		{name: "secret header", hook: Hook{Secret: "s3cret"}, headers: map[string]string{"X-Hook-Secret": "s3cret"}, want: true},
+		{name: "secret query", hook: Hook{Secret: "s3cret"}, target: "/hooks/ci?secret=s3cret", want: true},
+		{name: "wrong secret", hook: Hook{Secret: "s3cret"}, headers: map[string]string{"X-Hook-Secret": "guess"}},
+		{name: "no secret", hook: Hook{Secret: "s3cret"}},
+		{name: "signature", hook: Hook{HMACKey: "key"}, headers: map[string]string{"X-Signature-256": sign("key", body)}, want: true},
+		{name: "prefixed signature", hook: Hook{HMACKey: "key"}, headers: map[string]string{"X-Signature-256": "sha256=" + sign("key", body)}, want: true},
+		{name: "signature in named header", hook: Hook{HMACKey: "key", SignatureHeader: "X-Hub-Signature-256"}, headers: map[string]string{"X-Hub-Signature-256": "sha256=" + sign("key", body)}, want: true},
+		{name: "signature in default header", hook: Hook{HMACKey: "key", SignatureHeader: "X-Hub-Signature-256"}, headers: map[string]string{"X-Signature-256": sign("key", body)}},
+		{name: "signed with other key", hook: Hook{HMACKey: "key"}, headers: map[string]string{"X-Signature-256": sign("other", body)}},
+		{name: "signature not hex", hook: Hook{HMACKey: "key"}, headers: map[string]string{"X-Signature-256": "sha256=zz"}},
+		{name: "no signature", hook: Hook{HMACKey: "key"}},
+		{name: "secret and signature", hook: Hook{Secret: "s3cret", HMACKey: "key"}, headers: map[string]string{"X-Hook-Secret": "s3cret", "X-Signature-256": sign("key", body)}, want: true},
+		{name: "signature without secret", hook: Hook{Secret: "s3cret", HMACKey: "key"}, headers: map[string]string{"X-Signature-256": sign("key", body)}},
+	}
+	for _, tt := range tests {
+		target := tt.target
+		if target == "" {
+			target = "/hooks/ci"
+		}
+		r := httptest.NewRequest("POST", target, nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := tt.hook.verify(r, body); got != tt.want {
+			t.Errorf("%s: verify = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHookRender(t *testing.T) {
+	payload := decodePayload(t, testPayload)
+	rule := &HookRule{Text: "${commits.0.author.name} deployed ${deployment.ref} (${count}) ${missing}"}
+	if got, want := rule.render(payload), "alice deployed v1.2.0 (3) "; got != want {
+		t.Errorf("render = %q, want %q", got, want)
+	}
+
+	long := decodePayload(t, `{"message": "`+strings.Repeat("é", 2*maxChatLength)+`"}`)
+	rule = &HookRule{Text: "said ${message}"}
+	got := rule.render(long)
+	if n := utf8.RuneCountInString(got); n != maxChatLength || !strings.HasSuffix(got, "…") {
+		t.Errorf("render of a long value has %d characters ending %q, want %d ending in an ellipsis", n, got[len(got)-6:], maxChatLength)
+	}
+}
+
+func TestCheckHooks(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  HookRule
+		err   string
+		sound string
+	}{
+		{name: "fine", rule: HookRule{Sound: "tada", Target: Target{Room: "ci", Zones: []string{"lobby"}}}},
+		{name: "no sound", rule: HookRule{}, err: "hook deploy, rule 1: no sound"},
+		{name: "bad room", rule: HookRule{Sound: "tada", Target: Target{Room: "no good"}}, err: `hook deploy, rule 1: invalid room "no good"`},
+		{name: "bad zone", rule: HookRule{Sound: "tada", Target: Target{Zones: []string{"no good"}}}, err: `hook deploy, rule 1: invalid zone "no good"`},
+		{name: "bad regex", rule: HookRule{Sound: "tada", When: []*Condition{{Path: "action", Regex: "("}}}, err: "hook deploy, rule 1: error parsing regexp: missing closing ): `(`"},
+		{name: "unknown sound", rule: HookRule{Sound: "xylophone"}, sound: `hook deploy (rule 1) plays "xylophone", which will fail: unknown sound`},
+	}
+	for _, tt := range tests {
+		library := testLibrary(t)
+		sounds := library.sounds
+		library.sounds = nil
+		rule := tt.rule
+		err := checkHooks(library, map[string]*Hook{"deploy": {Secret: "s3cret", Rules: []*HookRule{&rule}}})
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		library.mu.Lock()
+		library.sounds = sounds
+		problems := library.checkExpected()
+		library.mu.Unlock()
+		if (len(problems) == 0) != (tt.sound == "") || (len(problems) > 0 && !strings.HasPrefix(problems[0], tt.sound)) {
+			t.Errorf("%s: got problems %q, want %q", tt.name, problems, tt.sound)
+		}
+	}
+}
+
+func TestHookEvaluate(t *testing.T) {
+	hook := &Hook{Rules: []*HookRule{
+		{Sound: "drama", When: []*Condition{{Path: "action", Equals: "failed"}}},
+		{Sound: "tada", Target: Target{Zones: []string{"lobby"}}, Text: "${deployment.ref} is out"},
+	}}
+	want := &HookMatch{Matched: true, Rule: 2, Sound: "tada", Target: Target{Room: defaultRoom, Zones: []string{"lobby"}}, Text: "v1.2.0 is out"}
+	if got := hook.evaluate(decodePayload(t, testPayload)); !reflect.DeepEqual(got, want) {
+		t.Errorf("evaluate = %+v, want %+v", got, want)
+	}
+	if hook.Rules[1].Room != "" {
+		t.Errorf("evaluate changed the rule's room to %q", hook.Rules[1].Room)
+	}
+}
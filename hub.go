@@ -4,50 +4,554 @@
 
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Number of recent events each hub remembers.
+const historySize = 100
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
+	// Name of the room this hub serves.
+	room string
+
+	// Sounds and macros that plays are resolved against.
+	library *Library
+
+	// Per-sound ack counts, shared by all rooms.
+	stats *SoundStats
+
+	// Saved preferences by handle, shared by all rooms.
+	prefs *PrefStore
+
+	// Chat triggers, shared by all rooms.
+	triggers *Triggers
+
+	// Incident alarms, shared by all rooms.
+	alarms *Alarms
+
+	// Every room, for changes that reach past this one.
+	rooms *Rooms
+
 	// Registered clients.
 	clients map[*Client]bool
 
-	// Inbound messages from the clients.
-	broadcast chan []byte
+	// Batches of events to send to every client, in order.
+	broadcast chan []*jukebox.Event
 
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Events for a single client.
+	direct chan delivery
+
+	// Acks from clients.
+	acks chan ack
+
+	// Preference changes from clients.
+	preferences chan preferences
+
+	// Do-not-disturb changes from clients.
+	dnds chan dndRequest
+
+	// Ack summaries for recent play events, by sequence number.
+	receipts map[uint64]*receipt
+
+	// When each participant's theme last played.
+	themed map[string]time.Time
+
+	// Sequence number of the latest broadcast event.
+	seq uint64
+
+	mu sync.Mutex
+
+	// Room settings.
+	settings RoomSettings
+
+	// Number of registered clients in each role.
+	speakers    int
+	controllers int
+
+	// Number of registered speakers carrying each zone label.
+	zoneSpeakers map[string]int
+
+	// Number of registered clients for each presence handle.
+	handles map[string]int
+
+	historyMu sync.Mutex
+
+	// Most recent broadcast events, oldest first.
+	history []*jukebox.Event
 }
 
-func newHub() *Hub {
+// delivery is an event addressed to one client.
+type delivery struct {
+	client *Client
+	event  *jukebox.Event
+}
+
+// newHub creates the hub for a room, sharing the library and other state
+// common to all rooms.
+func newHub(rs *Rooms, room string) *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
+		room:       room,
+		settings:   rs.settings[room],
+		library:    rs.library,
+		stats:      rs.stats,
+		prefs:      rs.prefs,
+		triggers:   rs.triggers,
+		alarms:     rs.alarms,
+		rooms:      rs,
+		broadcast:  make(chan []*jukebox.Event),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		direct:     make(chan delivery),
+		acks:       make(chan ack),
 		clients:    make(map[*Client]bool),
+		receipts:   make(map[uint64]*receipt),
+		themed:     make(map[string]time.Time),
+
+		preferences:  make(chan preferences),
+		dnds:         make(chan dndRequest),
+		zoneSpeakers: make(map[string]int),
+		handles:      make(map[string]int),
 	}
 }
 
 func (h *Hub) run() {
+	ticker := time.NewTicker(receiptPeriod)
+	defer ticker.Stop()
 	for {
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
+			h.add(client)
+			if client.prefs != nil {
+				h.deliver(client, encodeEvent(&jukebox.Event{
+					Type:  jukebox.EventPrefs,
+					Room:  h.room,
+					Time:  time.Now(),
+					Prefs: client.prefs,
+				}))
+			}
+			if client.resume {
+				h.replay(client)
+			}
+			h.welcome(client)
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.remove(client)
+			}
+		case d := <-h.direct:
+			if _, ok := h.clients[d.client]; ok {
+				h.deliver(d.client, encodeEvent(d.event))
 			}
-		case message := <-h.broadcast:
+		case events := <-h.broadcast:
+			h.publish(events)
+		case a := <-h.acks:
+			h.acknowledge(a)
+		case p := <-h.preferences:
+			h.setPreferences(p)
+		case req := <-h.dnds:
+			h.setDND(req)
+		case now := <-ticker.C:
+			h.flushReceipts()
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+				h.checkDND(client, now)
 			}
 		}
 	}
 }
+
+// publish numbers a batch of events, remembers them and sends them out.
+func (h *Hub) publish(events []*jukebox.Event) {
+	for _, e := range events {
+		if e.To != "" {
+			h.whisper(e)
+			continue
+		}
+		h.seq++
+		e.Seq = h.seq
+		e.Room = h.room
+		e.Time = time.Now()
+		h.remember(e)
+		recipients := h.fanout(e)
+		if e.Type == jukebox.EventPlay {
+			h.track(e, recipients)
+		}
+	}
+}
+
+// add registers a client.
+func (h *Hub) add(client *Client) {
+	h.clients[client] = true
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if client.handle != "" {
+		h.handles[client.handle]++
+	}
+	if client.role == jukebox.RoleController {
+		h.controllers++
+		return
+	}
+	h.speakers++
+	for _, z := range client.zones {
+		h.zoneSpeakers[z]++
+	}
+}
+
+// remove unregisters a client and closes its send channel.
+func (h *Hub) remove(client *Client) {
+	delete(h.clients, client)
+	close(client.send)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if client.handle != "" {
+		if h.handles[client.handle]--; h.handles[client.handle] == 0 {
+			delete(h.handles, client.handle)
+		}
+	}
+	if client.role == jukebox.RoleController {
+		h.controllers--
+		return
+	}
+	h.speakers--
+	for _, z := range client.zones {
+		if h.zoneSpeakers[z]--; h.zoneSpeakers[z] == 0 {
+			delete(h.zoneSpeakers, z)
+		}
+	}
+}
+
+// deliver queues a message for a client, dropping the client if it has
+// fallen too far behind. It reports whether the message was queued.
+func (h *Hub) deliver(client *Client, message []byte) bool {
+	select {
+	case client.send <- message:
+		return true
+	default:
+		h.remove(client)
+		return false
+	}
+}
+
+// fanout sends an event to every client in the form each should see it, and
+// returns the clients that were sent the event itself.
+func (h *Hub) fanout(e *jukebox.Event) []*Client {
+	var full, announce []byte
+	var recipients []*Client
+	for client := range h.clients {
+		switch client.view(e) {
+		case viewFull:
+			if full == nil {
+				full = encodeEvent(e)
+			}
+			if h.deliver(client, full) {
+				recipients = append(recipients, client)
+			}
+		case viewAnnounce:
+			if announce == nil {
+				announce = encodeEvent(announcement(e))
+			}
+			h.deliver(client, announce)
+		case viewHeld:
+			client.dnd.hold(e)
+		}
+	}
+	return recipients
+}
+
+// whisper sends a play event to one participant's connections only. It is
+// neither numbered nor remembered, so no one else can see it.
+func (h *Hub) whisper(e *jukebox.Event) {
+	e.Room = h.room
+	e.Time = time.Now()
+	for client := range h.clients {
+		switch client.view(e) {
+		case viewFull:
+			h.deliver(client, encodeEvent(e))
+		case viewAnnounce:
+			h.deliver(client, encodeEvent(announcement(e)))
+		case viewHeld:
+			client.dnd.hold(e)
+		}
+	}
+}
+
+// replay sends a resuming client the events it missed, preceded by a gap
+// event if some of them are no longer held.
+func (h *Hub) replay(client *Client) {
+	missed := h.since(client.since)
+	first := h.seq + 1
+	if len(missed) > 0 {
+		first = missed[0].Seq
+	}
+	switch {
+	case client.since > h.seq:
+		// The client saw events from before a restart.
+		h.deliver(client, encodeEvent(&jukebox.Event{
+			Type: jukebox.EventGap,
+			Room: h.room,
+			Time: time.Now(),
+			Text: "event history was reset",
+		}))
+	case first > client.since+1:
+		h.deliver(client, encodeEvent(&jukebox.Event{
+			Type: jukebox.EventGap,
+			Room: h.room,
+			Time: time.Now(),
+			Text: fmt.Sprintf("missed %d events", first-client.since-1),
+		}))
+	}
+	for _, e := range missed {
+		var r jukebox.Event
+		switch client.view(e) {
+		case viewFull:
+			r = *e
+		case viewAnnounce:
+			r = *announcement(e)
+		case viewHeld:
+			client.dnd.hold(e)
+			continue
+		default:
+			continue
+		}
+		r.Replayed = true
+		if _, ok := h.clients[client]; !ok {
+			return
+		}
+		h.deliver(client, encodeEvent(&r))
+	}
+}
+
+// Settings returns the room's settings.
+func (h *Hub) Settings() RoomSettings {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.settings
+}
+
+// setSettings replaces the room's settings.
+func (h *Hub) setSettings(settings RoomSettings) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.settings = settings
+}
+
+// Status describes a room's settings and the clients connected to it.
+type Status struct {
+	Room        string       `json:"room"`
+	Settings    RoomSettings `json:"settings"`
+	Speakers    int          `json:"speakers"`
+	Controllers int          `json:"controllers"`
+
+	// Presence handles of the connected participants.
+	Handles []string `json:"handles"`
+}
+
+// Status returns the room's current status.
+func (h *Hub) Status() *Status {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	handles := make([]string, 0, len(h.handles))
+	for handle := range h.handles {
+		handles = append(handles, handle)
+	}
+	sort.Strings(handles)
+	return &Status{
+		Room:        h.room,
+		Settings:    h.settings,
+		Speakers:    h.speakers,
+		Controllers: h.controllers,
+		Handles:     handles,
+	}
+}
+
+// Zone is a zone label and the number of speakers carrying it.
+type Zone struct {
+	Zone     string `json:"zone"`
+	Speakers int    `json:"speakers"`
+}
+
+// Zones lists the zones of the connected speakers, sorted by label.
+func (h *Hub) Zones() []Zone {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	zones := make([]Zone, 0, len(h.zoneSpeakers))
+	for z, n := range h.zoneSpeakers {
+		zones = append(zones, Zone{Zone: z, Speakers: n})
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].Zone < zones[j].Zone })
+	return zones
+}
+
+// accepting returns an error if the room cannot take a play right now.
+func (h *Hub) accepting(opts jukebox.PlayOptions) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.settings.RequireSpeaker && h.speakers == 0 {
+		return errNoSpeakers
+	}
+	if opts.To != "" {
+		if h.settings.DisableWhispers {
+			return errNoWhispers
+		}
+		if h.handles[opts.To] == 0 {
+			return fmt.Errorf("%q is not in this room", opts.To)
+		}
+	}
+	return nil
+}
+
+// remember adds an event to the room's history.
+func (h *Hub) remember(e *jukebox.Event) {
+	h.historyMu.Lock()
+	defer h.historyMu.Unlock()
+	h.history = append(h.history, e)
+	if len(h.history) > historySize {
+		h.history = h.history[len(h.history)-historySize:]
+	}
+}
+
+// since returns the remembered events with sequence numbers after seq,
+// oldest first.
+func (h *Hub) since(seq uint64) []*jukebox.Event {
+	h.historyMu.Lock()
+	defer h.historyMu.Unlock()
+	i := sort.Search(len(h.history), func(i int) bool { return h.history[i].Seq > seq })
+	return append([]*jukebox.Event(nil), h.history[i:]...)
+}
+
+// handle acts on a message from a client, which is nil if the message came
+// over plain HTTP from an unknown peer.
+//
+// A message is either a bare sound or macro name, or a JSON command.
+func (h *Hub) handle(client *Client, message []byte) error {
+	if len(message) == 0 || message[0] != '{' {
+		return h.play(string(message), jukebox.PlayOptions{})
+	}
+
+	var cmd jukebox.Event
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		return err
+	}
+	switch cmd.Type {
+	case jukebox.EventPlay:
+		if cmd.Priority {
+			return errPriority
+		}
+		opts := jukebox.PlayOptions{Zones: cmd.Zones, To: cmd.To}
+		if err := validateOptions(opts); err != nil {
+			return err
+		}
+		return h.play(cmd.Sound, opts)
+	case jukebox.EventSkip:
+		h.skip(cmd.Group)
+		return nil
+	case jukebox.EventAck:
+		h.acks <- ack{client: client, seq: cmd.Ref, status: cmd.Status}
+		return nil
+	case jukebox.EventPrefs:
+		if client == nil {
+			return fmt.Errorf("preferences need a connection")
+		}
+		prefs, err := h.library.normalizePreferences(cmd.Prefs)
+		if err != nil {
+			return err
+		}
+		if client.handle != "" {
+			h.rooms.setPreferences(client.handle, prefs)
+			return nil
+		}
+		h.preferences <- preferences{client: client, prefs: prefs}
+		return nil
+	case jukebox.EventAcknowledge:
+		if cmd.Alarm == nil {
+			return fmt.Errorf("no alarm to acknowledge")
+		}
+		by := ""
+		if client != nil {
+			by = client.handle
+		}
+		_, err := h.alarms.acknowledge(cmd.Alarm.ID, h.room, by)
+		return err
+	case jukebox.EventChat, jukebox.EventReaction:
+		return h.chat(client, &cmd)
+	case jukebox.EventDND:
+		if client == nil {
+			return fmt.Errorf("do-not-disturb needs a connection")
+		}
+		d, err := parseDND(cmd.DND, time.Now())
+		if err != nil {
+			return err
+		}
+		h.dnds <- dndRequest{client: client, dnd: d}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Type)
+	}
+}
+
+// play resolves a sound or macro name and broadcasts the resulting plays.
+func (h *Hub) play(name string, opts jukebox.PlayOptions) error {
+	return h.notify(name, opts, "")
+}
+
+// notify plays a sound or macro along with text saying why, for plays that
+// the server makes on its own.
+func (h *Hub) notify(name string, opts jukebox.PlayOptions, text string) error {
+	if err := h.accepting(opts); err != nil {
+		return err
+	}
+	events, err := h.library.resolve(name)
+	if err != nil {
+		return err
+	}
+	applyOptions(events, opts)
+	for _, e := range events {
+		e.Text = text
+	}
+	h.broadcast <- events
+	return nil
+}
+
+// queue resolves several names and broadcasts their plays in order as a
+// single group. Nothing is played unless every name resolves.
+func (h *Hub) queue(names []string, opts jukebox.PlayOptions) error {
+	if err := h.accepting(opts); err != nil {
+		return err
+	}
+	group := newID()
+	var events []*jukebox.Event
+	for _, name := range names {
+		resolved, err := h.library.resolve(name)
+		if err != nil {
+			return err
+		}
+		for _, e := range resolved {
+			e.Group = group
+		}
+		events = append(events, resolved...)
+	}
+	applyOptions(events, opts)
+	h.broadcast <- events
+	return nil
+}
+
+// skip tells clients to drop a group of plays.
+func (h *Hub) skip(group string) {
+	if group == "" {
+		return
+	}
+	h.broadcast <- []*jukebox.Event{{Type: jukebox.EventSkip, Group: group}}
+}
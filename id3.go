@@ -0,0 +1,338 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // decoders for cover art
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf16"
+)
+
+// Width and height that cover art is scaled to fit for icons.
+const iconSize = 96
+
+// Most pixels a picture may have to be decoded, since a few bytes of image
+// header can claim dimensions that take gigabytes to hold.
+const maxPicturePixels = 4096 * 4096
+
+// id3Tags holds the ID3v2 frames the library uses as sound metadata.
+type id3Tags struct {
+	title   string // TIT2
+	artist  string // TPE1
+	comment string // COMM
+
+	// Embedded picture from APIC, preferring the front cover.
+	picture     []byte
+	pictureType byte
+}
+
+// Picture type of a front cover in APIC frames.
+const id3FrontCover = 3
+
+// readID3 reads the ID3v2 tag at the start of an MP3 file, if any. Besides
+// versions 2.3 and 2.4 it understands the three-letter frames of 2.2, which
+// older iTunes wrote.
+func readID3(b []byte) *id3Tags {
+	size := id3v2Size(b)
+	if size == 0 || size > len(b) {
+		return nil
+	}
+	version, flags := b[3], b[5]
+	if version < 2 || version > 4 {
+		return nil
+	}
+	tag := b[10 : 10+syncsafe(b[6:10])]
+	if version < 4 && flags&0x80 != 0 {
+		// Before 2.4, unsynchronisation applies to the whole tag.
+		tag = unsynchronise(tag)
+	}
+	if version > 2 && flags&0x40 != 0 && len(tag) >= 4 {
+		// Skip the extended header, whose size excludes itself in 2.3.
+		n := int(binary.BigEndian.Uint32(tag))
+		if version == 4 {
+			n = syncsafe(tag)
+		} else {
+			n += 4
+		}
+		if n > len(tag) {
+			return nil
+		}
+		tag = tag[n:]
+	}
+
+	tags := &id3Tags{}
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(tag) >= headerLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var n int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			n = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			n = int(binary.BigEndian.Uint32(tag[4:]))
+			frameFlags = binary.BigEndian.Uint16(tag[8:])
+		case 4:
+			// Some taggers wrote plain sizes in 2.4 tags; bytes with the
+			// high bit set cannot be syncsafe.
+			n = int(binary.BigEndian.Uint32(tag[4:]))
+			if n&0x80808080 == 0 {
+				n = syncsafe(tag[4:8])
+			}
+			frameFlags = binary.BigEndian.Uint16(tag[8:])
+		}
+		if n < 0 || headerLen+n > len(tag) {
+			break
+		}
+		data := tag[headerLen : headerLen+n]
+		tag = tag[headerLen+n:]
+
+		data, ok := frameData(version, frameFlags, data)
+		if !ok {
+			continue
+		}
+		switch id {
+		case "TIT2", "TT2":
+			tags.title = textFrame(data)
+		case "TPE1", "TP1":
+			tags.artist = textFrame(data)
+		case "COMM", "COM":
+			if c, ok := commentFrame(data); ok && tags.comment == "" {
+				tags.comment = c
+			}
+		case "APIC", "PIC":
+			if pic, kind, ok := pictureFrame(data, version == 2); ok && (tags.picture == nil || kind == id3FrontCover && tags.pictureType != id3FrontCover) {
+				tags.picture, tags.pictureType = pic, kind
+			}
+		}
+	}
+	return tags
+}
+
+// frameData undoes the compression and unsynchronisation that a frame's
+// flags call for, reporting false for encrypted frames and for compressed
+// ones that are damaged or inflate past maxAudioSize.
+func frameData(version byte, flags uint16, data []byte) ([]byte, bool) {
+	var compressed, encrypted bool
+	switch version {
+	case 3:
+		compressed, encrypted = flags&0x80 != 0, flags&0x40 != 0
+		if flags&0x20 != 0 && len(data) > 0 {
+			data = data[1:] // group
+		}
+		if compressed && len(data) >= 4 {
+			data = data[4:] // decompressed size
+		}
+	case 4:
+		compressed, encrypted = flags&0x08 != 0, flags&0x04 != 0
+		if flags&0x40 != 0 && len(data) > 0 {
+			data = data[1:] // group
+		}
+		if flags&0x01 != 0 && len(data) >= 4 {
+			data = data[4:] // data length indicator
+		}
+		if flags&0x02 != 0 {
+			data = unsynchronise(data)
+		}
+	}
+	if encrypted {
+		return nil, false
+	}
+	if compressed {
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, false
+		}
+		defer func() { _ = r.Close() }()
+		// A small frame can inflate to any size, so stop at the size of
+		// the largest file that would have been read.
+		bb, err := ioutil.ReadAll(io.LimitReader(r, maxAudioSize+1))
+		if err != nil || len(bb) > maxAudioSize {
+			return nil, false
+		}
+		data = bb
+	}
+	return data, true
+}
+
+// unsynchronise removes the zero bytes inserted after 0xff to keep tags
+// from looking like frame syncs.
+func unsynchronise(b []byte) []byte {
+	return bytes.Replace(b, []byte{0xff, 0x00}, []byte{0xff}, -1)
+}
+
+// decodeText decodes a string in one of the ID3 text encodings.
+func decodeText(encoding byte, b []byte) string {
+	var s string
+	switch encoding {
+	case 0: // ISO-8859-1
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		s = string(r)
+	case 1, 2: // UTF-16 with a byte order mark, or big-endian
+		order := binary.ByteOrder(binary.BigEndian)
+		if encoding == 1 && len(b) >= 2 {
+			if b[0] == 0xff && b[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			if b[0] == 0xff && b[1] == 0xfe || b[0] == 0xfe && b[1] == 0xff {
+				b = b[2:]
+			}
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = order.Uint16(b[2*i:])
+		}
+		s = string(utf16.Decode(u))
+	default: // UTF-8
+		s = string(b)
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+// splitText splits off the first string terminated by the encoding's null.
+func splitText(encoding byte, b []byte) (string, []byte) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return decodeText(encoding, b[:i]), b[i+2:]
+			}
+		}
+		return decodeText(encoding, b), nil
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return decodeText(encoding, b[:i]), b[i+1:]
+	}
+	return decodeText(encoding, b), nil
+}
+
+// textFrame reads a text frame, keeping only the first of several values.
+func textFrame(data []byte) string {
+	if len(data) < 1 {
+		return ""
+	}
+	s, _ := splitText(data[0], data[1:])
+	return s
+}
+
+// commentFrame reads a comment, skipping those that encoders such as iTunes
+// use to store settings.
+func commentFrame(data []byte) (string, bool) {
+	if len(data) < 4 {
+		return "", false
+	}
+	desc, rest := splitText(data[0], data[4:])
+	if strings.HasPrefix(desc, "iTun") {
+		return "", false
+	}
+	text := decodeText(data[0], rest)
+	return text, text != ""
+}
+
+// pictureFrame reads an APIC frame, or a PIC frame from ID3v2.2, which
+// gives a three-letter format instead of a MIME type.
+func pictureFrame(data []byte, v22 bool) ([]byte, byte, bool) {
+	if len(data) < 2 {
+		return nil, 0, false
+	}
+	encoding, rest := data[0], data[1:]
+	if v22 {
+		if len(rest) < 3 {
+			return nil, 0, false
+		}
+		rest = rest[3:]
+	} else {
+		i := bytes.IndexByte(rest, 0)
+		if i < 0 {
+			return nil, 0, false
+		}
+		rest = rest[i+1:]
+	}
+	if len(rest) < 1 {
+		return nil, 0, false
+	}
+	kind := rest[0]
+	_, pic := splitText(encoding, rest[1:])
+	return pic, kind, len(pic) > 0
+}
+
+// thumbnail scales a picture to fit within an icon, averaging the pixels
+// that each one covers, and encodes it as a PNG. Pictures of more than
+// maxPicturePixels are refused before they are decoded.
+func thumbnail(pic []byte) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(pic))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxPicturePixels {
+		return nil, fmt.Errorf("picture is too large at %dx%d", cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(pic))
+	if err != nil {
+		return nil, err
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > iconSize || h > iconSize {
+		if w > h {
+			w, h = iconSize, h*iconSize/w
+		} else {
+			w, h = w*iconSize/h, iconSize
+		}
+	}
+	if w < 1 || h < 1 {
+		return nil, image.ErrFormat
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r, g, bl, a = r+uint64(c.R), g+uint64(c.G), bl+uint64(c.B), a+uint64(c.A)
+					n++
+				}
+			}
+			if n > 0 {
+				dst.Set(x, y, color.NRGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
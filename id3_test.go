@@ -0,0 +1,300 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"unicode/utf16"
+)
+
+// syncsafeBytes encodes n as a four-byte syncsafe integer.
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+// id3Tag builds an ID3v2 tag of a version from frames built by id3Frame.
+func id3Tag(version, flags byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	tag := append([]byte{'I', 'D', '3', version, 0, flags}, syncsafeBytes(len(body))...)
+	return append(tag, body...)
+}
+
+// id3Frame builds a frame for a tag of a version. Frames in 2.4 tags get
+// syncsafe sizes unless plain is set, as some taggers wrote them.
+func id3Frame(version byte, id string, flags uint16, data []byte, plain bool) []byte {
+	frame := []byte(id)
+	switch {
+	case version == 2:
+		frame = append(frame, byte(len(data)>>16), byte(len(data)>>8), byte(len(data)))
+		return append(frame, data...)
+	case version == 4 && !plain:
+		frame = append(frame, syncsafeBytes(len(data))...)
+	default:
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+		frame = append(frame, size[:]...)
+	}
+	frame = append(frame, byte(flags>>8), byte(flags))
+	return append(frame, data...)
+}
+
+// latin1 returns text in ID3 encoding 0.
+func latin1(s string) []byte {
+	return append([]byte{0}, s...)
+}
+
+// utf16Text returns text in ID3 encoding 1 with a byte order mark, or in
+// encoding 2 without one if bom is nil.
+func utf16Text(s string, order binary.ByteOrder, bom []byte) []byte {
+	b := []byte{1}
+	if bom == nil {
+		b[0] = 2
+	}
+	b = append(b, bom...)
+	for _, u := range utf16.Encode([]rune(s)) {
+		var c [2]byte
+		order.PutUint16(c[:], u)
+		b = append(b, c[:]...)
+	}
+	return b
+}
+
+// comment returns a COMM frame body in Latin-1 with a description.
+func comment(desc, text string) []byte {
+	return append(append([]byte{0, 'e', 'n', 'g'}, desc+"\x00"...), text...)
+}
+
+// picture returns an APIC frame body, or a PIC one for ID3v2.2.
+func picture(v22 bool, kind byte, data string) []byte {
+	b := []byte{0}
+	if v22 {
+		b = append(b, "PNG"...)
+	} else {
+		b = append(b, "image/png\x00"...)
+	}
+	b = append(b, kind)
+	b = append(b, "cover\x00"...)
+	return append(b, data...)
+}
+
+// synchronise inserts a zero after every 0xff, undoing unsynchronise.
+func synchronise(b []byte) []byte {
+	return bytes.Replace(b, []byte{0xff}, []byte{0xff, 0x00}, -1)
+}
+
+// compress returns a zlib stream of data.
+func compress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestReadID3(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	zipped := compress(latin1("Squeezed"))
+	tests := []struct {
+		name string
+		tag  []byte
+		want id3Tags
+	}{
+		{
+			name: "v2.3",
+			tag: id3Tag(3, 0,
+				id3Frame(3, "TIT2", 0, latin1("Tada"), false),
+				id3Frame(3, "TPE1", 0, latin1("Orchestra\x00Second artist"), false),
+				id3Frame(3, "COMM", 0, comment("iTunNORM", " 00000233 000002B8"), false),
+				id3Frame(3, "COMM", 0, comment("", "Fanfare for a job well done"), false),
+			),
+			want: id3Tags{title: "Tada", artist: "Orchestra", comment: "Fanfare for a job well done"},
+		},
+		{
+			name: "v2.4 syncsafe sizes",
+			tag: id3Tag(4, 0,
+				id3Frame(4, "TIT2", 0, append([]byte{3}, "Café"...), false),
+				id3Frame(4, "COMM", 0, comment("", long), false),
+				id3Frame(4, "TPE1", 0, latin1("After"), false),
+			),
+			want: id3Tags{title: "Café", artist: "After", comment: long},
+		},
+		{
+			name: "v2.4 plain sizes",
+			tag: id3Tag(4, 0,
+				id3Frame(4, "COMM", 0, comment("", long[:200]), true),
+				id3Frame(4, "TPE1", 0, latin1("After"), true),
+			),
+			want: id3Tags{artist: "After", comment: long[:200]},
+		},
+		{
+			name: "v2.2",
+			tag: id3Tag(2, 0,
+				id3Frame(2, "TT2", 0, latin1("Old iTunes"), false),
+				id3Frame(2, "TP1", 0, latin1("Someone"), false),
+				id3Frame(2, "COM", 0, comment("", "From 2004"), false),
+				id3Frame(2, "PIC", 0, picture(true, id3FrontCover, "png!"), false),
+			),
+			want: id3Tags{title: "Old iTunes", artist: "Someone", comment: "From 2004", picture: []byte("png!"), pictureType: id3FrontCover},
+		},
+		{
+			name: "UTF-16",
+			tag: id3Tag(3, 0,
+				id3Frame(3, "TIT2", 0, utf16Text("Ünïcödé ♪", binary.LittleEndian, []byte{0xff, 0xfe}), false),
+				id3Frame(3, "TPE1", 0, utf16Text("Big ♪", binary.BigEndian, []byte{0xfe, 0xff}), false),
+			),
+			want: id3Tags{title: "Ünïcödé ♪", artist: "Big ♪"},
+		},
+		{
+			name: "UTF-16BE",
+			tag:  id3Tag(4, 0, id3Frame(4, "TIT2", 0, utf16Text("No BOM ♪", binary.BigEndian, nil), false)),
+			want: id3Tags{title: "No BOM ♪"},
+		},
+		{
+			name: "front cover wins",
+			tag: id3Tag(3, 0,
+				id3Frame(3, "APIC", 0, picture(false, 0, "other"), false),
+				id3Frame(3, "APIC", 0, picture(false, id3FrontCover, "front"), false),
+				id3Frame(3, "APIC", 0, picture(false, 4, "back"), false),
+			),
+			want: id3Tags{picture: []byte("front"), pictureType: id3FrontCover},
+		},
+		{
+			name: "first picture without a front cover",
+			tag: id3Tag(3, 0,
+				id3Frame(3, "APIC", 0, picture(false, 4, "back"), false),
+				id3Frame(3, "APIC", 0, picture(false, 0, "other"), false),
+			),
+			want: id3Tags{picture: []byte("back"), pictureType: 4},
+		},
+		{
+			name: "compressed frame",
+			tag: id3Tag(3, 0,
+				id3Frame(3, "TIT2", 0x80, append([]byte{0, 0, 0, 9}, zipped...), false),
+				id3Frame(3, "TPE1", 0, latin1("Plain"), false),
+			),
+			want: id3Tags{title: "Squeezed", artist: "Plain"},
+		},
+		{
+			name: "v2.4 compressed frame",
+			tag: id3Tag(4, 0,
+				id3Frame(4, "TIT2", 0x09, append([]byte{0, 0, 0, 9}, zipped...), false),
+			),
+			want: id3Tags{title: "Squeezed"},
+		},
+		{
+			name: "encrypted frame",
+			tag: id3Tag(3, 0,
+				id3Frame(3, "TIT2", 0x40, latin1("Secret"), false),
+				id3Frame(3, "TPE1", 0, latin1("Public"), false),
+			),
+			want: id3Tags{artist: "Public"},
+		},
+		{
+			name: "unsynchronised tag",
+			tag: id3Tag(3, 0x80,
+				synchronise(id3Frame(3, "APIC", 0, picture(false, id3FrontCover, "\xff\xd8\xff\xe0"), false)),
+			),
+			want: id3Tags{picture: []byte("\xff\xd8\xff\xe0"), pictureType: id3FrontCover},
+		},
+		{
+			name: "extended header",
+			tag: id3Tag(3, 0x40,
+				append([]byte{0, 0, 0, 6, 0, 0, 0, 0, 0, 0}, id3Frame(3, "TIT2", 0, latin1("Extended"), false)...),
+			),
+			want: id3Tags{title: "Extended"},
+		},
+		{
+			name: "frame running past the tag",
+			tag: id3Tag(3, 0,
+				id3Frame(3, "TIT2", 0, latin1("Fine"), false),
+				id3Frame(3, "TPE1", 0, latin1("Cut"), false)[:12],
+			),
+			want: id3Tags{title: "Fine"},
+		},
+	}
+	for _, tt := range tests {
+		got := readID3(append(tt.tag, 0xff, 0xfb, 0x90, 0x64))
+		if got == nil {
+			t.Errorf("%s: no tag", tt.name)
+			continue
+		}
+		if got.title != tt.want.title || got.artist != tt.want.artist || got.comment != tt.want.comment ||
+			!bytes.Equal(got.picture, tt.want.picture) || got.pictureType != tt.want.pictureType {
+			t.Errorf("%s: got %+q, want %+q", tt.name, *got, tt.want)
+		}
+	}
+
+	for _, b := range [][]byte{nil, []byte("not a tag"), []byte("ID3\x05\x00\x00\x00\x00\x00\x00"), id3Tag(3, 0, id3Frame(3, "TIT2", 0, latin1("Tada"), false))[:15]} {
+		if tags := readID3(b); tags != nil {
+			t.Errorf("readID3(%q) = %+v, want nil", b, *tags)
+		}
+	}
+}
+
+func TestFrameDataBomb(t *testing.T) {
+	bomb := compress(make([]byte, maxAudioSize+1))
+	if _, ok := frameData(3, 0x80, append([]byte{0, 0, 0, 0}, bomb...)); ok {
+		t.Error("frameData inflated a frame past maxAudioSize")
+	}
+	fits := compress(make([]byte, 1000))
+	if data, ok := frameData(3, 0x80, append([]byte{0, 0, 0, 0}, fits...)); !ok || len(data) != 1000 {
+		t.Errorf("frameData inflated to %d bytes, %v; want 1000", len(data), ok)
+	}
+	if _, ok := frameData(3, 0x80, []byte{0, 0, 0, 0, 'n', 'o', 'p', 'e'}); ok {
+		t.Error("frameData accepted a damaged zlib stream")
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			src.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	icon, err := thumbnail(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(icon))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != iconSize || b.Dy() != iconSize/2 {
+		t.Errorf("thumbnail is %dx%d, want %dx%d", b.Dx(), b.Dy(), iconSize, iconSize/2)
+	}
+	if c := color.NRGBAModel.Convert(img.At(10, 10)).(color.NRGBA); c != (color.NRGBA{R: 255, A: 255}) {
+		t.Errorf("thumbnail pixel is %v, want red", c)
+	}
+
+	// A GIF header claiming a 65535x65535 screen, with nothing after it.
+	huge := []byte("GIF89a\xff\xff\xff\xff\x00\x00\x00")
+	if _, err := thumbnail(huge); err == nil || err.Error() != "picture is too large at 65535x65535" {
+		t.Errorf("thumbnail of a huge picture: got %v", err)
+	}
+	if _, err := thumbnail([]byte("not a picture")); err == nil {
+		t.Error("thumbnail accepted a non-picture")
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jukebox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Largest page of search results the server returns.
+const maxPageSize = 200
+
+// Client talks to a jukebox server.
+type Client struct {
+	// Server is the base URL, such as "http://localhost:8080".
+	Server string
+
+	// Room to play in and listen to; empty means the server's default room.
+	Room string
+
+	// APIKey, if set, is sent as a bearer token.
+	APIKey string
+
+	// Role to connect as when subscribing; empty means RoleController,
+	// since most programs do not play sounds aloud.
+	Role string
+
+	// HTTPClient makes API requests; nil means http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Dialer opens websocket connections; nil means websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+}
+
+// NewClient returns a client for the server at a base URL.
+func NewClient(server string) *Client {
+	return &Client{Server: server}
+}
+
+// Error is a request that the server rejected.
+type Error struct {
+	// HTTP status code of the response.
+	StatusCode int
+
+	// Text of the server's error.
+	Text string
+
+	// Suggestions for a sound name the server could not resolve.
+	Suggestions []string
+}
+
+func (e *Error) Error() string {
+	return e.Text
+}
+
+// Play plays a sound or macro. The name may be an alias, an abbreviation,
+// "random" or "random:<tag>". Options may be nil.
+func (c *Client) Play(ctx context.Context, name string, opts *PlayOptions) error {
+	return c.do(ctx, http.MethodPost, "/play/"+url.PathEscape(name), opts.query(), nil, nil)
+}
+
+// Queue plays several sounds or macros in order, as one group. Options may
+// be nil.
+func (c *Client) Queue(ctx context.Context, names []string, opts *PlayOptions) error {
+	return c.do(ctx, http.MethodPost, "/api/queue", opts.query(), names, nil)
+}
+
+// query encodes play options as URL parameters.
+func (opts *PlayOptions) query() url.Values {
+	q := url.Values{}
+	if opts == nil {
+		return q
+	}
+	for _, z := range opts.Zones {
+		q.Add("zone", z)
+	}
+	if opts.To != "" {
+		q.Set("to", opts.To)
+	}
+	if opts.Priority {
+		q.Set("priority", "true")
+	}
+	return q
+}
+
+// Search returns one page of sounds ranked by how well they match a query,
+// limited to those carrying every given tag.
+func (c *Client) Search(ctx context.Context, query string, tags []string, offset int, limit int) (*SearchResults, error) {
+	q := url.Values{"offset": {strconv.Itoa(offset)}, "limit": {strconv.Itoa(limit)}}
+	if query != "" {
+		q.Set("q", query)
+	}
+	for _, t := range tags {
+		q.Add("tag", t)
+	}
+	var page SearchResults
+	if err := c.do(ctx, http.MethodGet, "/api/sounds", q, nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// List returns every sound in the library, or every sound with a tag.
+func (c *Client) List(ctx context.Context, tag string) ([]*Sound, error) {
+	var tags []string
+	if tag != "" {
+		tags = []string{tag}
+	}
+	var sounds []*Sound
+	for {
+		page, err := c.Search(ctx, "", tags, len(sounds), maxPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range page.Results {
+			sounds = append(sounds, &m.Sound)
+		}
+		if len(page.Results) == 0 || len(sounds) >= page.Total {
+			return sounds, nil
+		}
+	}
+}
+
+// History returns the room's recent events, oldest first.
+func (c *Client) History(ctx context.Context) ([]*Event, error) {
+	var events []*Event
+	if err := c.do(ctx, http.MethodGet, "/api/history", nil, nil, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// StartAlarm starts an alarm in the client's room and returns it with its ID
+// filled in.
+func (c *Client) StartAlarm(ctx context.Context, alarm *Alarm) (*Alarm, error) {
+	var started Alarm
+	if err := c.do(ctx, http.MethodPost, "/api/alarms", nil, alarm, &started); err != nil {
+		return nil, err
+	}
+	return &started, nil
+}
+
+// Alarms returns the active and recently acknowledged alarms in every room,
+// newest first.
+func (c *Client) Alarms(ctx context.Context) ([]*Alarm, error) {
+	var alarms []*Alarm
+	if err := c.do(ctx, http.MethodGet, "/api/alarms", nil, nil, &alarms); err != nil {
+		return nil, err
+	}
+	return alarms, nil
+}
+
+// Acknowledge stops an alarm, recording who acknowledged it.
+func (c *Client) Acknowledge(ctx context.Context, id string, by string) (*Alarm, error) {
+	var alarm Alarm
+	q := url.Values{"by": {by}}
+	if err := c.do(ctx, http.MethodPost, "/api/alarms/"+url.PathEscape(id)+"/ack", q, nil, &alarm); err != nil {
+		return nil, err
+	}
+	return &alarm, nil
+}
+
+// endpoint builds a URL on the server, adding the room if one is set.
+func (c *Client) endpoint(path string, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.Room != "" {
+		query.Set("room", c.Room)
+	}
+	u := strings.TrimRight(c.Server, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// header returns the headers sent with every request.
+func (c *Client) header() http.Header {
+	h := http.Header{}
+	if c.APIKey != "" {
+		h.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	return h
+}
+
+// do sends a request with an optional JSON body and decodes a JSON response
+// into out, if given.
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		bb, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(bb)
+	}
+	req, err := http.NewRequest(method, c.endpoint(path, query), body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header = c.header()
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	bb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		e := &Error{StatusCode: resp.StatusCode, Text: strings.TrimSpace(string(bb))}
+		var ev Event
+		if json.Unmarshal(bb, &ev) == nil && ev.Type == EventError {
+			e.Text = ev.Text
+			e.Suggestions = ev.Suggestions
+		}
+		if e.Text == "" {
+			e.Text = resp.Status
+		}
+		return e
+	}
+	if out == nil || len(bb) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(bb, out); err != nil {
+		return fmt.Errorf("decoding response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jukebox
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// replying returns a server that records each request and answers with a
+// status and body.
+func replying(t *testing.T, status int, body string, requests *[]*http.Request) *Client {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r)
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(ts.Close)
+	return NewClient(ts.URL + "/")
+}
+
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		status      int
+		body        string
+		text        string
+		suggestions []string
+	}{
+		{status: http.StatusOK},
+		{
+			status:      http.StatusNotFound,
+			body:        `{"type":"error","text":"Unknown sound: tad","suggestions":["tada","drama"]}`,
+			text:        "Unknown sound: tad",
+			suggestions: []string{"tada", "drama"},
+		},
+		{status: http.StatusUnauthorized, body: "Unauthorized\n", text: "Unauthorized"},
+		{status: http.StatusBadRequest, body: `{"type":"play","text":"odd"}`, text: `{"type":"play","text":"odd"}`},
+		{status: http.StatusServiceUnavailable, text: "503 Service Unavailable"},
+	}
+	for _, tt := range tests {
+		var requests []*http.Request
+		c := replying(t, tt.status, tt.body, &requests)
+		err := c.Play(context.Background(), "tad", nil)
+		if tt.text == "" {
+			if err != nil {
+				t.Errorf("status %d: %v", tt.status, err)
+			}
+			continue
+		}
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("status %d: got %v, want *Error", tt.status, err)
+			continue
+		}
+		if e.StatusCode != tt.status || e.Text != tt.text || !reflect.DeepEqual(e.Suggestions, tt.suggestions) {
+			t.Errorf("status %d: got %+v, want %q suggesting %q", tt.status, e, tt.text, tt.suggestions)
+		}
+	}
+}
+
+func TestClientPlay(t *testing.T) {
+	var requests []*http.Request
+	c := replying(t, http.StatusNoContent, "", &requests)
+	c.Room, c.APIKey = "ops", "secret"
+	opts := &PlayOptions{Zones: []string{"desk", "lobby"}, To: "bob", Priority: true}
+	if err := c.Play(context.Background(), "air horn", opts); err != nil {
+		t.Fatal(err)
+	}
+	r := requests[0]
+	if r.Method != http.MethodPost || r.URL.EscapedPath() != "/play/air%20horn" {
+		t.Errorf("got %s %s, want POST /play/air%%20horn", r.Method, r.URL.EscapedPath())
+	}
+	q := r.URL.Query()
+	if q.Get("room") != "ops" || !reflect.DeepEqual(q["zone"], opts.Zones) || q.Get("to") != "bob" || q.Get("priority") != "true" {
+		t.Errorf("query %q does not carry the room and options", r.URL.RawQuery)
+	}
+	if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization %q, want bearer token", got)
+	}
+}
+
+func TestClientSearch(t *testing.T) {
+	var requests []*http.Request
+	c := replying(t, http.StatusOK, `{"total":3,"offset":2,"results":[{"name":"tada","url":"/sounds/tada.mp3","score":7}]}`, &requests)
+	page, err := c.Search(context.Background(), "ta", []string{"short", "loud"}, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || page.Offset != 2 || len(page.Results) != 1 || page.Results[0].Name != "tada" || page.Results[0].Score != 7 {
+		t.Errorf("got %+v", page)
+	}
+	q := requests[0].URL.Query()
+	if q.Get("q") != "ta" || !reflect.DeepEqual(q["tag"], []string{"short", "loud"}) || q.Get("offset") != "2" || q.Get("limit") != "1" {
+		t.Errorf("query %q does not carry the search", requests[0].URL.RawQuery)
+	}
+
+	c = replying(t, http.StatusOK, `{"total": "many"}`, &requests)
+	if _, err := c.Search(context.Background(), "", nil, 0, 10); err == nil || !strings.HasPrefix(err.Error(), "decoding response") {
+		t.Errorf("malformed page: got %v, want decoding error", err)
+	}
+	c = replying(t, http.StatusBadRequest, `{"type":"error","text":"Bad limit"}`, &requests)
+	if _, err := c.Search(context.Background(), "", nil, 0, -1); err == nil || err.Error() != "Bad limit" {
+		t.Errorf("rejected search: got %v, want Bad limit", err)
+	}
+}
+
+func TestClientAcknowledge(t *testing.T) {
+	var requests []*http.Request
+	c := replying(t, http.StatusOK, `{"id":"a/1","room":"ops","sound":"bell","started":"2018-01-02T03:04:05Z","ackedBy":"alice"}`, &requests)
+	alarm, err := c.Acknowledge(context.Background(), "a/1", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alarm.ID != "a/1" || alarm.AckedBy != "alice" || alarm.Sound != "bell" {
+		t.Errorf("got %+v", alarm)
+	}
+	r := requests[0]
+	if r.Method != http.MethodPost || r.URL.EscapedPath() != "/api/alarms/a%2F1/ack" || r.URL.Query().Get("by") != "alice" {
+		t.Errorf("got %s %s", r.Method, r.URL)
+	}
+
+	c = replying(t, http.StatusNotFound, "Unknown alarm\n", &requests)
+	alarm, err = c.Acknowledge(context.Background(), "gone", "alice")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusNotFound || e.Text != "Unknown alarm" || alarm != nil {
+		t.Errorf("unknown alarm: got %+v, %v", alarm, err)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jukebox is a client for the jukebox server, along with the message
+// types that the server and its clients share.
+package jukebox
+
+import (
+	"time"
+)
+
+// Event types sent from the hub to clients.
+const (
+	// EventPlay asks clients to queue a sound.
+	EventPlay = "play"
+
+	// EventAnnounce tells a controller that a sound is being played, without
+	// asking it to play the sound itself.
+	EventAnnounce = "announce"
+
+	// EventSkip asks clients to drop every queued or playing sound in a group.
+	EventSkip = "skip"
+
+	// EventError tells a single client that its request failed.
+	EventError = "error"
+
+	// EventGap tells a resuming client that some events it missed are no
+	// longer held by the server.
+	EventGap = "gap"
+
+	// EventAck is sent by a client to report whether it played an event.
+	EventAck = "ack"
+
+	// EventReceipt summarizes the acks received for a play event.
+	EventReceipt = "receipt"
+
+	// EventPrefs is sent by a client to set its Preferences. The hub answers
+	// with an EventPrefs holding the preferences now in effect.
+	EventPrefs = "prefs"
+
+	// EventDND is sent by a client to start or stop do-not-disturb. The hub
+	// answers with an EventDND holding the state now in effect, and sends
+	// another listing the plays held back once do-not-disturb ends.
+	EventDND = "dnd"
+
+	// EventChat is a short text message from a participant. It is never
+	// played.
+	EventChat = "chat"
+
+	// EventReaction attaches an emoji, in Text, to the play event that Ref
+	// names.
+	EventReaction = "reaction"
+
+	// EventAlarm reports that an alarm started, escalated or was
+	// acknowledged. The plays an alarm makes are ordinary play events that
+	// carry the Alarm too.
+	EventAlarm = "alarm"
+
+	// EventAcknowledge is sent by a client to acknowledge the alarm whose ID
+	// is given in Alarm.
+	EventAcknowledge = "acknowledge"
+)
+
+// Roles a client may take when it connects.
+const (
+	// RoleSpeaker clients play sounds aloud.
+	RoleSpeaker = "speaker"
+
+	// RoleController clients are silent remote controls. They are sent
+	// EventAnnounce in place of EventPlay.
+	RoleController = "controller"
+)
+
+// Statuses a client may report in an EventAck.
+const (
+	// AckPlayed means the sound played.
+	AckPlayed = "played"
+
+	// AckFailed means the sound could not be loaded or decoded.
+	AckFailed = "failed"
+
+	// AckBlocked means the browser refused to autoplay the sound.
+	AckBlocked = "blocked"
+)
+
+// Event is a single message broadcast by the hub.
+type Event struct {
+	// Sequence number, increasing by one with each event broadcast in a
+	// room. Events sent to a single client have none.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Type of event, such as EventPlay.
+	Type string `json:"type"`
+
+	// Room the event was broadcast in.
+	Room string `json:"room,omitempty"`
+
+	// Time the event was broadcast.
+	Time time.Time `json:"time,omitempty"`
+
+	// Sound name, for play events.
+	Sound string `json:"sound,omitempty"`
+
+	// Group ID shared by every play expanded from the same macro.
+	Group string `json:"group,omitempty"`
+
+	// Wait is the pause in milliseconds before this sound starts.
+	Wait int64 `json:"wait,omitempty"`
+
+	// Zones whose speakers should play the sound; empty means all of them.
+	Zones []string `json:"zones,omitempty"`
+
+	// To is the handle of the only participant meant to hear a whisper.
+	To string `json:"to,omitempty"`
+
+	// Priority plays reach clients even in do-not-disturb.
+	Priority bool `json:"priority,omitempty"`
+
+	// From is the handle of the participant who sent a chat message or
+	// reaction, if known.
+	From string `json:"from,omitempty"`
+
+	// Text describing the event, or the body of a chat message or reaction.
+	Text string `json:"text,omitempty"`
+
+	// Suggestions for a name that could not be resolved.
+	Suggestions []string `json:"suggestions,omitempty"`
+
+	// Replayed is set on events resent to a client that reconnected.
+	Replayed bool `json:"replayed,omitempty"`
+
+	// Ref is the sequence number of the event that an ack, receipt or
+	// reaction is for.
+	Ref uint64 `json:"ref,omitempty"`
+
+	// Status reported by an ack, such as AckPlayed.
+	Status string `json:"status,omitempty"`
+
+	// Receipt counts the acks for the referenced event, for receipts.
+	Receipt *Receipt `json:"receipt,omitempty"`
+
+	// Prefs carries a client's preferences, for prefs events.
+	Prefs *Preferences `json:"prefs,omitempty"`
+
+	// DND carries a client's do-not-disturb state, for dnd events.
+	DND *DoNotDisturb `json:"dnd,omitempty"`
+
+	// Alarm is the alarm that a play or alarm event belongs to.
+	Alarm *Alarm `json:"alarm,omitempty"`
+
+	// Missed lists the sounds held back while a client was in
+	// do-not-disturb, oldest first.
+	Missed []string `json:"missed,omitempty"`
+}
+
+// DoNotDisturb holds back all but priority plays from a client, for a while
+// or during daily quiet hours. With no fields set, it is off.
+type DoNotDisturb struct {
+	// For is how long to stay in do-not-disturb, such as "30m". The hub
+	// replaces it with Until.
+	For string `json:"for,omitempty"`
+
+	// Until is when do-not-disturb ends.
+	Until *time.Time `json:"until,omitempty"`
+
+	// Schedule gives daily quiet hours in the server's local time, such as
+	// "18:00-09:00".
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// Receipt summarizes the acks received for a play event.
+type Receipt struct {
+	// Clients the event was sent to.
+	Recipients int `json:"recipients"`
+
+	Played  int `json:"played"`
+	Failed  int `json:"failed"`
+	Blocked int `json:"blocked"`
+}
+
+// Preferences filter the plays a client is sent and pick its theme sound.
+// They are kept per handle, so they survive reconnects.
+type Preferences struct {
+	// Mute lists sounds the client never wants to hear.
+	Mute []string `json:"mute,omitempty"`
+
+	// Tags, if any, limit the client to sounds carrying at least one of them.
+	Tags []string `json:"tags,omitempty"`
+
+	// Theme is a sound or macro played when the participant joins a room.
+	Theme string `json:"theme,omitempty"`
+}
+
+// Alarm repeats a sound in a room until someone acknowledges it. Its plays
+// get through mutes and do-not-disturb.
+type Alarm struct {
+	ID   string `json:"id,omitempty"`
+	Room string `json:"room,omitempty"`
+
+	// Sound or macro to repeat.
+	Sound string `json:"sound"`
+
+	// Every is how often to repeat the sound, such as "30s".
+	Every string `json:"every,omitempty"`
+
+	// Zones whose speakers should play the sound; empty means all of them.
+	Zones []string `json:"zones,omitempty"`
+
+	// EscalateTo is a sound or macro to switch to if nobody acknowledges the
+	// alarm within EscalateAfter, such as "5m".
+	EscalateTo    string `json:"escalateTo,omitempty"`
+	EscalateAfter string `json:"escalateAfter,omitempty"`
+
+	// Text says what the alarm is about.
+	Text string `json:"text,omitempty"`
+
+	Started   time.Time `json:"started"`
+	Escalated bool      `json:"escalated,omitempty"`
+
+	// Who acknowledged the alarm and when, once someone has.
+	AckedBy string     `json:"ackedBy,omitempty"`
+	AckedAt *time.Time `json:"ackedAt,omitempty"`
+}
+
+// PlayOptions control where a play is heard.
+type PlayOptions struct {
+	// Zones whose speakers should play the sound; empty means all of them.
+	Zones []string `json:"zones,omitempty"`
+
+	// To whispers the play to a single participant by handle. Whispers are
+	// not numbered or kept in the room's history.
+	To string `json:"to,omitempty"`
+
+	// Priority plays reach clients even in do-not-disturb.
+	Priority bool `json:"priority,omitempty"`
+}
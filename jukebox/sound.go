@@ -0,0 +1,95 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jukebox
+
+import (
+	"strings"
+)
+
+// Sound is a single entry in the library manifest.
+//
+// In the manifest a sound may be given either as a bare URL or as an object:
+//
+//	"tada": "/sounds/tada.mp3",
+//	"danielsan": {"url": "/sounds/danielsan.mp3", "title": "Daniel-san", "aliases": ["karate"], "tags": ["movies"], "weight": 2}
+type Sound struct {
+	Name    string   `json:"name"`
+	URL     string   `json:"url"`
+	Title   string   `json:"title,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+
+	// Attribution credits the sound's source, such as its artist.
+	Attribution string `json:"attribution,omitempty"`
+
+	// Icon is the URL of an image to show for the sound.
+	Icon string `json:"icon,omitempty"`
+
+	// Weight for random selection; zero means the default of one.
+	Weight float64 `json:"weight,omitempty"`
+
+	// Audio describes the sound's file, once the server has inspected it.
+	Audio *AudioInfo `json:"audio,omitempty"`
+}
+
+// AudioInfo describes an audio file.
+type AudioInfo struct {
+	// Format, such as "MPEG-1 Layer III".
+	Format string `json:"format"`
+
+	// Duration in milliseconds.
+	Duration int64 `json:"duration"`
+
+	// Average bitrate in kbit/s, and whether it varies between frames.
+	Bitrate int  `json:"bitrate"`
+	VBR     bool `json:"vbr,omitempty"`
+
+	// SampleRate in Hz.
+	SampleRate int `json:"sampleRate"`
+
+	// Channels is "mono", "stereo", "joint stereo" or "dual channel".
+	Channels string `json:"channels"`
+
+	// Frames of audio in the file.
+	Frames int `json:"frames"`
+
+	// Problems found in the file, such as truncation or garbage between
+	// frames. A file with problems may still play, but may cut out early.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// HasTag reports whether the sound carries a tag, ignoring case.
+func (s *Sound) HasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match is a sound found by a search.
+type Match struct {
+	Sound
+	Score int `json:"score"`
+}
+
+// SearchResults is one page of search matches.
+type SearchResults struct {
+	Total   int      `json:"total"`
+	Offset  int      `json:"offset"`
+	Limit   int      `json:"limit"`
+	Results []*Match `json:"results"`
+}
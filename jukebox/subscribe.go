@@ -0,0 +1,131 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jukebox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed between messages from the server, which pings far more
+	// often than this.
+	readWait = 90 * time.Second
+
+	// Time allowed to write a control message to the server.
+	writeWait = 10 * time.Second
+
+	// Bounds on the delay between reconnection attempts.
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// Subscribe streams the room's events to handle until the context is done,
+// reconnecting whenever the connection drops.
+//
+// On reconnecting, the server replays the events missed in the meantime,
+// marked as Replayed, or sends an EventGap if it no longer holds them.
+// Connection errors are passed to onError, if it is not nil. Subscribe always
+// returns the context's error.
+func (c *Client) Subscribe(ctx context.Context, handle func(*Event), onError func(error)) error {
+	var last uint64
+	backoff := minBackoff
+	for {
+		connected, err := c.listen(ctx, &last, handle)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		if connected {
+			backoff = minBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// listen runs one websocket connection, reporting whether it connected at all.
+//
+// last is the sequence number of the latest event handled, and is advanced
+// as events arrive.
+func (c *Client) listen(ctx context.Context, last *uint64, handle func(*Event)) (bool, error) {
+	d := c.Dialer
+	if d == nil {
+		d = websocket.DefaultDialer
+	}
+	role := c.Role
+	if role == "" {
+		role = RoleController
+	}
+	query := url.Values{"role": {role}}
+	if *last > 0 {
+		query.Set("since", strconv.FormatUint(*last, 10))
+	}
+	u := "ws" + strings.TrimPrefix(c.endpoint("/ws", query), "http")
+	conn, _, err := d.DialContext(ctx, u, c.header())
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(readWait))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(readWait))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+	})
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+		conn.SetReadDeadline(time.Now().Add(readWait))
+		for _, line := range bytes.Split(message, []byte{'\n'}) {
+			var e Event
+			if err := json.Unmarshal(line, &e); err != nil {
+				return true, err
+			}
+			if e.Seq > 0 {
+				*last = e.Seq
+			}
+			handle(&e)
+		}
+	}
+}
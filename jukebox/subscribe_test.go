@@ -0,0 +1,123 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jukebox
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSubscribeResumes(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries []string
+	)
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		n := len(queries)
+		mu.Unlock()
+
+		switch n {
+		case 1:
+			// Two events batched into one message, then a dropped connection.
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"seq":1,"type":"play","sound":"tada"}`+"\n"+`{"seq":2,"type":"play","sound":"bell"}`))
+		default:
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"seq":3,"type":"play","sound":"drama","replayed":true}`))
+			conn.ReadMessage()
+		}
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	c.Room, c.APIKey = "ops", "secret"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var events []*Event
+	var errs []error
+	err := c.Subscribe(ctx, func(e *Event) {
+		events = append(events, e)
+		if e.Seq == 3 {
+			cancel()
+		}
+	}, func(err error) { errs = append(errs, err) })
+	if err != context.Canceled {
+		t.Errorf("Subscribe returned %v, want context.Canceled", err)
+	}
+
+	if len(events) != 3 || events[0].Sound != "tada" || events[1].Sound != "bell" || events[2].Sound != "drama" || !events[2].Replayed {
+		t.Errorf("got events %+v", events)
+	}
+	if len(errs) != 1 {
+		t.Errorf("got errors %v, want one for the dropped connection", errs)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"role=controller&room=ops", "role=controller&room=ops&since=2"}
+	if len(queries) != len(want) || queries[0] != want[0] || queries[1] != want[1] {
+		t.Errorf("connected with %q, want %q", queries, want)
+	}
+}
+
+func TestSubscribeRetries(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		tries int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tries++
+		mu.Unlock()
+		http.Error(w, "Too many rooms", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	c.Role = RoleSpeaker
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := 0
+	err := c.Subscribe(ctx, func(e *Event) {
+		t.Errorf("unexpected event %+v", e)
+	}, func(err error) {
+		if errs++; errs == 2 {
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Errorf("Subscribe returned %v, want context.Canceled", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if tries != 2 {
+		t.Errorf("dialled %d times, want 2", tries)
+	}
+}
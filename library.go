@@ -0,0 +1,422 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Largest audio file the server will read to inspect.
+const maxAudioSize = 32 << 20
+
+// Library holds the sounds from the remote manifest and any macros over them.
+type Library struct {
+	// URL of the sound library JSON.
+	manifest string
+
+	mu sync.RWMutex
+
+	// Sounds by name; nil until the manifest is loaded.
+	sounds map[string]*jukebox.Sound
+
+	// Macros by name.
+	macros map[string]*Macro
+
+	// Macro definitions from config, validated once the manifest is loaded.
+	pending map[string]string
+
+	// Icons made from cover art, as PNGs by sound name.
+	icons map[string][]byte
+
+	// Sounds named in the config outside macros, checked once the manifest
+	// is loaded.
+	expected []expectedSound
+}
+
+// expectedSound is a sound or macro that something in the config plays.
+type expectedSound struct {
+	sound string
+
+	// What plays it, such as "trigger shipit".
+	by string
+}
+
+// checkMacros parses the macros from config, which can only be checked
+// against the library once the manifest is loaded.
+func checkMacros(macros map[string]string) error {
+	for name, def := range macros {
+		if _, err := parseMacro(name, def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newLibrary(manifest string, macros map[string]string) *Library {
+	return &Library{
+		manifest: manifest,
+		macros:   make(map[string]*Macro),
+		pending:  macros,
+		icons:    make(map[string][]byte),
+	}
+}
+
+// load fetches the manifest if it has not been fetched yet.
+//
+// Loading is deferred until first use, since the manifest may be served by
+// this very process.
+func (l *Library) load() error {
+	l.mu.RLock()
+	loaded := l.sounds != nil
+	l.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	bb, err := getRemoteFile(l.manifest)
+	if err != nil {
+		return err
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(bb, &entries); err != nil {
+		return err
+	}
+	sounds := make(map[string]*jukebox.Sound, len(entries))
+	for name, data := range entries {
+		s, err := parseSound(name, data)
+		if err != nil {
+			return err
+		}
+		sounds[name] = s
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sounds != nil {
+		return nil
+	}
+	macros := make(map[string]*Macro)
+	for name, def := range l.pending {
+		// Syntax was checked at startup, but a macro may name sounds that
+		// the manifest lacks. Skip it rather than fail every load.
+		m, err := parseMacro(name, def)
+		if err == nil {
+			err = validateMacro(m, sounds)
+		}
+		if err != nil {
+			log.Println("Skipping macro:", err)
+			continue
+		}
+		macros[name] = m
+	}
+	l.sounds = sounds
+	for name, m := range macros {
+		l.macros[name] = m
+	}
+	log.Printf("Loaded %d sounds and %d macros", len(sounds), len(macros))
+	for _, problem := range l.checkExpected() {
+		log.Println("Warning:", problem)
+	}
+	l.expected = nil
+	go l.inspect(sounds)
+	return nil
+}
+
+// inspect reads each MP3 in the library to fill in its duration and format,
+// and uses its ID3 tag for any title, attribution or icon the manifest does
+// not give. Sounds are replaced rather than changed, since callers may hold
+// them.
+func (l *Library) inspect(sounds map[string]*jukebox.Sound) {
+	names := make([]string, 0, len(sounds))
+	for name := range sounds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := sounds[name]
+		if !strings.EqualFold(path.Ext(s.URL), ".mp3") {
+			continue
+		}
+		bb, err := l.readAudio(s.URL)
+		if err != nil {
+			log.Println("Could not read sound", name+":", err)
+			continue
+		}
+
+		inspected := *s
+		if inspected.Audio == nil {
+			info, err := inspectMP3(bb)
+			if err != nil {
+				log.Println("Could not inspect sound", name+":", err)
+			} else {
+				if len(info.Problems) > 0 {
+					log.Println("Sound", name, "may be damaged:", strings.Join(info.Problems, "; "))
+				}
+				inspected.Audio = info
+			}
+		}
+		var icon []byte
+		if tags := readID3(bb); tags != nil {
+			icon = tags.apply(&inspected)
+		}
+
+		l.mu.Lock()
+		if l.sounds[name] == s {
+			l.sounds[name] = &inspected
+			if icon != nil {
+				l.icons[name] = icon
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// apply fills in a sound's missing metadata from its tags, returning an
+// icon made from the cover art if the sound needs one.
+func (tags *id3Tags) apply(s *jukebox.Sound) []byte {
+	if s.Title == "" {
+		s.Title = tags.title
+	}
+	if s.Attribution == "" {
+		switch {
+		case tags.artist != "" && tags.comment != "":
+			s.Attribution = tags.artist + " (" + tags.comment + ")"
+		case tags.artist != "":
+			s.Attribution = tags.artist
+		default:
+			s.Attribution = tags.comment
+		}
+	}
+	if s.Icon != "" || tags.picture == nil {
+		return nil
+	}
+	icon, err := thumbnail(tags.picture)
+	if err != nil {
+		log.Println("Could not read cover art for sound", s.Name+":", err)
+		return nil
+	}
+	s.Icon = "/api/sounds/" + url.PathEscape(s.Name) + "/icon"
+	return icon
+}
+
+// icon returns a sound's icon made from its cover art.
+func (l *Library) icon(name string) ([]byte, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	icon, ok := l.icons[name]
+	return icon, ok
+}
+
+// readAudio reads a sound's file, whose URL may be relative to the
+// manifest's. Sounds shipped in the static directory are read from disk.
+func (l *Library) readAudio(rawURL string) ([]byte, error) {
+	ref, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Host == "" {
+		p := path.Clean("/" + ref.Path)
+		if strings.HasPrefix(p, "/static/") {
+			p = p[len("/static"):]
+		}
+		if bb, err := ioutil.ReadFile(filepath.Join("static", filepath.FromSlash(p))); err == nil {
+			return bb, nil
+		}
+	}
+	base, err := url.Parse(l.manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Get(base.ResolveReference(ref).String())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	bb, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAudioSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(bb) > maxAudioSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxAudioSize)
+	}
+	return bb, nil
+}
+
+// expect notes a sound or macro named in the config, so that it is checked
+// once the manifest is loaded rather than failing unnoticed when it plays.
+func (l *Library) expect(sound string, by string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expected = append(l.expected, expectedSound{sound: sound, by: by})
+	if l.sounds != nil {
+		for _, problem := range l.checkExpected() {
+			log.Println("Warning:", problem)
+		}
+		l.expected = nil
+	}
+}
+
+// checkExpected describes the expected sounds that cannot be played. The
+// caller must hold l.mu.
+func (l *Library) checkExpected() []string {
+	var problems []string
+	for _, x := range l.expected {
+		if _, err := l.lookup(x.sound); err != nil {
+			problems = append(problems, fmt.Sprintf("%s plays %q, which will fail: %v", x.by, x.sound, err))
+		}
+	}
+	return problems
+}
+
+// URLs returns the sound names mapped to their URLs.
+func (l *Library) URLs() map[string]string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	urls := make(map[string]string, len(l.sounds))
+	for k, v := range l.sounds {
+		urls[k] = v.URL
+	}
+	return urls
+}
+
+// sound looks up a sound by name, falling back to a case-insensitive match on
+// names and aliases.
+func (l *Library) sound(name string) (*jukebox.Sound, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if s, ok := l.sounds[name]; ok {
+		return s, true
+	}
+	for _, s := range l.sounds {
+		if strings.EqualFold(s.Name, name) {
+			return s, true
+		}
+		for _, a := range s.Aliases {
+			if strings.EqualFold(a, name) {
+				return s, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Macros returns all macros sorted by name.
+func (l *Library) Macros() []*Macro {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	macros := make([]*Macro, 0, len(l.macros))
+	for _, m := range l.macros {
+		macros = append(macros, m)
+	}
+	sort.Slice(macros, func(i, j int) bool { return macros[i].Name < macros[j].Name })
+	return macros
+}
+
+// defineMacro validates a macro against the library and adds or replaces it.
+func (l *Library) defineMacro(m *Macro) error {
+	if err := l.load(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := validateMacro(m, l.sounds); err != nil {
+		return err
+	}
+	l.macros[m.Name] = m
+	return nil
+}
+
+// removeMacro deletes a macro, reporting whether it existed.
+func (l *Library) removeMacro(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.macros[name]
+	delete(l.macros, name)
+	return ok
+}
+
+// resolve turns a user-supplied name into the events needed to play it.
+//
+// Besides sound and macro names and aliases, which may be abbreviated or
+// misspelled, it accepts "random" and "random:<tag>" for a weighted random
+// sound. An unmatched or ambiguous name yields a *ResolveError.
+func (l *Library) resolve(input string) ([]*jukebox.Event, error) {
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	name, err := l.lookup(input)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := l.macros[name]; ok {
+		return m.events(), nil
+	}
+	return []*jukebox.Event{{Type: jukebox.EventPlay, Sound: name}}, nil
+}
+
+// lookup turns a user-supplied name into the name of a sound or macro. The
+// caller must hold l.mu.
+func (l *Library) lookup(input string) (string, error) {
+	switch {
+	case strings.EqualFold(input, "random"):
+		return l.randomSound("")
+	case strings.HasPrefix(strings.ToLower(input), "random:"):
+		return l.randomSound(input[len("random:"):])
+	default:
+		return l.resolveName(input)
+	}
+}
+
+// validateMacro ensures a macro only refers to known sounds.
+func validateMacro(m *Macro, sounds map[string]*jukebox.Sound) error {
+	if _, ok := sounds[m.Name]; ok {
+		return fmt.Errorf("macro %q: name is already a sound", m.Name)
+	}
+	played := false
+	for _, s := range m.Steps {
+		if s.Sound == "" {
+			continue
+		}
+		if _, ok := sounds[s.Sound]; !ok {
+			return fmt.Errorf("macro %q: unknown sound %q", m.Name, s.Sound)
+		}
+		played = true
+	}
+	if !played {
+		return fmt.Errorf("macro %q: no sounds to play", m.Name)
+	}
+	return nil
+}
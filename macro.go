@@ -0,0 +1,122 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Maximum number of steps a macro may expand to.
+const maxMacroSteps = 64
+
+// Step is a single entry in a macro.
+type Step struct {
+	// Sound to play, or empty for a pure wait.
+	Sound string
+
+	// Wait before the next step.
+	Wait time.Duration
+}
+
+// Macro is a named sequence of sounds and pauses.
+type Macro struct {
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+	Steps      []Step `json:"-"`
+}
+
+// parseMacroLine parses a definition of the form "name = step, step, ...".
+func parseMacroLine(line string) (*Macro, error) {
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("macro %q: expected name = steps", line)
+	}
+	return parseMacro(strings.TrimSpace(parts[0]), parts[1])
+}
+
+// parseMacro parses a comma-separated list of steps.
+//
+// Each step is a sound name optionally followed by a repeat count ("yeah x2"),
+// or a pause ("wait 500ms").
+func parseMacro(name string, definition string) (*Macro, error) {
+	if name == "" || strings.ContainsAny(name, " \t/") {
+		return nil, fmt.Errorf("macro %q: invalid name", name)
+	}
+
+	m := &Macro{Name: name, Definition: strings.TrimSpace(definition)}
+	for _, field := range strings.Split(definition, ",") {
+		words := strings.Fields(field)
+		switch {
+		case len(words) == 0:
+			return nil, fmt.Errorf("macro %q: empty step", name)
+		case words[0] == "wait":
+			if len(words) != 2 {
+				return nil, fmt.Errorf("macro %q: expected wait <duration>", name)
+			}
+			d, err := time.ParseDuration(words[1])
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("macro %q: invalid wait %q", name, words[1])
+			}
+			m.Steps = append(m.Steps, Step{Wait: d})
+		case len(words) == 1:
+			m.Steps = append(m.Steps, Step{Sound: words[0]})
+		case len(words) == 2 && strings.HasPrefix(words[1], "x"):
+			n, err := strconv.Atoi(words[1][1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("macro %q: invalid repeat %q", name, words[1])
+			}
+			if n > maxMacroSteps-len(m.Steps) {
+				return nil, fmt.Errorf("macro %q: more than %d steps", name, maxMacroSteps)
+			}
+			for i := 0; i < n; i++ {
+				m.Steps = append(m.Steps, Step{Sound: words[0]})
+			}
+		default:
+			return nil, fmt.Errorf("macro %q: cannot parse step %q", name, strings.TrimSpace(field))
+		}
+		if len(m.Steps) > maxMacroSteps {
+			return nil, fmt.Errorf("macro %q: more than %d steps", name, maxMacroSteps)
+		}
+	}
+	return m, nil
+}
+
+// events expands a macro into an ordered group of play events.
+//
+// Pauses are folded into the wait of the sound that follows them.
+func (m *Macro) events() []*jukebox.Event {
+	group := newID()
+	var events []*jukebox.Event
+	var wait time.Duration
+	for _, s := range m.Steps {
+		if s.Sound == "" {
+			wait += s.Wait
+			continue
+		}
+		events = append(events, &jukebox.Event{
+			Type:  jukebox.EventPlay,
+			Sound: s.Sound,
+			Group: group,
+			Wait:  int64(wait / time.Millisecond),
+		})
+		wait = 0
+	}
+	return events
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMacro(t *testing.T) {
+	tests := []struct {
+		definition string
+		steps      []Step
+		err        string
+	}{
+		{definition: "tada", steps: []Step{{Sound: "tada"}}},
+		{definition: " tada , bell ", steps: []Step{{Sound: "tada"}, {Sound: "bell"}}},
+		{definition: "bell x3", steps: []Step{{Sound: "bell"}, {Sound: "bell"}, {Sound: "bell"}}},
+		{definition: "tada, wait 1.5s, bell", steps: []Step{{Sound: "tada"}, {Wait: 1500 * time.Millisecond}, {Sound: "bell"}}},
+		{definition: "wait 0s", steps: []Step{{}}},
+		{definition: "tada,", err: "empty step"},
+		{definition: "", err: "empty step"},
+		{definition: "wait", err: "expected wait <duration>"},
+		{definition: "wait 1s 2s", err: "expected wait <duration>"},
+		{definition: "wait soon", err: `invalid wait "soon"`},
+		{definition: "wait -1s", err: `invalid wait "-1s"`},
+		{definition: "bell x0", err: `invalid repeat "x0"`},
+		{definition: "bell x-2", err: `invalid repeat "x-2"`},
+		{definition: "bell xx", err: `invalid repeat "xx"`},
+		{definition: "bell twice", err: `cannot parse step "bell twice"`},
+		{definition: "bell x2 x3", err: `cannot parse step "bell x2 x3"`},
+		{definition: "bell x65", err: "more than 64 steps"},
+		{definition: "tada, bell x64", err: "more than 64 steps"},
+		{definition: "yeah x1000000000", err: "more than 64 steps"},
+		{definition: "yeah x99999999999999999999", err: `invalid repeat "x99999999999999999999"`},
+		{definition: strings.Repeat("tada, ", 64) + "bell", err: "more than 64 steps"},
+	}
+	for _, tt := range tests {
+		m, err := parseMacro("test", tt.definition)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseMacro(%q) = %v, %v; want error %q", tt.definition, m, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMacro(%q): %v", tt.definition, err)
+			continue
+		}
+		if !reflect.DeepEqual(m.Steps, tt.steps) {
+			t.Errorf("parseMacro(%q) steps = %+v, want %+v", tt.definition, m.Steps, tt.steps)
+		}
+	}
+}
+
+func TestParseMacroLimits(t *testing.T) {
+	m, err := parseMacro("test", "bell x63, wait 1s")
+	if err != nil || len(m.Steps) != maxMacroSteps {
+		t.Errorf("a macro of exactly %d steps: %v", maxMacroSteps, err)
+	}
+	for _, name := range []string{"", "two words", "a/b", "tab\tbed"} {
+		if _, err := parseMacro(name, "tada"); err == nil {
+			t.Errorf("parseMacro accepted the name %q", name)
+		}
+	}
+	m, err = parseMacroLine(" party = tada, bell x2 ")
+	if err != nil || m.Name != "party" || m.Definition != "tada, bell x2" || len(m.Steps) != 3 {
+		t.Errorf("parseMacroLine = %+v, %v", m, err)
+	}
+	if _, err := parseMacroLine("no equals sign"); err == nil {
+		t.Error("parseMacroLine accepted a line without =")
+	}
+}
+
+func TestMacroEvents(t *testing.T) {
+	m, err := parseMacro("test", "wait 1s, tada, wait 200ms, wait 300ms, bell x2, wait 5s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := m.events()
+	var got []string
+	for _, e := range events {
+		got = append(got, fmt.Sprintf("%s+%d", e.Sound, e.Wait))
+		if e.Group != events[0].Group || e.Group == "" {
+			t.Errorf("event %s is in group %q, want %q", e.Sound, e.Group, events[0].Group)
+		}
+	}
+	// Waits fold into the next sound, and a trailing wait is dropped.
+	if want := []string{"tada+1000", "bell+500", "bell+0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
@@ -18,13 +18,10 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// TODO: emoji responses? handles for participants?
 // TODO: revamp fault tolerance (invalid sound, etc.)
 // TODO: better log/history display in browser, plus status messages about joins/leaves--and don't try to play those...
 // TODO: Lambda to run? Accept URI for sound library...
-// TODO: different rooms, namespaced to allow multiple "conversations"
 // TODO: Slack integration
-// TODO: dedicated client app to submit?
 // NOTE: portions based heavily on https://github.com/gorilla/websocket/tree/master/examples/chat
 // TODO: allow refreshing of list if remote manifest updated??
 // TODO: remove trailing /ws if we can switch to Heroku for POC
@@ -39,12 +36,18 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
+	"strings"
+
+	"github.com/merenbach/sound-machine/jukebox"
 )
 
 var addr = flag.String("addr", "localhost:8080", "http service address")
 var manifest = flag.String("manifest", "", "URL of sound library JSON")
+var configFile = flag.String("config", "", "path to optional JSON config file")
+var dataDir = flag.String("data", "", "directory to keep state in across restarts (default memory only)")
 
 // GetRemoteFile reads the contents of a file from a remote URL.
 func getRemoteFile(url string) ([]byte, error) {
@@ -58,31 +61,60 @@ func getRemoteFile(url string) ([]byte, error) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+	flag.Usage = usage
 	flag.Parse()
-	hub := newHub()
-	go hub.run()
+	serve()
+}
+
+// serve runs the jukebox server.
+func serve() {
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal("Could not load config: ", err)
+	}
+	if err := checkMacros(cfg.Macros); err != nil {
+		log.Fatal("Could not load config: ", err)
+	}
+	library := newLibrary(*manifest, cfg.Macros)
+	prefs, err := newPrefStore(stateFile(*dataDir, "prefs.json"))
+	if err != nil {
+		log.Fatal("Could not load preferences: ", err)
+	}
+	triggers, err := newTriggers(library, cfg.Triggers)
+	if err != nil {
+		log.Fatal("Could not load triggers: ", err)
+	}
+	rooms := newRooms(library, cfg.Rooms, prefs, triggers)
 
 	log.Println("Initializing with address: ", *addr)
 	log.Println("Initializing with manifest: ", *manifest)
-	var library map[string]string
 
 	http.HandleFunc("/", serveHome)
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		hub, ok := rooms.forConnection(w, r)
+		if !ok {
+			return
+		}
 		serveWs(hub, w, r)
 	})
 	// TODO: improve this....
 	http.HandleFunc("/play/", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
-			if library == nil {
-				bb, err := getRemoteFile(*manifest)
-				if err != nil {
-					log.Fatal(err)
-				}
-				if err = json.Unmarshal(bb, &library); err != nil {
-					log.Fatal(err)
-				}
+			if err := library.load(); err != nil {
+				log.Println(err)
+				http.Error(w, "Could not load library", http.StatusInternalServerError)
+				return
+			}
+			if name := strings.TrimPrefix(r.URL.Path, "/play/"); name != "" {
+				serveSound(library, w, name)
+				return
 			}
-			bb, err := json.Marshal(library)
+			bb, err := json.Marshal(library.URLs())
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -94,17 +126,211 @@ func main() {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		if !authorize(cfg.APIKeys, w, r) {
+			return
+		}
+		hub, ok := rooms.forRequest(w, r)
+		if !ok {
+			return
+		}
 
+		if err := library.load(); err != nil {
+			log.Println(err)
+			http.Error(w, "Could not load library", http.StatusInternalServerError)
+			return
+		}
+		opts, err := optionsFromRequest(r, authenticated(cfg.APIKeys, r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		resourceName := path.Base(r.URL.Path)
-		log.Println("Requested to play sound:", resourceName)
-		hub.broadcast <- []byte(resourceName)
+		log.Println("Requested to play sound:", resourceName, "in room:", hub.room)
+		if err := hub.play(resourceName, opts); err != nil {
+			writePlayError(w, err)
+		}
+	})
+	http.HandleFunc("/api/sounds", func(w http.ResponseWriter, r *http.Request) {
+		serveSounds(library, w, r)
+	})
+	http.HandleFunc("/api/sounds/", func(w http.ResponseWriter, r *http.Request) {
+		serveSounds(library, w, r)
+	})
+	http.HandleFunc("/api/macros", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !authorize(cfg.APIKeys, w, r) {
+			return
+		}
+		serveMacros(library, w, r)
+	})
+	http.HandleFunc("/api/macros/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !authorize(cfg.APIKeys, w, r) {
+			return
+		}
+		serveMacros(library, w, r)
+	})
+	http.HandleFunc("/api/triggers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !authorize(cfg.APIKeys, w, r) {
+			return
+		}
+		serveTriggers(triggers, w, r)
+	})
+	http.HandleFunc("/api/triggers/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !authorize(cfg.APIKeys, w, r) {
+			return
+		}
+		serveTriggers(triggers, w, r)
+	})
+	http.HandleFunc("/api/alarms", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !authorize(cfg.APIKeys, w, r) {
+			return
+		}
+		serveAlarms(rooms, w, r)
+	})
+	http.HandleFunc("/api/alarms/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !authorize(cfg.APIKeys, w, r) {
+			return
+		}
+		serveAlarms(rooms, w, r)
+	})
+	heartbeats, err := newHeartbeats(rooms, stateFile(*dataDir, "heartbeats.json"), cfg.Heartbeats)
+	if err != nil {
+		log.Fatal("Could not load heartbeats: ", err)
+	}
+	go heartbeats.run()
+	http.HandleFunc("/api/heartbeats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !authorize(cfg.APIKeys, w, r) {
+			return
+		}
+		serveHeartbeats(heartbeats, w, r)
+	})
+	http.HandleFunc("/api/heartbeats/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !authorize(cfg.APIKeys, w, r) {
+			return
+		}
+		serveHeartbeats(heartbeats, w, r)
+	})
+	checks, err := newChecks(library, cfg.Checks, func(c *Check, sound string, text string) {
+		if err := rooms.notify(c.Room, sound, jukebox.PlayOptions{Zones: c.Zones}, text); err != nil {
+			log.Println("Check", c.Name, "could not play", sound+":", err)
+		}
+	})
+	if err != nil {
+		log.Fatal("Could not load checks: ", err)
+	}
+	go checks.run()
+	if err := checkWatches(library, cfg.Watches); err != nil {
+		log.Fatal("Could not load watches: ", err)
+	}
+	for _, watch := range cfg.Watches {
+		go watch.run(func(rule *LogRule, text string) {
+			if err := rooms.notify(rule.Room, rule.Sound, jukebox.PlayOptions{Zones: rule.Zones}, text); err != nil {
+				log.Println("Log rule", rule.Pattern, "could not play", rule.Sound+":", err)
+			}
+		})
+	}
+	if err := checkHooks(library, cfg.Hooks); err != nil {
+		log.Fatal("Could not load hooks: ", err)
+	}
+	http.HandleFunc("/hooks/", func(w http.ResponseWriter, r *http.Request) {
+		serveHook(rooms, cfg.Hooks, cfg.APIKeys, w, r)
+	})
+	for name, f := range map[string]*Forge{"github": cfg.GitHub, "gitlab": cfg.GitLab} {
+		if f != nil {
+			if err := f.check(library, name); err != nil {
+				log.Fatal("Could not load forge: ", err)
+			}
+		}
+	}
+	http.HandleFunc("/forge/github", func(w http.ResponseWriter, r *http.Request) {
+		serveForge(rooms, "github", cfg.GitHub, w, r)
+	})
+	http.HandleFunc("/forge/gitlab", func(w http.ResponseWriter, r *http.Request) {
+		serveForge(rooms, "gitlab", cfg.GitLab, w, r)
+	})
+	if am := cfg.Alertmanager; am != nil {
+		if err := am.check(library); err != nil {
+			log.Fatal("Could not load Alertmanager receiver: ", err)
+		}
+		am.rooms = rooms
+	}
+	http.HandleFunc("/alertmanager", func(w http.ResponseWriter, r *http.Request) {
+		serveAlertmanager(cfg.Alertmanager, w, r)
+	})
+	http.HandleFunc("/api/checks", func(w http.ResponseWriter, r *http.Request) {
+		serveChecks(checks, w, r)
+	})
+	http.HandleFunc("/api/checks/", func(w http.ResponseWriter, r *http.Request) {
+		serveChecks(checks, w, r)
+	})
+	polls := newPolls()
+	go polls.run()
+	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		hub, ok := rooms.forConnection(w, r)
+		if !ok {
+			return
+		}
+		serveEvents(polls, hub, w, r)
+	})
+	http.HandleFunc("/poll", func(w http.ResponseWriter, r *http.Request) {
+		hub, ok := rooms.forConnection(w, r)
+		if !ok {
+			return
+		}
+		servePoll(polls, hub, w, r)
+	})
+	http.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+		hub, ok := rooms.forRequest(w, r)
+		if !ok {
+			return
+		}
+		if err := library.load(); err != nil {
+			log.Println(err)
+			http.Error(w, "Could not load library", http.StatusInternalServerError)
+			return
+		}
+		serveSend(polls, hub, cfg.APIKeys, w, r)
+	})
+	http.HandleFunc("/api/queue", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorize(cfg.APIKeys, w, r) {
+			return
+		}
+		hub, ok := rooms.forRequest(w, r)
+		if !ok {
+			return
+		}
+		if err := library.load(); err != nil {
+			log.Println(err)
+			http.Error(w, "Could not load library", http.StatusInternalServerError)
+			return
+		}
+		serveQueue(hub, cfg.APIKeys, w, r)
+	})
+	http.HandleFunc("/api/stats/sounds", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, rooms.stats.all())
+	})
+	http.HandleFunc("/api/rooms", func(w http.ResponseWriter, r *http.Request) {
+		serveRooms(rooms, cfg.APIKeys, w, r)
+	})
+	http.HandleFunc("/api/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		serveRooms(rooms, cfg.APIKeys, w, r)
+	})
+	http.HandleFunc("/api/history", func(w http.ResponseWriter, r *http.Request) {
+		serveHistory(rooms, w, r)
 	})
 	// <<----
 	// TODO: remove from final product--->
 	fs := http.FileServer(http.Dir("static"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 	// <<<<<----
-	err := http.ListenAndServe(*addr, nil)
+	err = http.ListenAndServe(*addr, nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
@@ -0,0 +1,216 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Maximum number of suggestions offered for an unresolved name.
+const maxSuggestions = 8
+
+// ResolveError explains why a name did not match exactly one sound or macro.
+type ResolveError struct {
+	Name        string   `json:"name"`
+	Ambiguous   bool     `json:"ambiguous"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+func (e *ResolveError) Error() string {
+	msg := fmt.Sprintf("unknown sound %q", e.Name)
+	if e.Ambiguous {
+		msg = fmt.Sprintf("ambiguous sound %q", e.Name)
+	}
+	if len(e.Suggestions) > 0 {
+		msg += "; did you mean " + strings.Join(e.Suggestions, ", ") + "?"
+	}
+	return msg
+}
+
+// resolveName finds the sound or macro meant by a user-supplied name.
+//
+// Exact names win, followed by case-insensitive names and aliases, then
+// unique prefixes, then the closest name by edit distance. The caller must
+// hold l.mu.
+func (l *Library) resolveName(input string) (string, error) {
+	if _, ok := l.macros[input]; ok {
+		return input, nil
+	}
+	if _, ok := l.sounds[input]; ok {
+		return input, nil
+	}
+
+	// Every lowercased name and alias, mapped to what it refers to.
+	keys := make(map[string][]string)
+	for name, s := range l.sounds {
+		keys[strings.ToLower(name)] = append(keys[strings.ToLower(name)], name)
+		for _, a := range s.Aliases {
+			keys[strings.ToLower(a)] = append(keys[strings.ToLower(a)], name)
+		}
+	}
+	for name := range l.macros {
+		keys[strings.ToLower(name)] = append(keys[strings.ToLower(name)], name)
+	}
+
+	query := strings.ToLower(strings.TrimSpace(input))
+	if targets := unique(keys[query]); len(targets) > 0 {
+		return pick(input, targets)
+	}
+
+	var prefixed []string
+	for k, targets := range keys {
+		if strings.HasPrefix(k, query) {
+			prefixed = append(prefixed, targets...)
+		}
+	}
+	if targets := unique(prefixed); len(targets) > 0 {
+		return pick(input, targets)
+	}
+
+	// Closest distance to each target over all of its keys.
+	distances := make(map[string]int)
+	for k, targets := range keys {
+		d := levenshtein(query, k)
+		for _, t := range targets {
+			if old, ok := distances[t]; !ok || d < old {
+				distances[t] = d
+			}
+		}
+	}
+	limit := len([]rune(query)) / 3
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > 3 {
+		limit = 3
+	}
+	var nearest []string
+	best := limit + 1
+	for t, d := range distances {
+		switch {
+		case d > limit:
+		case d < best:
+			best, nearest = d, []string{t}
+		case d == best:
+			nearest = append(nearest, t)
+		}
+	}
+	if len(nearest) > 0 {
+		return pick(input, unique(nearest))
+	}
+
+	// Nothing is close enough to play, but offer the nearest names anyway.
+	var near []string
+	for t, d := range distances {
+		if d <= 2*limit {
+			near = append(near, t)
+		}
+	}
+	sort.Slice(near, func(i, j int) bool {
+		if distances[near[i]] != distances[near[j]] {
+			return distances[near[i]] < distances[near[j]]
+		}
+		return near[i] < near[j]
+	})
+	if len(near) > maxSuggestions {
+		near = near[:maxSuggestions]
+	}
+	return "", &ResolveError{Name: input, Suggestions: near}
+}
+
+// pick returns the only target, or an ambiguity error listing all of them.
+func pick(input string, targets []string) (string, error) {
+	if len(targets) == 1 {
+		return targets[0], nil
+	}
+	if len(targets) > maxSuggestions {
+		targets = targets[:maxSuggestions]
+	}
+	return "", &ResolveError{Name: input, Ambiguous: true, Suggestions: targets}
+}
+
+// randomSound picks a weighted random sound, optionally limited to a tag.
+// The caller must hold l.mu.
+func (l *Library) randomSound(tag string) (string, error) {
+	var names []string
+	var total float64
+	for name, s := range l.sounds {
+		if tag != "" && !s.HasTag(tag) {
+			continue
+		}
+		names = append(names, name)
+		total += soundWeight(s)
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no sounds tagged %q", tag)
+	}
+
+	// Sort so that a given random draw always maps to the same sound.
+	sort.Strings(names)
+	r := rand.Float64() * total
+	for _, name := range names {
+		r -= soundWeight(l.sounds[name])
+		if r < 0 {
+			return name, nil
+		}
+	}
+	return names[len(names)-1], nil
+}
+
+// unique sorts and deduplicates a list of names.
+func unique(names []string) []string {
+	sort.Strings(names)
+	out := names[:0]
+	for i, n := range names {
+		if i == 0 || n != names[i-1] {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// levenshtein returns the edit distance between two strings.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a int, rest ...int) int {
+	for _, b := range rest {
+		if b < a {
+			a = b
+		}
+	}
+	return a
+}
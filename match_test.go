@@ -0,0 +1,149 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// testLibrary returns a loaded library with a few sounds and a macro.
+func testLibrary(t *testing.T) *Library {
+	l := newLibrary("", nil)
+	l.sounds = map[string]*jukebox.Sound{
+		"tada":       {Name: "tada", URL: "/sounds/tada.mp3", Tags: []string{"celebrate"}},
+		"danielsan":  {Name: "danielsan", URL: "/sounds/danielsan.mp3", Title: "You're The Best", Aliases: []string{"karate"}, Tags: []string{"movies"}},
+		"dangerzone": {Name: "dangerzone", URL: "/sounds/dangerzone.mp3", Title: "Danger Zone", Tags: []string{"movies", "music"}},
+		"drama":      {Name: "drama", URL: "/sounds/drama.mp3", Aliases: []string{"chipmunk"}},
+		"bell":       {Name: "bell", URL: "/sounds/bell.mp3", Title: "Shop bell"},
+		"bezos":      {Name: "bezos", URL: "/sounds/bezos.mp3", Weight: 2},
+	}
+	m, err := parseMacro("celebrate", "tada, wait 500ms, bell x2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.macros[m.Name] = m
+	return l
+}
+
+func TestResolveName(t *testing.T) {
+	tests := []struct {
+		input       string
+		want        string
+		ambiguous   bool
+		suggestions []string
+	}{
+		{input: "tada", want: "tada"},
+		{input: "TADA", want: "tada"},
+		{input: " bell ", want: "bell"},
+		{input: "karate", want: "danielsan"},
+		{input: "Karate", want: "danielsan"},
+		{input: "celebrate", want: "celebrate"},
+		{input: "celeb", want: "celebrate"},
+		{input: "dang", want: "dangerzone"},
+		{input: "chip", want: "drama"},
+		{input: "dnagerzone", want: "dangerzone"},
+		{input: "tadaa", want: "tada"},
+		{input: "dan", ambiguous: true, suggestions: []string{"dangerzone", "danielsan"}},
+		{input: "be", ambiguous: true, suggestions: []string{"bell", "bezos"}},
+		{input: "bxxl", suggestions: []string{"bell"}},
+		{input: "xylophone"},
+	}
+	l := testLibrary(t)
+	for _, tt := range tests {
+		got, err := l.resolveName(tt.input)
+		if tt.want != "" {
+			if err != nil || got != tt.want {
+				t.Errorf("resolveName(%q) = %q, %v; want %q", tt.input, got, err, tt.want)
+			}
+			continue
+		}
+		re, ok := err.(*ResolveError)
+		if !ok {
+			t.Errorf("resolveName(%q) = %q, %v; want a *ResolveError", tt.input, got, err)
+			continue
+		}
+		if re.Ambiguous != tt.ambiguous || !reflect.DeepEqual(re.Suggestions, tt.suggestions) {
+			t.Errorf("resolveName(%q) error = %+v; want ambiguous %v, suggestions %v", tt.input, re, tt.ambiguous, tt.suggestions)
+		}
+	}
+}
+
+func TestResolveErrorText(t *testing.T) {
+	err := &ResolveError{Name: "dan", Ambiguous: true, Suggestions: []string{"danielsan", "dangerzone"}}
+	want := `ambiguous sound "dan"; did you mean danielsan, dangerzone?`
+	if err.Error() != want {
+		t.Errorf("Error() = %q; want %q", err.Error(), want)
+	}
+}
+
+func TestResolveMacro(t *testing.T) {
+	l := testLibrary(t)
+	events, err := l.resolve("celebrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sounds []string
+	for _, e := range events {
+		if e.Sound != "" {
+			sounds = append(sounds, e.Sound)
+		}
+	}
+	if want := []string{"tada", "bell", "bell"}; !reflect.DeepEqual(sounds, want) {
+		t.Errorf("resolve(celebrate) plays %v; want %v", sounds, want)
+	}
+}
+
+func TestRandomSound(t *testing.T) {
+	l := testLibrary(t)
+	for i := 0; i < 50; i++ {
+		name, err := l.randomSound("MOVIES")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "danielsan" && name != "dangerzone" {
+			t.Fatalf("randomSound(MOVIES) = %q; want a sound tagged movies", name)
+		}
+	}
+	if _, err := l.randomSound("nope"); err == nil {
+		t.Error("randomSound(nope) succeeded; want an error")
+	}
+	events, err := l.resolve("random")
+	if err != nil || len(events) != 1 || l.sounds[events[0].Sound] == nil {
+		t.Errorf("resolve(random) = %v, %v; want one known sound", events, err)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"tada", "tada", 0},
+		{"tada", "tadaa", 1},
+		{"kitten", "sitting", 3},
+		{"dnagerzone", "dangerzone", 2},
+		{"héllo", "hello", 1},
+	}
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d; want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
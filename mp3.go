@@ -0,0 +1,357 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Most problems listed for one file; past this it is simply broken.
+const maxAudioProblems = 10
+
+// errNotMP3 means no MPEG audio frames were found.
+var errNotMP3 = errors.New("no MPEG audio frames found")
+
+// MPEG versions, as encoded in frame headers.
+const (
+	mpeg25 = 0
+	mpeg2  = 2
+	mpeg1  = 3
+)
+
+// Bitrates in kbit/s by [MPEG-1][layer][index], where MPEG-2 and 2.5 share
+// a table and layers run I, II, III.
+var mp3Bitrates = [2][3][16]int{
+	{ // MPEG-2 and 2.5
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	},
+	{ // MPEG-1
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	},
+}
+
+// Sample rates in Hz by version and index.
+var mp3SampleRates = map[int][3]int{
+	mpeg1:  {44100, 48000, 32000},
+	mpeg2:  {22050, 24000, 16000},
+	mpeg25: {11025, 12000, 8000},
+}
+
+var mp3ChannelModes = [4]string{"stereo", "joint stereo", "dual channel", "mono"}
+
+// frameHeader is a decoded MPEG audio frame header.
+type frameHeader struct {
+	version    int
+	layer      int // 1, 2 or 3
+	bitrate    int // kbit/s
+	sampleRate int
+	padding    int
+	mode       int
+	crc        bool
+}
+
+// parseFrameHeader decodes the four bytes at the start of a frame,
+// reporting false if they are not a valid header.
+func parseFrameHeader(b []byte) (frameHeader, bool) {
+	var h frameHeader
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return h, false
+	}
+	h.version = int(b[1]>>3) & 3
+	layerBits := int(b[1]>>1) & 3
+	bitrateIndex := int(b[2] >> 4)
+	rateIndex := int(b[2]>>2) & 3
+	if h.version == 1 || layerBits == 0 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		// Reserved values, or free-format bitrates, which are too rare to
+		// be worth the trouble of finding the frame length.
+		return h, false
+	}
+	h.layer = 4 - layerBits
+	v1 := 0
+	if h.version == mpeg1 {
+		v1 = 1
+	}
+	h.bitrate = mp3Bitrates[v1][h.layer-1][bitrateIndex]
+	h.sampleRate = mp3SampleRates[h.version][rateIndex]
+	h.padding = int(b[2]>>1) & 1
+	h.mode = int(b[3] >> 6)
+	h.crc = b[1]&1 == 0
+	return h, true
+}
+
+// samples returns the number of samples per channel in a frame.
+func (h frameHeader) samples() int {
+	switch {
+	case h.layer == 1:
+		return 384
+	case h.layer == 3 && h.version != mpeg1:
+		return 576
+	}
+	return 1152
+}
+
+// length returns the size of the frame in bytes, including its header.
+func (h frameHeader) length() int {
+	if h.layer == 1 {
+		return (12*h.bitrate*1000/h.sampleRate + h.padding) * 4
+	}
+	return h.samples()/8*h.bitrate*1000/h.sampleRate + h.padding
+}
+
+// sideInfoSize returns the size of the Layer III side information, after
+// which Xing headers are found.
+func (h frameHeader) sideInfoSize() int {
+	mono := h.mode == 3
+	switch {
+	case h.version == mpeg1 && mono:
+		return 17
+	case h.version == mpeg1:
+		return 32
+	case mono:
+		return 9
+	}
+	return 17
+}
+
+// sameStream reports whether two headers could belong to the same stream.
+func (h frameHeader) sameStream(o frameHeader) bool {
+	return h.version == o.version && h.layer == o.layer && h.sampleRate == o.sampleRate
+}
+
+func (h frameHeader) format() string {
+	version := map[int]string{mpeg1: "1", mpeg2: "2", mpeg25: "2.5"}[h.version]
+	return fmt.Sprintf("MPEG-%s Layer %s", version, [...]string{"I", "II", "III"}[h.layer-1])
+}
+
+// vbrHeader holds what a Xing, Info or VBRI header says about a stream.
+type vbrHeader struct {
+	frames int
+	bytes  int
+
+	// Encoder delay and padding in samples, from a LAME extension.
+	delay, padding int
+}
+
+// parseVBRHeader looks for a Xing, Info or VBRI header in the first frame.
+func parseVBRHeader(h frameHeader, frame []byte) (*vbrHeader, bool) {
+	if off := 4 + h.sideInfoSize(); len(frame) >= off+8 {
+		tag := string(frame[off : off+4])
+		if tag == "Xing" || tag == "Info" {
+			vbr := &vbrHeader{}
+			flags := binary.BigEndian.Uint32(frame[off+4:])
+			p := off + 8
+			if flags&1 != 0 && len(frame) >= p+4 {
+				vbr.frames = int(binary.BigEndian.Uint32(frame[p:]))
+				p += 4
+			}
+			if flags&2 != 0 && len(frame) >= p+4 {
+				vbr.bytes = int(binary.BigEndian.Uint32(frame[p:]))
+				p += 4
+			}
+			if flags&4 != 0 {
+				p += 100
+			}
+			if flags&8 != 0 {
+				p += 4
+			}
+			// The LAME extension stores the encoder delay and padding as
+			// two 12-bit numbers, 21 bytes in.
+			if len(frame) >= p+24 && bytes.HasPrefix(frame[p:], []byte("LAME")) {
+				d := frame[p+21:]
+				vbr.delay = int(d[0])<<4 | int(d[1])>>4
+				vbr.padding = int(d[1]&0x0f)<<8 | int(d[2])
+			}
+			return vbr, true
+		}
+	}
+	// VBRI headers sit at a fixed offset after the header.
+	if off := 4 + 32; len(frame) >= off+18 && string(frame[off:off+4]) == "VBRI" {
+		return &vbrHeader{
+			bytes:  int(binary.BigEndian.Uint32(frame[off+10:])),
+			frames: int(binary.BigEndian.Uint32(frame[off+14:])),
+			delay:  int(binary.BigEndian.Uint16(frame[off+6:])),
+		}, true
+	}
+	return nil, false
+}
+
+// id3v2Size returns the size of an ID3v2 tag at the start of b, or zero.
+func id3v2Size(b []byte) int {
+	if len(b) < 10 || string(b[:3]) != "ID3" || b[3] == 0xff || b[4] == 0xff {
+		return 0
+	}
+	size := 10 + syncsafe(b[6:10])
+	if b[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+	return size
+}
+
+// syncsafe decodes a 28-bit integer stored in the low 7 bits of 4 bytes.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// trailerSize returns the size of the ID3v1 and APEv2 tags at the end of b.
+func trailerSize(b []byte) int {
+	size := 0
+	if len(b) >= 128 && string(b[len(b)-128:len(b)-125]) == "TAG" {
+		size = 128
+	}
+	if end := len(b) - size; end >= 32 && string(b[end-32:end-24]) == "APETAGEX" {
+		n := int(binary.LittleEndian.Uint32(b[end-20:]))
+		if flags := binary.LittleEndian.Uint32(b[end-12:]); flags&(1<<31) != 0 {
+			n += 32 // header
+		}
+		if n <= end {
+			size += n
+		}
+	}
+	return size
+}
+
+// syncAt reports whether a frame starts at offset i, checking that the
+// next one follows where expected so that stray sync bytes are not taken
+// for frames.
+func syncAt(b []byte, i int, first *frameHeader) (frameHeader, bool) {
+	h, ok := parseFrameHeader(b[i:])
+	if !ok || (first != nil && !h.sameStream(*first)) {
+		return h, false
+	}
+	next := i + h.length()
+	if next+4 > len(b) {
+		// The last frame, or a truncated one, which the caller reports.
+		return h, true
+	}
+	n, ok := parseFrameHeader(b[next:])
+	return h, ok && n.sameStream(h)
+}
+
+// inspectMP3 walks the frames of an MP3 file to find its duration, bitrate
+// and format, noting damage such as truncation or garbage between frames.
+func inspectMP3(b []byte) (*jukebox.AudioInfo, error) {
+	info := &jukebox.AudioInfo{}
+	problem := func(format string, args ...interface{}) {
+		if len(info.Problems) < maxAudioProblems {
+			info.Problems = append(info.Problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	start := 0
+	for {
+		n := id3v2Size(b[start:])
+		if n == 0 {
+			break
+		}
+		if start+n > len(b) {
+			return nil, fmt.Errorf("ID3v2 tag runs past the end of the file")
+		}
+		start += n
+	}
+	end := len(b) - trailerSize(b[start:])
+
+	audio := b[start:end]
+	var first *frameHeader
+	var vbr *vbrHeader
+	var frames, samples, audioBytes int
+	var junk []byte
+	bitrates := make(map[int]bool)
+	for i := 0; i+4 <= len(audio); {
+		var h frameHeader
+		var ok bool
+		if first == nil {
+			h, ok = syncAt(audio, i, nil)
+		} else {
+			// Once in sync, a header like the first is enough.
+			h, ok = parseFrameHeader(audio[i:])
+			ok = ok && h.sameStream(*first)
+		}
+		if !ok {
+			// Lost sync: skip ahead to the next frame.
+			j := i + 1
+			for ; j+4 <= len(audio); j++ {
+				if _, ok := syncAt(audio, j, first); ok {
+					break
+				}
+			}
+			switch {
+			case first == nil:
+				junk = audio[i:j]
+			case j+4 <= len(audio):
+				problem("%d bytes of garbage at offset %d", j-i, start+i)
+			case j-i > 128:
+				problem("%d bytes of garbage after the last frame", len(audio)-i)
+			}
+			i = j
+			continue
+		}
+
+		n := h.length()
+		if i+n > len(audio) {
+			problem("last frame is truncated by %d bytes", i+n-len(audio))
+			break
+		}
+		if first == nil {
+			first = &h
+			if h.layer == 3 {
+				if v, ok := parseVBRHeader(h, audio[i:i+n]); ok {
+					// The header occupies a frame of silence that is not
+					// part of the audio.
+					vbr = v
+					i += n
+					continue
+				}
+			}
+		}
+		frames++
+		samples += h.samples()
+		audioBytes += n
+		bitrates[h.bitrate] = true
+		i += n
+	}
+	if first == nil || frames == 0 {
+		return nil, errNotMP3
+	}
+	if len(bytes.Trim(junk, "\x00")) > 0 {
+		// Padding with zeros is harmless, but anything else is not.
+		problem("%d bytes of garbage before the first frame", len(junk))
+	}
+	if vbr != nil && vbr.frames > 0 && vbr.frames != frames && vbr.frames != frames+1 {
+		// Some encoders count the header frame and some do not.
+		problem("header says %d frames but found %d", vbr.frames, frames)
+	}
+
+	if vbr != nil && vbr.delay+vbr.padding < samples {
+		samples -= vbr.delay + vbr.padding
+	}
+	seconds := float64(samples) / float64(first.sampleRate)
+	info.Format = first.format()
+	info.Duration = int64(seconds*1000 + 0.5)
+	info.Bitrate = int(float64(audioBytes)*8/seconds/1000 + 0.5)
+	info.VBR = len(bitrates) > 1
+	info.SampleRate = first.sampleRate
+	info.Channels = mp3ChannelModes[first.mode]
+	info.Frames = frames
+	return info, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// readSound returns one of the sounds served from static/sounds.
+func readSound(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile(filepath.Join("static", "sounds", name+".mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// splice returns b with extra inserted at offset i.
+func splice(b []byte, i int, extra []byte) []byte {
+	out := append([]byte(nil), b[:i]...)
+	out = append(out, extra...)
+	return append(out, b[i:]...)
+}
+
+func TestInspectMP3(t *testing.T) {
+	tests := []struct {
+		name string
+		want jukebox.AudioInfo
+	}{
+		// VBR with a Xing header, whose frame is not counted.
+		{name: "tada", want: jukebox.AudioInfo{Format: "MPEG-1 Layer III", Duration: 2259, Bitrate: 186, VBR: true, SampleRate: 44100, Channels: "joint stereo", Frames: 88}},
+		// CBR with an Info header giving the encoder delay and padding.
+		{name: "bell", want: jukebox.AudioInfo{Format: "MPEG-1 Layer III", Duration: 1704, Bitrate: 164, SampleRate: 44100, Channels: "mono", Frames: 67}},
+		// MPEG-2 with no header frame at all.
+		{name: "rimshot", want: jukebox.AudioInfo{Format: "MPEG-2 Layer III", Duration: 1881, Bitrate: 128, SampleRate: 22050, Channels: "mono", Frames: 72}},
+		{name: "horror", want: jukebox.AudioInfo{Format: "MPEG-2 Layer III", Duration: 7525, Bitrate: 52, VBR: true, SampleRate: 22050, Channels: "stereo", Frames: 296}},
+		{name: "drama", want: jukebox.AudioInfo{Format: "MPEG-1 Layer III", Duration: 1392, Bitrate: 128, SampleRate: 48000, Channels: "stereo", Frames: 58}},
+	}
+	for _, tt := range tests {
+		info, err := inspectMP3(readSound(t, tt.name))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*info, tt.want) {
+			t.Errorf("%s: got %+v\nwant %+v", tt.name, *info, tt.want)
+		}
+	}
+}
+
+func TestInspectMP3Sounds(t *testing.T) {
+	// Every sound that ships with the jukebox is intact.
+	files, err := filepath.Glob(filepath.Join("static", "sounds", "*.mp3"))
+	if err != nil || len(files) == 0 {
+		t.Fatal("no sounds found", err)
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := inspectMP3(b)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if len(info.Problems) > 0 || info.Duration <= 0 || info.Bitrate <= 0 {
+			t.Errorf("%s: got %+v", file, *info)
+		}
+	}
+}
+
+func TestInspectMP3Damaged(t *testing.T) {
+	tada := readSound(t, "tada")
+	bell := readSound(t, "bell")
+	// Rimshot already ends with 7 stray bytes, too few to complain about.
+	rimshot := readSound(t, "rimshot")
+	garbage := bytes.Repeat([]byte("garbage!"), 375)
+	trailer := append([]byte("TAG"), make([]byte, 125)...)
+
+	tests := []struct {
+		name     string
+		b        []byte
+		problems []string
+	}{
+		{name: "truncated", b: tada[:30000], problems: []string{"last frame is truncated by ", "header says 88 frames but found 49"}},
+		{name: "garbage between frames", b: splice(tada, 20000, garbage), problems: []string{"bytes of garbage at offset "}},
+		{name: "garbage after the last frame", b: append(append([]byte(nil), rimshot...), garbage...), problems: []string{"3007 bytes of garbage after the last frame"}},
+		{name: "a few stray bytes at the end", b: append(append([]byte(nil), rimshot...), "oops"...)},
+		{name: "garbage before the first frame", b: splice(tada, 0, garbage), problems: []string{"3000 bytes of garbage before the first frame"}},
+		{name: "garbage after the ID3v2 tag", b: splice(bell, id3v2Size(bell), garbage), problems: []string{"3000 bytes of garbage before the first frame"}},
+		{name: "zeros after the ID3v2 tag", b: splice(bell, id3v2Size(bell), make([]byte, 3000))},
+		{name: "ID3v1 trailer", b: append(append([]byte(nil), rimshot...), trailer...)},
+	}
+	for _, tt := range tests {
+		info, err := inspectMP3(tt.b)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(info.Problems) != len(tt.problems) {
+			t.Errorf("%s: problems %q, want %q", tt.name, info.Problems, tt.problems)
+			continue
+		}
+		for i, p := range tt.problems {
+			if !strings.Contains(info.Problems[i], p) {
+				t.Errorf("%s: problem %q, want %q", tt.name, info.Problems[i], p)
+			}
+		}
+	}
+}
+
+func TestInspectMP3NotAudio(t *testing.T) {
+	bell := readSound(t, "bell")
+	noise := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(noise)
+	tests := map[string][]byte{
+		"empty":         nil,
+		"text":          []byte("this is not an mp3 file"),
+		"noise":         noise,
+		"tag only":      readSound(t, "tada")[:id3v2Size(readSound(t, "tada"))],
+		"one sync word": {0xff, 0xfb, 0x90, 0x64},
+		"json":          []byte(`{"tada": {"url": "/static/sounds/tada.mp3"}}`),
+	}
+	for name, b := range tests {
+		if _, err := inspectMP3(b); err != errNotMP3 {
+			t.Errorf("%s: got %v, want errNotMP3", name, err)
+		}
+	}
+
+	// A tag claiming to be longer than the file is an error of its own.
+	if _, err := inspectMP3(bell[:id3v2Size(bell)-1]); err == nil || err == errNotMP3 {
+		t.Errorf("cut-off ID3v2 tag: got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Longest time a poll waits for an event before returning empty.
+	pollWait = 25 * time.Second
+
+	// Time after its last poll that a session is dropped.
+	pollExpiry = 2 * pollWait
+)
+
+// pollSession is a hub client whose messages are collected by repeated
+// long-poll requests rather than pushed over a connection.
+type pollSession struct {
+	id     string
+	client *Client
+
+	mu sync.Mutex
+
+	// Whether a poll is in progress; only one at a time may drain send.
+	busy bool
+
+	// Time the last poll finished.
+	idle time.Time
+}
+
+// acquire marks a poll as in progress, reporting false if one already is.
+func (s *pollSession) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy {
+		return false
+	}
+	s.busy = true
+	return true
+}
+
+// release marks the poll in progress as finished.
+func (s *pollSession) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy = false
+	s.idle = time.Now()
+}
+
+// expired reports whether the session has gone unpolled for too long.
+func (s *pollSession) expired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.busy && time.Since(s.idle) > pollExpiry
+}
+
+// Polls keeps the long-poll sessions.
+type Polls struct {
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+}
+
+func newPolls() *Polls {
+	return &Polls{sessions: make(map[string]*pollSession)}
+}
+
+// run drops sessions that have not polled recently.
+func (p *Polls) run() {
+	ticker := time.NewTicker(pollWait)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expired []*pollSession
+		p.mu.Lock()
+		for id, s := range p.sessions {
+			if s.expired() {
+				delete(p.sessions, id)
+				expired = append(expired, s)
+			}
+		}
+		p.mu.Unlock()
+
+		// Hubs are told without holding the lock, so that a busy hub
+		// cannot hold up sessions in other rooms.
+		for _, s := range expired {
+			s.client.hub.unregister <- s.client
+		}
+	}
+}
+
+// start begins a new session for a client.
+func (p *Polls) start(client *Client) *pollSession {
+	s := &pollSession{id: newID(), client: client, idle: time.Now()}
+	client.hub.register <- client
+	p.mu.Lock()
+	p.sessions[s.id] = s
+	p.mu.Unlock()
+	return s
+}
+
+// attach gives a client that is registered and streamed to some other way a
+// session of its own, so that messages it sends over HTTP can be told apart
+// from others'. The session never expires; it lasts until detach.
+func (p *Polls) attach(client *Client) *pollSession {
+	s := &pollSession{id: newID(), client: client, busy: true}
+	p.mu.Lock()
+	p.sessions[s.id] = s
+	p.mu.Unlock()
+	return s
+}
+
+// detach drops a session made by attach, leaving its client registered.
+func (p *Polls) detach(s *pollSession) {
+	p.mu.Lock()
+	delete(p.sessions, s.id)
+	p.mu.Unlock()
+}
+
+// session finds a session on a hub.
+func (p *Polls) session(hub *Hub, id string) (*pollSession, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.sessions[id]
+	if !ok || s.client.hub != hub {
+		return nil, false
+	}
+	return s, true
+}
+
+// remove drops a session.
+func (p *Polls) remove(s *pollSession) {
+	p.mu.Lock()
+	_, ok := p.sessions[s.id]
+	delete(p.sessions, s.id)
+	p.mu.Unlock()
+	if ok {
+		s.client.hub.unregister <- s.client
+	}
+}
+
+// pollResponse is the body returned by a long poll.
+type pollResponse struct {
+	// Session to pass to the next poll.
+	Session string `json:"session"`
+
+	// Events received since the previous poll, oldest first.
+	Events []json.RawMessage `json:"events"`
+}
+
+// servePoll returns the events broadcast since the session's last poll,
+// waiting up to pollWait for one to arrive.
+//
+// The first poll omits the session parameter and returns a new session at
+// once. A session that has expired, or was dropped by the hub for falling
+// behind, gets 410 Gone and must start over, passing the last sequence
+// number it saw as "since" to have missed events replayed.
+func servePoll(polls *Polls, hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("session")
+	if id == "" {
+		client, err := newClientFromRequest(hub, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s := polls.start(client)
+		writeJSON(w, &pollResponse{Session: s.id, Events: []json.RawMessage{}})
+		return
+	}
+	s, ok := polls.session(hub, id)
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusGone)
+		return
+	}
+	if !s.acquire() {
+		http.Error(w, "Session is already polling", http.StatusConflict)
+		return
+	}
+	defer s.release()
+
+	resp := &pollResponse{Session: s.id, Events: []json.RawMessage{}}
+	timer := time.NewTimer(pollWait)
+	defer timer.Stop()
+	for {
+		select {
+		case message, ok := <-s.client.send:
+			if !ok {
+				// The hub closed the channel.
+				polls.remove(s)
+				http.Error(w, "Session dropped", http.StatusGone)
+				return
+			}
+			for _, line := range bytes.Split(message, newline) {
+				resp.Events = append(resp.Events, json.RawMessage(line))
+			}
+			// Collect anything else already waiting, then reply.
+			for n := len(s.client.send); n > 0; n-- {
+				message, ok := <-s.client.send
+				if !ok {
+					break
+				}
+				for _, line := range bytes.Split(message, newline) {
+					resp.Events = append(resp.Events, json.RawMessage(line))
+				}
+			}
+			writeJSON(w, resp)
+			return
+		case <-timer.C:
+			writeJSON(w, resp)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
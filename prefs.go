@@ -0,0 +1,201 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Time to wait after a change before saving preferences, so that a burst of
+// changes is written once, off the hub goroutine.
+const prefSaveDelay = time.Second
+
+// preferences is a request to change the preferences of one client without
+// a handle, or of every client carrying a handle.
+type preferences struct {
+	client *Client
+	handle string
+	prefs  *jukebox.Preferences
+}
+
+// PrefStore keeps each handle's preferences, shared by all rooms.
+type PrefStore struct {
+	// File the preferences are saved to, or "" to keep them in memory.
+	path string
+
+	mu       sync.Mutex
+	byHandle map[string]*jukebox.Preferences
+
+	// Whether a save is scheduled.
+	saving bool
+
+	// Held while writing the file, so that saves land in order.
+	saveMu sync.Mutex
+}
+
+// newPrefStore loads any preferences saved at path.
+func newPrefStore(path string) (*PrefStore, error) {
+	s := &PrefStore{path: path, byHandle: make(map[string]*jukebox.Preferences)}
+	if err := loadState(path, &s.byHandle); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// get returns a handle's preferences, or nil if it has none.
+func (s *PrefStore) get(handle string) *jukebox.Preferences {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byHandle[handle]
+}
+
+// set replaces a handle's preferences and schedules a save.
+func (s *PrefStore) set(handle string, prefs *jukebox.Preferences) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(prefs.Mute) == 0 && len(prefs.Tags) == 0 && prefs.Theme == "" {
+		delete(s.byHandle, handle)
+	} else {
+		s.byHandle[handle] = prefs
+	}
+	if s.path != "" && !s.saving {
+		s.saving = true
+		time.AfterFunc(prefSaveDelay, s.save)
+	}
+}
+
+// save writes out the preferences as they are now.
+func (s *PrefStore) save() {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	byHandle := make(map[string]*jukebox.Preferences, len(s.byHandle))
+	for handle, prefs := range s.byHandle {
+		byHandle[handle] = prefs
+	}
+	s.saving = false
+	s.mu.Unlock()
+	if err := saveState(s.path, byHandle); err != nil {
+		log.Println("Could not save preferences:", err)
+	}
+}
+
+// normalizePreferences checks a client's preferences against the library,
+// replacing sound names and aliases with the sounds they name.
+func (l *Library) normalizePreferences(prefs *jukebox.Preferences) (*jukebox.Preferences, error) {
+	out := &jukebox.Preferences{}
+	if prefs == nil {
+		return out, nil
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	for _, name := range prefs.Mute {
+		s, ok := l.sound(name)
+		if !ok {
+			return nil, fmt.Errorf("cannot mute unknown sound %q", name)
+		}
+		out.Mute = append(out.Mute, s.Name)
+	}
+	for _, tag := range prefs.Tags {
+		if tag == "" {
+			return nil, fmt.Errorf("empty tag")
+		}
+		out.Tags = append(out.Tags, tag)
+	}
+	out.Mute = unique(out.Mute)
+	out.Tags = unique(out.Tags)
+	if prefs.Theme != "" {
+		if _, err := l.resolve(prefs.Theme); err != nil {
+			return nil, err
+		}
+		out.Theme = prefs.Theme
+		if s, ok := l.sound(prefs.Theme); ok {
+			out.Theme = s.Name
+		}
+	}
+	return out, nil
+}
+
+// setPreferences saves a handle's preferences and applies them to the
+// handle's clients in every room.
+func (rs *Rooms) setPreferences(handle string, prefs *jukebox.Preferences) {
+	rs.prefs.set(handle, prefs)
+	for _, h := range rs.all() {
+		h.preferences <- preferences{handle: handle, prefs: prefs}
+	}
+}
+
+// setPreferences applies new preferences to a client, or to every client in
+// the room carrying a handle, and tells them about it.
+func (h *Hub) setPreferences(p preferences) {
+	var targets []*Client
+	if p.handle == "" {
+		if _, ok := h.clients[p.client]; ok {
+			targets = append(targets, p.client)
+		}
+	} else {
+		for client := range h.clients {
+			if client.handle == p.handle {
+				targets = append(targets, client)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	message := encodeEvent(&jukebox.Event{
+		Type:  jukebox.EventPrefs,
+		Room:  h.room,
+		Time:  time.Now(),
+		Prefs: p.prefs,
+	})
+	for _, client := range targets {
+		client.prefs = p.prefs
+		h.deliver(client, message)
+	}
+}
+
+// wants reports whether a client's preferences let it hear a play. Alarms
+// are always heard.
+func (c *Client) wants(e *jukebox.Event) bool {
+	prefs := c.prefs
+	if prefs == nil || e.Alarm != nil {
+		return true
+	}
+	for _, name := range prefs.Mute {
+		if name == e.Sound {
+			return false
+		}
+	}
+	if len(prefs.Tags) == 0 {
+		return true
+	}
+	s, ok := c.hub.library.sound(e.Sound)
+	if !ok {
+		return false
+	}
+	for _, tag := range prefs.Tags {
+		if s.HasTag(tag) {
+			return true
+		}
+	}
+	return false
+}
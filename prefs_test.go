@@ -0,0 +1,126 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+func TestPreferences(t *testing.T) {
+	rooms := testRooms(t)
+	h, err := rooms.get(defaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := rooms.get("ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := connect(t, h, "handle=alice")
+	clients := []*Client{alice, connect(t, ops, "handle=alice"), connect(t, h, "handle=bob"), connect(t, h, "")}
+	anon := clients[3]
+	for _, c := range clients {
+		received(t, c)
+	}
+	all := "play:tada play:danielsan play:dangerzone play:bell"
+
+	tests := []struct {
+		from    *Client
+		message string
+		err     string
+
+		// What alice hears in each room, then bob, then the client without
+		// a handle.
+		want []string
+	}{
+		{
+			from:    alice,
+			message: `{"type":"prefs","prefs":{"mute":["karate","karate"]}}`,
+			want: []string{
+				"prefs: play:tada play:dangerzone play:bell",
+				"prefs: play:tada play:dangerzone play:bell",
+				all,
+				all,
+			},
+		},
+		{
+			from:    alice,
+			message: `{"type":"prefs","prefs":{"tags":["movies"]}}`,
+			want:    []string{"prefs: play:danielsan play:dangerzone", "prefs: play:danielsan play:dangerzone", all, all},
+		},
+		{
+			from:    alice,
+			message: `{"type":"prefs","prefs":{"mute":["dangerzone"],"tags":["movies"]}}`,
+			want:    []string{"prefs: play:danielsan", "prefs: play:danielsan", all, all},
+		},
+		{
+			from:    alice,
+			message: `{"type":"prefs","prefs":{"mute":["xylophone"]}}`,
+			err:     `cannot mute unknown sound "xylophone"`,
+			want:    []string{"play:danielsan", "play:danielsan", all, all},
+		},
+		{
+			from:    alice,
+			message: `{"type":"prefs","prefs":{"tags":[""]}}`,
+			err:     "empty tag",
+			want:    []string{"play:danielsan", "play:danielsan", all, all},
+		},
+		{
+			from:    anon,
+			message: `{"type":"prefs","prefs":{"mute":["tada"]}}`,
+			want:    []string{"play:danielsan", "play:danielsan", all, "prefs: play:danielsan play:dangerzone play:bell"},
+		},
+		{
+			from:    alice,
+			message: `{"type":"prefs"}`,
+			want:    []string{"prefs: " + all, "prefs: " + all, all, "play:danielsan play:dangerzone play:bell"},
+		},
+	}
+	for _, tt := range tests {
+		err := h.handle(tt.from, []byte(tt.message))
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.message, err, tt.err)
+		}
+		for _, h := range []*Hub{h, ops} {
+			for _, sound := range []string{"tada", "danielsan", "dangerzone", "bell"} {
+				if err := h.play(sound, jukebox.PlayOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for i, c := range clients {
+			got := strings.Join(summarize(received(t, c)), " ")
+			if got != tt.want[i] {
+				t.Errorf("%s: client %d got %q, want %q", tt.message, i, got, tt.want[i])
+			}
+		}
+	}
+	if got := rooms.prefs.get("alice"); got != nil {
+		t.Errorf("cleared preferences are still saved: %+v", got)
+	}
+
+	// A new connection picks up the saved preferences.
+	if err := h.handle(alice, []byte(`{"type":"prefs","prefs":{"tags":["Music"]}}`)); err != nil {
+		t.Fatal(err)
+	}
+	later := connect(t, ops, "handle=alice")
+	if got := summarize(received(t, later)); !reflect.DeepEqual(got, []string{"prefs:"}) || !reflect.DeepEqual(later.prefs.Tags, []string{"Music"}) {
+		t.Errorf("new connection got %q with %+v", got, later.prefs)
+	}
+}
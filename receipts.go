@@ -0,0 +1,185 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// How often a hub broadcasts updated receipt summaries.
+const receiptPeriod = time.Second
+
+// ack is a client's report on whether it played an event.
+type ack struct {
+	// Client that sent the ack, or nil if it cannot be told apart from
+	// others, in which case the ack is ignored.
+	client *Client
+
+	// Sequence number of the play event.
+	seq uint64
+
+	// One of the jukebox.Ack* statuses.
+	status string
+}
+
+// receipt collects the acks for one play event.
+type receipt struct {
+	sound   string
+	summary jukebox.Receipt
+
+	// Clients the event was sent to that have not acked it yet, so that
+	// each recipient is counted once and no one else is counted at all.
+	pending map[*Client]bool
+
+	// Whether the summary has changed since it was last broadcast.
+	dirty bool
+}
+
+// track starts collecting acks for a play event sent to some recipients,
+// and stops collecting them for events that have left the history.
+func (h *Hub) track(e *jukebox.Event, recipients []*Client) {
+	r := &receipt{
+		sound:   e.Sound,
+		summary: jukebox.Receipt{Recipients: len(recipients)},
+		pending: make(map[*Client]bool, len(recipients)),
+	}
+	for _, client := range recipients {
+		r.pending[client] = true
+	}
+	h.receipts[e.Seq] = r
+	if e.Seq > historySize {
+		for seq := range h.receipts {
+			if seq <= e.Seq-historySize {
+				delete(h.receipts, seq)
+			}
+		}
+	}
+}
+
+// acknowledge records an ack against its event's receipt.
+func (h *Hub) acknowledge(a ack) {
+	switch a.status {
+	case jukebox.AckPlayed, jukebox.AckFailed, jukebox.AckBlocked:
+	default:
+		return
+	}
+	r, ok := h.receipts[a.seq]
+	if !ok || a.client == nil || !r.pending[a.client] {
+		return
+	}
+	delete(r.pending, a.client)
+	switch a.status {
+	case jukebox.AckPlayed:
+		r.summary.Played++
+	case jukebox.AckFailed:
+		r.summary.Failed++
+	case jukebox.AckBlocked:
+		r.summary.Blocked++
+	}
+	r.dirty = true
+	h.stats.record(r.sound, a.status)
+}
+
+// flushReceipts broadcasts the summaries that have changed.
+//
+// Summaries are not part of the numbered event stream, since they are only
+// of interest while the play is recent.
+func (h *Hub) flushReceipts() {
+	for seq, r := range h.receipts {
+		if !r.dirty {
+			continue
+		}
+		r.dirty = false
+		summary := r.summary
+		message := encodeEvent(&jukebox.Event{
+			Type:    jukebox.EventReceipt,
+			Room:    h.room,
+			Time:    time.Now(),
+			Ref:     seq,
+			Sound:   r.sound,
+			Text:    fmt.Sprintf("heard by %d of %d", summary.Played, summary.Recipients),
+			Receipt: &summary,
+		})
+		for client := range h.clients {
+			h.deliver(client, message)
+		}
+	}
+}
+
+// SoundStat counts the acks received for one sound.
+type SoundStat struct {
+	Sound   string `json:"sound"`
+	Played  int    `json:"played"`
+	Failed  int    `json:"failed"`
+	Blocked int    `json:"blocked"`
+
+	// FailureRate is the share of acks reporting failure. Autoplay blocks
+	// are left out, since they say nothing about the sound itself.
+	FailureRate float64 `json:"failureRate"`
+}
+
+// SoundStats counts acks per sound across all rooms, to find broken URLs.
+type SoundStats struct {
+	mu     sync.Mutex
+	sounds map[string]*SoundStat
+}
+
+func newSoundStats() *SoundStats {
+	return &SoundStats{sounds: make(map[string]*SoundStat)}
+}
+
+// record counts one ack for a sound.
+func (s *SoundStats) record(sound string, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.sounds[sound]
+	if !ok {
+		st = &SoundStat{Sound: sound}
+		s.sounds[sound] = st
+	}
+	switch status {
+	case jukebox.AckPlayed:
+		st.Played++
+	case jukebox.AckFailed:
+		st.Failed++
+	case jukebox.AckBlocked:
+		st.Blocked++
+	}
+	if n := st.Played + st.Failed; n > 0 {
+		st.FailureRate = float64(st.Failed) / float64(n)
+	}
+}
+
+// all returns the stats for every sound, worst failure rate first.
+func (s *SoundStats) all() []SoundStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]SoundStat, 0, len(s.sounds))
+	for _, st := range s.sounds {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].FailureRate != stats[j].FailureRate {
+			return stats[i].FailureRate > stats[j].FailureRate
+		}
+		return stats[i].Sound < stats[j].Sound
+	})
+	return stats
+}
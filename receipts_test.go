@@ -0,0 +1,124 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+func TestReceipts(t *testing.T) {
+	rooms := testRooms(t)
+	h, err := rooms.get(defaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := map[string]*Client{
+		"a":          connect(t, h, "handle=a"),
+		"b":          connect(t, h, "handle=b&zone=desk"),
+		"controller": connect(t, h, "role=controller"),
+		"http":       nil,
+	}
+
+	type ack struct {
+		from   string
+		status string
+	}
+	tests := []struct {
+		sound string
+		zones []string
+		acks  []ack
+
+		// Expected summary, or nil if none should be broadcast.
+		want *jukebox.Receipt
+	}{
+		{
+			sound: "tada",
+			acks:  []ack{{"a", jukebox.AckPlayed}, {"b", jukebox.AckPlayed}},
+			want:  &jukebox.Receipt{Recipients: 2, Played: 2},
+		},
+		{
+			sound: "bell",
+			acks:  []ack{{"a", jukebox.AckFailed}, {"b", jukebox.AckBlocked}},
+			want:  &jukebox.Receipt{Recipients: 2, Failed: 1, Blocked: 1},
+		},
+		{
+			sound: "drama",
+			acks:  []ack{{"a", jukebox.AckPlayed}, {"a", jukebox.AckPlayed}, {"a", jukebox.AckFailed}},
+			want:  &jukebox.Receipt{Recipients: 2, Played: 1},
+		},
+		{
+			sound: "dangerzone",
+			acks:  []ack{{"controller", jukebox.AckPlayed}, {"http", jukebox.AckPlayed}, {"a", "loud"}},
+		},
+		{
+			sound: "danielsan",
+			zones: []string{"desk"},
+			acks:  []ack{{"a", jukebox.AckPlayed}, {"b", jukebox.AckPlayed}},
+			want:  &jukebox.Receipt{Recipients: 1, Played: 1},
+		},
+	}
+	for _, tt := range tests {
+		if err := h.play(tt.sound, jukebox.PlayOptions{Zones: tt.zones}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settle(h)
+	plays := h.since(0)
+	if len(plays) != len(tests) {
+		t.Fatalf("got %d plays, want %d", len(plays), len(tests))
+	}
+	for i, tt := range tests {
+		for _, a := range tt.acks {
+			message := fmt.Sprintf(`{"type":"ack","ref":%d,"status":%q}`, plays[i].Seq, a.status)
+			if err := h.handle(clients[a.from], []byte(message)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Summaries are broadcast every receiptPeriod.
+	receipts := make(map[uint64]*jukebox.Receipt)
+	deadline := time.Now().Add(3 * receiptPeriod)
+	for len(receipts) < 4 && time.Now().Before(deadline) {
+		for _, e := range received(t, clients["a"]) {
+			if e.Type == jukebox.EventReceipt {
+				receipts[e.Ref] = e.Receipt
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, tt := range tests {
+		got := receipts[plays[i].Seq]
+		switch {
+		case got == nil && tt.want == nil:
+		case got == nil || tt.want == nil || *got != *tt.want:
+			t.Errorf("%s: receipt %+v, want %+v", tt.sound, got, tt.want)
+		}
+	}
+
+	want := []SoundStat{
+		{Sound: "bell", Failed: 1, Blocked: 1, FailureRate: 1},
+		{Sound: "danielsan", Played: 1},
+		{Sound: "drama", Played: 1},
+		{Sound: "tada", Played: 2},
+	}
+	if got := h.stats.all(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Room used when a request does not name one.
+const defaultRoom = "main"
+
+// How long a participant's theme waits to play again, unless a room says.
+const defaultThemeCooldown = 10 * time.Minute
+
+// Most rooms that can be open at once, besides those named in the config.
+const maxRooms = 1000
+
+// errTooManyRooms means a connection would open one room too many.
+var errTooManyRooms = errors.New("too many rooms are open")
+
+var validRoom = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Zone labels follow the same rules as room names.
+var validLabel = validRoom
+
+// RoomSettings control how a room behaves.
+type RoomSettings struct {
+	// RequireSpeaker rejects plays while no speaker is connected.
+	RequireSpeaker bool `json:"requireSpeaker"`
+
+	// DisableWhispers rejects plays aimed at a single participant.
+	DisableWhispers bool `json:"disableWhispers"`
+
+	// DisableThemes turns off walk-on theme sounds.
+	DisableThemes bool `json:"disableThemes"`
+
+	// ThemeCooldown is how long after a participant's theme plays before it
+	// may play again in the room. Zero means defaultThemeCooldown.
+	ThemeCooldown duration `json:"themeCooldown,omitempty"`
+}
+
+// Rooms keeps one hub per room, so that each room hears only its own plays.
+type Rooms struct {
+	library  *Library
+	stats    *SoundStats
+	prefs    *PrefStore
+	triggers *Triggers
+	alarms   *Alarms
+
+	// Initial settings for rooms named in the config.
+	settings map[string]RoomSettings
+
+	mu   sync.Mutex
+	hubs map[string]*Hub
+}
+
+func newRooms(library *Library, settings map[string]RoomSettings, prefs *PrefStore, triggers *Triggers) *Rooms {
+	return &Rooms{
+		library:  library,
+		stats:    newSoundStats(),
+		prefs:    prefs,
+		triggers: triggers,
+		alarms:   newAlarms(),
+		settings: settings,
+		hubs:     make(map[string]*Hub),
+	}
+}
+
+// get returns the hub for a room, starting it if needed. Only rooms named in
+// the config and the default room may be started past maxRooms.
+func (rs *Rooms) get(name string) (*Hub, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	h, ok := rs.hubs[name]
+	if !ok {
+		if !rs.configured(name) && len(rs.hubs) >= maxRooms {
+			return nil, errTooManyRooms
+		}
+		h = newHub(rs, name)
+		rs.hubs[name] = h
+		go h.run()
+	}
+	return h, nil
+}
+
+// find returns the hub for a room that is in use or named in the config,
+// without starting rooms for arbitrary names.
+func (rs *Rooms) find(name string) (*Hub, bool) {
+	rs.mu.Lock()
+	h, ok := rs.hubs[name]
+	rs.mu.Unlock()
+	if ok {
+		return h, true
+	}
+	if !rs.configured(name) {
+		return nil, false
+	}
+	h, err := rs.get(name)
+	return h, err == nil
+}
+
+// configured reports whether a room is the default or named in the config.
+func (rs *Rooms) configured(name string) bool {
+	_, ok := rs.settings[name]
+	return ok || name == defaultRoom
+}
+
+// notify plays a sound in a room, which defaults to the main room, along with
+// text saying why.
+func (rs *Rooms) notify(room string, sound string, opts jukebox.PlayOptions, text string) error {
+	if room == "" {
+		room = defaultRoom
+	}
+	h, err := rs.get(room)
+	if err != nil {
+		return err
+	}
+	return h.notify(sound, opts, text)
+}
+
+// all returns the hubs of every room in use, sorted by name.
+func (rs *Rooms) all() []*Hub {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	hubs := make([]*Hub, 0, len(rs.hubs))
+	for _, h := range rs.hubs {
+		hubs = append(hubs, h)
+	}
+	sort.Slice(hubs, func(i, j int) bool { return hubs[i].room < hubs[j].room })
+	return hubs
+}
+
+// forRequest returns the hub for the room named by the "room" query
+// parameter, or writes an error if the name is invalid or the room is not in
+// use. Only connections open new rooms.
+func (rs *Rooms) forRequest(w http.ResponseWriter, r *http.Request) (*Hub, bool) {
+	name, err := roomName(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	h, ok := rs.find(name)
+	if !ok {
+		http.Error(w, "Unknown room", http.StatusNotFound)
+		return nil, false
+	}
+	return h, true
+}
+
+// forConnection returns the hub for the room named by the "room" query
+// parameter, opening the room if needed, or writes an error.
+func (rs *Rooms) forConnection(w http.ResponseWriter, r *http.Request) (*Hub, bool) {
+	name, err := roomName(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	h, err := rs.get(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return h, true
+}
+
+// roomName returns the room named by a request.
+func roomName(r *http.Request) (string, error) {
+	name := r.URL.Query().Get("room")
+	if name == "" {
+		return defaultRoom, nil
+	}
+	if !validRoom.MatchString(name) {
+		return "", fmt.Errorf("invalid room %q", name)
+	}
+	return name, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoomName(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		ok    bool
+	}{
+		{query: "", want: defaultRoom, ok: true},
+		{query: "room=kitchen", want: "kitchen", ok: true},
+		{query: "room=Ops_2-b", want: "Ops_2-b", ok: true},
+		{query: "room=" + strings.Repeat("a", 64), want: strings.Repeat("a", 64), ok: true},
+		{query: "room=" + strings.Repeat("a", 65)},
+		{query: "room=two+words"},
+		{query: "room=..%2Fetc"},
+		{query: "room=caf%C3%A9"},
+	}
+	for _, tt := range tests {
+		got, err := roomName(httptest.NewRequest("GET", "/ws?"+tt.query, nil))
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("roomName(%q) = %q, %v; want %q", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestRoomsOpening(t *testing.T) {
+	rooms := testRooms(t)
+	rooms.settings = map[string]RoomSettings{"ops": {RequireSpeaker: true}}
+
+	// status returns the status of a request through forRequest or
+	// forConnection.
+	status := func(connect bool, query string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/?"+query, nil)
+		if connect {
+			rooms.forConnection(w, r)
+		} else {
+			rooms.forRequest(w, r)
+		}
+		return w.Code
+	}
+	tests := []struct {
+		name    string
+		connect bool
+		query   string
+		want    int
+	}{
+		{name: "default room", query: "", want: http.StatusOK},
+		{name: "configured room", query: "room=ops", want: http.StatusOK},
+		{name: "unknown room", query: "room=kitchen", want: http.StatusNotFound},
+		{name: "invalid room", query: "room=no%20spaces", want: http.StatusBadRequest},
+		{name: "invalid room on connect", connect: true, query: "room=no%20spaces", want: http.StatusBadRequest},
+		{name: "connection opens a room", connect: true, query: "room=kitchen", want: http.StatusOK},
+		{name: "opened room is found", query: "room=kitchen", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := status(tt.connect, tt.query); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if h, err := rooms.get("ops"); err != nil || !h.Settings().RequireSpeaker {
+		t.Errorf("configured room ops did not get its settings: %v", err)
+	}
+
+	// Past the cap only the default and configured rooms open.
+	for i := len(rooms.hubs); i < maxRooms; i++ {
+		rooms.hubs[fmt.Sprintf("filler-%d", i)] = &Hub{}
+	}
+	if got := status(true, "room=one-too-many"); got != http.StatusServiceUnavailable {
+		t.Errorf("room past the cap: status %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	if _, err := rooms.get("one-too-many"); err != errTooManyRooms {
+		t.Errorf("get past the cap: %v, want errTooManyRooms", err)
+	}
+	delete(rooms.hubs, "ops")
+	delete(rooms.hubs, defaultRoom)
+	rooms.hubs["filler-a"], rooms.hubs["filler-b"] = &Hub{}, &Hub{}
+	for _, name := range []string{"ops", defaultRoom} {
+		if _, err := rooms.get(name); err != nil {
+			t.Errorf("get(%q) past the cap: %v", name, err)
+		}
+	}
+}
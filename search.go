@@ -0,0 +1,126 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// Scores for each way a query can match a sound, best first.
+const (
+	scoreName        = 100
+	scoreAlias       = 90
+	scoreNamePrefix  = 80
+	scoreAliasPrefix = 70
+	scoreNamePart    = 60
+	scoreAliasPart   = 50
+	scoreTitle       = 40
+	scoreTag         = 30
+	scoreSpelling    = 20
+)
+
+// search ranks the sounds matching a query, keeping only those carrying every
+// given tag, and returns the requested page.
+//
+// An empty query matches every sound, ordered by name.
+func (l *Library) search(query string, tags []string, offset int, limit int) *jukebox.SearchResults {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	query = strings.ToLower(strings.TrimSpace(query))
+	var matches []*jukebox.Match
+	for _, s := range l.sounds {
+		if !hasTags(s, tags) {
+			continue
+		}
+		score := 1
+		if query != "" {
+			score = scoreSound(s, query)
+		}
+		if score > 0 {
+			matches = append(matches, &jukebox.Match{Sound: *s, Score: score})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Name < matches[j].Name
+	})
+
+	results := &jukebox.SearchResults{Total: len(matches), Offset: offset, Limit: limit, Results: []*jukebox.Match{}}
+	if offset < len(matches) {
+		end := offset + limit
+		if end > len(matches) {
+			end = len(matches)
+		}
+		results.Results = matches[offset:end]
+	}
+	return results
+}
+
+// scoreSound rates how well a lowercased query matches a sound, or zero.
+func scoreSound(s *jukebox.Sound, query string) int {
+	name := strings.ToLower(s.Name)
+	best := 0
+	better := func(score int) {
+		if score > best {
+			best = score
+		}
+	}
+
+	switch {
+	case name == query:
+		better(scoreName)
+	case strings.HasPrefix(name, query):
+		better(scoreNamePrefix)
+	case strings.Contains(name, query):
+		better(scoreNamePart)
+	}
+	for _, a := range s.Aliases {
+		a = strings.ToLower(a)
+		switch {
+		case a == query:
+			better(scoreAlias)
+		case strings.HasPrefix(a, query):
+			better(scoreAliasPrefix)
+		case strings.Contains(a, query):
+			better(scoreAliasPart)
+		}
+	}
+	if strings.Contains(strings.ToLower(s.Title), query) {
+		better(scoreTitle)
+	}
+	if s.HasTag(query) {
+		better(scoreTag)
+	}
+	if best == 0 && levenshtein(name, query) <= len([]rune(query))/3 {
+		better(scoreSpelling)
+	}
+	return best
+}
+
+// hasTags reports whether a sound carries every one of the given tags.
+func hasTags(s *jukebox.Sound, tags []string) bool {
+	for _, t := range tags {
+		if !s.HasTag(t) {
+			return false
+		}
+	}
+	return true
+}
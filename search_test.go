@@ -0,0 +1,88 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		query  string
+		tags   []string
+		offset int
+		limit  int
+		total  int
+		want   []string
+	}{
+		// An empty query lists everything by name.
+		{limit: 10, total: 6, want: []string{"bell", "bezos", "dangerzone", "danielsan", "drama", "tada"}},
+		// Pages.
+		{limit: 2, total: 6, want: []string{"bell", "bezos"}},
+		{offset: 4, limit: 2, total: 6, want: []string{"drama", "tada"}},
+		{offset: 5, limit: 2, total: 6, want: []string{"tada"}},
+		{offset: 6, limit: 2, total: 6, want: []string{}},
+		// Tags filter, ignoring case, and all must match.
+		{tags: []string{"Movies"}, limit: 10, total: 2, want: []string{"dangerzone", "danielsan"}},
+		{tags: []string{"movies", "music"}, limit: 10, total: 1, want: []string{"dangerzone"}},
+		{query: "dan", tags: []string{"music"}, limit: 10, total: 1, want: []string{"dangerzone"}},
+		// Names beat aliases, which beat prefixes, titles and tags.
+		{query: "karate", limit: 10, total: 1, want: []string{"danielsan"}},
+		{query: "DAN", limit: 10, total: 2, want: []string{"dangerzone", "danielsan"}},
+		{query: "zone", limit: 10, total: 1, want: []string{"dangerzone"}},
+		{query: "shop", limit: 10, total: 1, want: []string{"bell"}},
+		{query: "celebrate", limit: 10, total: 1, want: []string{"tada"}},
+		{query: "bel", limit: 10, total: 1, want: []string{"bell"}},
+		{query: "dramma", limit: 10, total: 1, want: []string{"drama"}},
+		{query: "xylophone", limit: 10, total: 0, want: []string{}},
+	}
+	l := testLibrary(t)
+	for _, tt := range tests {
+		page := l.search(tt.query, tt.tags, tt.offset, tt.limit)
+		got := []string{}
+		for _, m := range page.Results {
+			got = append(got, m.Name)
+		}
+		if page.Total != tt.total || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("search(%q, %v, %d, %d) = %d total, %v; want %d total, %v", tt.query, tt.tags, tt.offset, tt.limit, page.Total, got, tt.total, tt.want)
+		}
+	}
+}
+
+func TestScoreSound(t *testing.T) {
+	l := testLibrary(t)
+	s := l.sounds["danielsan"]
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"danielsan", scoreName},
+		{"karate", scoreAlias},
+		{"dan", scoreNamePrefix},
+		{"kar", scoreAliasPrefix},
+		{"iels", scoreNamePart},
+		{"rat", scoreAliasPart},
+		{"the best", scoreTitle},
+		{"movies", scoreTag},
+		{"danielsen", scoreSpelling},
+		{"xylophone", 0},
+	}
+	for _, tt := range tests {
+		if got := scoreSound(s, tt.query); got != tt.want {
+			t.Errorf("scoreSound(danielsan, %q) = %d; want %d", tt.query, got, tt.want)
+		}
+	}
+}
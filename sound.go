@@ -0,0 +1,50 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// parseSound reads a manifest entry, which is either a URL string or a full
+// sound object.
+func parseSound(name string, data json.RawMessage) (*jukebox.Sound, error) {
+	s := &jukebox.Sound{}
+	var err error
+	if len(data) > 0 && data[0] == '"' {
+		err = json.Unmarshal(data, &s.URL)
+	} else {
+		err = json.Unmarshal(data, s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sound %q: %v", name, err)
+	}
+	if s.URL == "" {
+		return nil, fmt.Errorf("sound %q: missing URL", name)
+	}
+	s.Name = name
+	return s, nil
+}
+
+// soundWeight returns the effective random selection weight.
+func soundWeight(s *jukebox.Sound) float64 {
+	if s.Weight <= 0 {
+		return 1
+	}
+	return s.Weight
+}
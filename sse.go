@@ -0,0 +1,147 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// serveEvents streams hub events to the peer as Server-Sent Events, for
+// browsers behind proxies that refuse websocket upgrades.
+//
+// Each event is sent as its own "data:" line, with its sequence number as
+// the event ID so that a reconnecting EventSource resumes where it left off.
+// A comment is sent every pingPeriod so that idle proxies keep the stream
+// open.
+//
+// The stream opens with a "session" event naming the session to pass to
+// /send, so that the peer's acks are counted as its own.
+func serveEvents(polls *Polls, hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	client, err := newClientFromRequest(hub, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	hub.register <- client
+	defer func() { hub.unregister <- client }()
+	session := polls.attach(client)
+	defer polls.detach(session)
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", session.id)
+	flusher.Flush()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				// The hub closed the channel.
+				return
+			}
+			for _, line := range bytes.Split(message, newline) {
+				var e struct {
+					Seq uint64 `json:"seq"`
+				}
+				if json.Unmarshal(line, &e) == nil && e.Seq > 0 {
+					fmt.Fprintf(w, "id: %d\n", e.Seq)
+				}
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", line); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// needsKey reports whether a message sent over HTTP without a session plays a
+// sound or acknowledges an alarm, which need an API key like the rest of the
+// API.
+func needsKey(message []byte) bool {
+	if len(message) == 0 || message[0] != '{' {
+		return true
+	}
+	var cmd jukebox.Event
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		return false
+	}
+	return cmd.Type == jukebox.EventPlay || cmd.Type == jukebox.EventAcknowledge
+}
+
+// serveSend accepts a message over plain HTTP, in the same form a websocket
+// client would send it, for peers using Server-Sent Events or long polling.
+//
+// Peers pass the session they were given by /poll or /events, and their
+// messages are then treated exactly as if they came over the peer's
+// websocket. Without a session, acks are not counted, and playing a sound or
+// acknowledging an alarm needs an API key.
+func serveSend(polls *Polls, hub *Hub, keys []string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	message, err := readBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(message) > maxMessageSize {
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+	var client *Client
+	if s, ok := polls.session(hub, r.URL.Query().Get("session")); ok {
+		client = s.client
+	} else if needsKey(message) && !authorize(keys, w, r) {
+		return
+	}
+	if err := hub.handle(client, message); err != nil {
+		log.Println(err)
+		writePlayError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeSend(t *testing.T) {
+	rooms := testRooms(t)
+	hub, err := rooms.get(defaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rooms.get("ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	polls := newPolls()
+	join := func(h *Hub) string {
+		client, err := newClientFromRequest(h, httptest.NewRequest("GET", "/poll?handle=alice", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return polls.start(client).id
+	}
+	session, elsewhere := join(hub), join(other)
+
+	keys := []string{"secret"}
+	tests := []struct {
+		name    string
+		session string
+		key     string
+		message string
+		want    int
+	}{
+		{name: "play without session or key", message: "tada", want: http.StatusUnauthorized},
+		{name: "play command without session or key", message: `{"type":"play","sound":"tada"}`, want: http.StatusUnauthorized},
+		{name: "acknowledge without session or key", message: `{"type":"acknowledge","alarm":{"id":"x"}}`, want: http.StatusUnauthorized},
+		{name: "play with key", key: "secret", message: "tada", want: http.StatusNoContent},
+		{name: "play with wrong key", key: "guess", message: "tada", want: http.StatusUnauthorized},
+		{name: "play with session", session: session, message: "bell", want: http.StatusNoContent},
+		{name: "play command with session", session: session, message: `{"type":"play","sound":"drama"}`, want: http.StatusNoContent},
+		{name: "acknowledge with session", session: session, message: `{"type":"acknowledge","alarm":{"id":"x"}}`, want: http.StatusNotFound},
+		{name: "session in another room", session: elsewhere, message: "tada", want: http.StatusUnauthorized},
+		{name: "unknown session", session: "nope", message: "tada", want: http.StatusUnauthorized},
+		{name: "ack without session", message: `{"type":"ack","ref":1,"status":"played"}`, want: http.StatusNoContent},
+		{name: "unknown sound with session", session: session, message: "nosuchsound", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/send?session="+tt.session, strings.NewReader(tt.message))
+		if tt.key != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+		w := httptest.NewRecorder()
+		serveSend(polls, hub, keys, w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+
+	var played []string
+	for _, e := range waitForPlays(t, rooms, defaultRoom, 3) {
+		played = append(played, e.Sound)
+	}
+	if strings.Join(played, " ") != "tada bell drama" {
+		t.Errorf("played %q, want tada bell drama", played)
+	}
+}
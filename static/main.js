@@ -5,8 +5,18 @@ const launch = document.getElementById("launch");
   launch.onclick = function() {
 	  launch.style.display = 'none';
 	var conn;
-    //var msg = document.getElementById("msg");
+    var msg = document.getElementById("msg");
     var log = document.getElementById("log");
+	const reactions = ["👏", "😂", "🥁"];
+
+	document.getElementById("chat").onsubmit = function(event) {
+		event.preventDefault();
+		if (conn && msg.value.trim()) {
+			conn.send(JSON.stringify({type: "chat", text: msg.value}));
+			msg.value = "";
+		}
+		return false;
+	};
 
     function appendLog(item) {
         //var doScroll = log.scrollTop > log.scrollHeight - log.clientHeight - 1;
@@ -17,6 +27,28 @@ const launch = document.getElementById("launch");
     }
 
 	var audioElements = {};
+	var soundButtons = {};
+
+	// decorateSounds adds titles, attributions and icons to the sound buttons.
+	function decorateSounds(page) {
+		page.results.forEach(function(sound) {
+			const button = soundButtons[sound.name];
+			if (!button) {
+				return;
+			}
+			const title = [sound.title, sound.attribution].filter(Boolean).join(" — ");
+			if (title) {
+				button.title = title;
+			}
+			if (sound.icon) {
+				const img = document.createElement('img');
+				img.className = 'icon';
+				img.src = sound.icon;
+				img.alt = '';
+				button.insertBefore(img, button.firstChild);
+			}
+		});
+	}
 
 	fetch('/play/')
 	   	.catch(function(e) {
@@ -46,6 +78,7 @@ const launch = document.getElementById("launch");
 					button.href = '#';
 					button.innerHTML = key;
 					sounds.appendChild(button);
+					soundButtons[key] = button;
 					button.onclick = function(event) {
 						event.preventDefault();
 						if (!conn) {
@@ -58,38 +91,118 @@ const launch = document.getElementById("launch");
 					};
 				}
 			);
-	    });
+			fetch('/api/sounds?limit=200')
+				.then(function(response) {
+					return response.json();
+				})
+				.then(decorateSounds)
+				.catch(function(e) {
+					console.log(e);
+				});
+			return fetch('/api/macros');
+	    })
+	   	.then(function(response) {
+	        if (response.ok) {
+	            return response.json();
+	        }
+	        throw new Error(response.statusText);
+	   	})
+	   	.then(function(macros) {
+			const sounds = document.getElementById("sounds");
+			macros.forEach(function(macro) {
+				const button = document.createElement('a');
+				button.href = '#';
+				button.className = 'macro';
+				button.title = macro.definition;
+				button.innerHTML = macro.name;
+				sounds.appendChild(button);
+				button.onclick = function(event) {
+					event.preventDefault();
+					if (!conn) {
+						return false;
+					}
+
+					console.log("SEND: " + macro.name);
+					conn.send(macro.name);
+					return false;
+				};
+			});
+	   	})
+	   	.catch(function(e) {
+	        console.log(e);
+	   	});
 console.log("audio elements = " + JSON.stringify(audioElements));
 console.log(audioElements);
 	var player = function() {
 		var currentTrack = false;
+		var currentGroup = false;
+		var waiting = false;
 		var queue = []; // TODO: const?
 
 		function append(t) {
 			queue.push(t);
 		}
+		function start(t) {
+			const audio = audioElements[t.sound];
+			if (!audio) {
+				console.log("UNKNOWN: " + t.sound);
+				acknowledge(t, "failed");
+				return;
+			}
+			console.log("PLAY: " + t.sound);
+			currentTrack = audio;
+			currentGroup = t.group || false;
+			audio.onended = function() {
+				currentTrack = false;
+				currentGroup = false;
+			}
+			audio.play().then(function() {
+				acknowledge(t, "played");
+			}).catch(function(e) {
+				console.log(e);
+				acknowledge(t, e.name === "NotAllowedError" ? "blocked" : "failed");
+				currentTrack = false;
+				currentGroup = false;
+			});
+		}
 		function next() {
-			if (!currentTrack && queue.length > 0) {
+			if (!currentTrack && !waiting && queue.length > 0) {
 				const nextTrack = queue.shift();
-				console.log("PLAY: " + nextTrack);
-				const audio = audioElements[nextTrack];
-				audio.onplay = function() {
-					currentTrack = audio;
-				}
-				audio.onended = function() {
-					currentTrack = false;
+				if (!nextTrack.wait) {
+					start(nextTrack);
+					return;
 				}
-				audio.play();
+				waiting = nextTrack;
+				window.setTimeout(function() {
+					if (waiting === nextTrack) {
+						waiting = false;
+						start(nextTrack);
+					}
+				}, nextTrack.wait);
 			}
 		}
 
-		/*function stop() {
+		// Drop every queued, pending or playing track in a group.
+		function skip(group) {
+			queue = queue.filter(function(t) {
+				return t.group !== group;
+			});
+			if (waiting && waiting.group === group) {
+				waiting = false;
+			}
+			if (currentTrack && currentGroup === group) {
+				stop();
+			}
+		}
+
+		function stop() {
 			if (currentTrack) {
 				currentTrack.pause();
 				currentTrack.currentTime = 0;
 				currentTrack = false;
+				currentGroup = false;
 			}
-		}*/
+		}
 		
 		window.setInterval(function() {
 			next();
@@ -97,33 +210,291 @@ console.log(audioElements);
 
 		return {
 			append: append,
+			skip: skip,
 		};
 	}();
 	var queueTrack = player.append;
+	var skipLinks = {};
+	var logItems = {};
+
+	// Sequence number of the last event received, for resuming.
+	var lastSeq = 0;
+	var wsOpened = false;
+	const minBackoff = 500;
+	const maxBackoff = 30000;
+	var backoff = minBackoff;
+	const replayWindow = 15000;
 	
-    if (window["WebSocket"]) {
-		conn = new WebSocket("ws://" + document.location.host + "/ws");
-
-        conn.onclose = function (evt) {
-            var item = document.createElement("div");
-            item.innerHTML = "<b>Connection closed.</b>";
-            appendLog(item);
-        };
-        conn.onmessage = function (evt) {
-			var messages = evt.data.split('\n');
-
-            for (var i = 0; i < messages.length; i++) {
-				queueTrack(messages[i]);
-				
-                var item = document.createElement("div");
-                item.innerText = messages[i];
-                appendLog(item);
-            }
-        };
-    } else {
-        var item = document.createElement("div");
-        item.innerHTML = "<b>Your browser does not support WebSockets.</b>";
-        appendLog(item);
+	function handleEvent(event) {
+		if (event.seq) {
+			lastSeq = event.seq;
+		}
+		if (event.type === "gap") {
+			logStatus("<b>Reconnected, but " + event.text + ".</b>");
+			return;
+		}
+		if (event.type === "skip") {
+			player.skip(event.group);
+			return;
+		}
+		if (event.type === "receipt") {
+			const item = logItems[event.ref];
+			if (item) {
+				item.querySelector(".receipt").innerText = event.text;
+			}
+			return;
+		}
+		if (event.type === "dnd") {
+			if (event.missed) {
+				var item = document.createElement("div");
+				item.innerText = "While you were away you " + event.text + ": " + event.missed.join(", ");
+				appendLog(item);
+			}
+			return;
+		}
+		if (event.type === "chat") {
+			var item = document.createElement("div");
+			item.className = 'chat';
+			item.innerText = (event.from || "someone") + ": " + event.text;
+			appendLog(item);
+			return;
+		}
+		if (event.type === "reaction") {
+			const item = logItems[event.ref];
+			if (item) {
+				item.querySelector(".reactions").innerText += event.text;
+			}
+			return;
+		}
+		if (event.type === "alarm") {
+			var item = document.createElement("div");
+			item.className = 'alarm';
+			item.innerText = event.alarm.sound + ": " + event.text;
+			appendLog(item);
+			return;
+		}
+		if (event.type === "error") {
+			var item = document.createElement("div");
+			item.className = 'error';
+			item.innerText = event.text;
+			appendLog(item);
+			return;
+		}
+		if (event.type !== "play" && event.type !== "announce") {
+			return;
+		}
+		// Catch up quietly on anything replayed from long ago. Announcements
+		// are only shown, since this client is a controller.
+		if (event.type === "play" && (!event.replayed || Date.now() - Date.parse(event.time) < replayWindow)) {
+			queueTrack(event);
+		}
+
+		var item = document.createElement("div");
+		var label = event.to ? event.sound + " (whisper)" : event.sound;
+		if (event.text) {
+			label += " — " + event.text;
+		}
+		item.innerText = label;
+		const receipt = document.createElement("span");
+		receipt.className = 'receipt';
+		item.appendChild(receipt);
+		const shown = document.createElement("span");
+		shown.className = 'reactions';
+		item.appendChild(shown);
+		if (event.seq) {
+			const ref = event.seq;
+			reactions.forEach(function(emoji) {
+				const link = document.createElement("a");
+				link.href = '#';
+				link.className = 'react';
+				link.innerText = emoji;
+				link.onclick = function(e) {
+					e.preventDefault();
+					conn.send(JSON.stringify({type: "reaction", ref: ref, text: emoji}));
+					return false;
+				};
+				item.appendChild(link);
+			});
+		}
+		logItems[event.seq] = item;
+		if (event.alarm && !skipLinks[event.group]) {
+			const id = event.alarm.id;
+			const link = document.createElement("a");
+			link.href = '#';
+			link.className = 'skip';
+			link.innerText = 'acknowledge';
+			link.onclick = function(e) {
+				e.preventDefault();
+				conn.send(JSON.stringify({type: "acknowledge", alarm: {id: id}}));
+				return false;
+			};
+			skipLinks[event.group] = link;
+			item.appendChild(link);
+		}
+		if (event.group && !skipLinks[event.group]) {
+			const group = event.group;
+			const link = document.createElement("a");
+			link.href = '#';
+			link.className = 'skip';
+			link.innerText = 'skip';
+			link.onclick = function(e) {
+				e.preventDefault();
+				conn.send(JSON.stringify({type: "skip", group: group}));
+				return false;
+			};
+			skipLinks[group] = link;
+			item.appendChild(link);
+		}
+		appendLog(item);
+	}
+
+	// Handle one or more newline-separated events.
+	function receive(data) {
+		var messages = data.split('\n');
+		for (var i = 0; i < messages.length; i++) {
+			if (messages[i]) {
+				handleEvent(JSON.parse(messages[i]));
+			}
+		}
+	}
+
+	function logStatus(html) {
+		var item = document.createElement("div");
+		item.innerHTML = html;
+		appendLog(item);
+	}
+
+	// Report whether a play event was heard.
+	function acknowledge(t, status) {
+		if (conn && t.seq) {
+			conn.send(JSON.stringify({type: "ack", ref: t.seq, status: status}));
+		}
+	}
+
+	// Send a message over plain HTTP, for the fallback transports.
+	function post(message, session) {
+		fetch(endpoint('/send', session ? 'session=' + encodeURIComponent(session) : ''), {method: 'POST', body: message})
+			.then(function(response) {
+				if (!response.ok) {
+					return response.text().then(function(text) {
+						if ((response.headers.get('Content-Type') || '').indexOf('application/json') === 0) {
+							receive(text);
+						} else {
+							handleEvent({type: "error", text: text.trim() || response.statusText});
+						}
+					});
+				}
+			})
+			.catch(function(e) {
+				console.log(e);
+			});
+	}
+
+	// Add the page's query, such as the room, and more parameters to a path.
+	function endpoint(path, params) {
+		var query = document.location.search ? document.location.search + '&' : '?';
+		return path + query + params;
+	}
+
+	// Ask the server to replay anything after the last event seen.
+	function resumeParams() {
+		return lastSeq ? 'since=' + lastSeq : '';
+	}
+
+	// Long polling works through nearly any proxy.
+	function connectPoll() {
+		var session = '';
+		function poll() {
+			fetch(endpoint('/poll', session ? 'session=' + encodeURIComponent(session) : resumeParams()))
+				.then(function(response) {
+					if (response.status === 410) {
+						session = '';
+						return null;
+					}
+					if (response.ok) {
+						return response.json();
+					}
+					throw new Error(response.statusText);
+				})
+				.then(function(body) {
+					if (body) {
+						session = body.session;
+						body.events.forEach(handleEvent);
+					}
+					poll();
+				})
+				.catch(function(e) {
+					console.log(e);
+					window.setTimeout(poll, 5000);
+				});
+		}
+		poll();
+		return {
+			send: function(message) {
+				post(message, session);
+			},
+		};
+	}
+
+	function connectEventSource() {
+		const source = new EventSource('/events' + document.location.search);
+		var opened = false;
+		var session = '';
+		source.onopen = function() {
+			opened = true;
+		};
+		source.onmessage = function(evt) {
+			receive(evt.data);
+		};
+		source.addEventListener('session', function(evt) {
+			session = evt.data;
+		});
+		source.onerror = function() {
+			if (!opened) {
+				source.close();
+				logStatus("<b>Server-Sent Events unavailable; polling instead.</b>");
+				conn = connectPoll();
+			}
+		};
+		return {
+			send: function(message) {
+				post(message, session);
+			},
+		};
+	}
+
+	// Fall back to Server-Sent Events or polling if the upgrade never succeeds,
+	// and otherwise keep reconnecting, resuming from the last event seen.
+	function connectWebSocket() {
+		const ws = new WebSocket("ws://" + document.location.host + endpoint("/ws", resumeParams()));
+		ws.onopen = function() {
+			wsOpened = true;
+			backoff = minBackoff;
+		};
+		ws.onclose = function (evt) {
+			if (!wsOpened) {
+				logStatus("<b>WebSockets unavailable; falling back.</b>");
+				conn = window["EventSource"] ? connectEventSource() : connectPoll();
+				return;
+			}
+			console.log("Connection closed; reconnecting in " + backoff + "ms");
+			window.setTimeout(function() {
+				conn = connectWebSocket();
+			}, backoff);
+			backoff = Math.min(backoff * 2, maxBackoff);
+		};
+		ws.onmessage = function (evt) {
+			receive(evt.data);
+		};
+		return ws;
+	}
+
+	if (window["WebSocket"]) {
+		conn = connectWebSocket();
+	} else if (window["EventSource"]) {
+		conn = connectEventSource();
+	} else {
+		conn = connectPoll();
 	}
   };
 };
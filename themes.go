@@ -0,0 +1,54 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// welcome plays a participant's theme when its first connection joins the
+// room, unless the room has heard it too recently, turned themes off or
+// cannot take a play right now.
+func (h *Hub) welcome(client *Client) {
+	if client.handle == "" || len(client.theme) == 0 {
+		return
+	}
+	h.mu.Lock()
+	first := h.handles[client.handle] == 1
+	settings := h.settings
+	h.mu.Unlock()
+	if !first || settings.DisableThemes {
+		return
+	}
+
+	cooldown := time.Duration(settings.ThemeCooldown)
+	if cooldown == 0 {
+		cooldown = defaultThemeCooldown
+	}
+	now := time.Now()
+	if last, ok := h.themed[client.handle]; ok && now.Sub(last) < cooldown {
+		return
+	}
+	if err := h.accepting(jukebox.PlayOptions{}); err != nil {
+		return
+	}
+	h.themed[client.handle] = now
+	for _, e := range client.theme {
+		e.Text = client.handle + " joined"
+	}
+	h.publish(client.theme)
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThemes(t *testing.T) {
+	rooms := testRooms(t)
+	rooms.settings = map[string]RoomSettings{
+		"brief":  {ThemeCooldown: duration(time.Nanosecond)},
+		"themes": {DisableThemes: true},
+		"quiet":  {RequireSpeaker: true},
+	}
+	setup, err := rooms.get("setup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setter := connect(t, setup, "handle=alice")
+
+	tests := []struct {
+		room  string
+		theme string
+		joins []string
+
+		// Whether each connection leaves before the next joins.
+		leave bool
+
+		want string
+	}{
+		{room: "lobby", theme: "karate", joins: []string{"handle=alice", "handle=alice"}, want: "play:danielsan"},
+		{room: "cooldown", theme: "karate", joins: []string{"handle=alice", "handle=alice"}, leave: true, want: "play:danielsan"},
+		{room: "brief", theme: "karate", joins: []string{"handle=alice", "handle=alice"}, leave: true, want: "play:danielsan play:danielsan"},
+		{room: "others", theme: "karate", joins: []string{"handle=bob", ""}},
+		{room: "themes", theme: "karate", joins: []string{"handle=alice"}},
+		{room: "quiet", theme: "karate", joins: []string{"handle=alice&role=controller"}},
+		{room: "macro", theme: "celebrate", joins: []string{"handle=alice"}, want: "play:tada play:bell play:bell"},
+		{room: "none", joins: []string{"handle=alice"}},
+	}
+	for _, tt := range tests {
+		message := fmt.Sprintf(`{"type":"prefs","prefs":{"theme":%q}}`, tt.theme)
+		if err := setup.handle(setter, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		h, err := rooms.get(tt.room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, query := range tt.joins {
+			c := connect(t, h, query)
+			if tt.leave {
+				h.unregister <- c
+			}
+		}
+		settle(h)
+		events := h.since(0)
+		if got := strings.Join(summarize(events), " "); got != tt.want {
+			t.Errorf("%s: heard %q, want %q", tt.room, got, tt.want)
+		}
+		for _, e := range events {
+			if e.Text != "alice joined" {
+				t.Errorf("%s: %s has text %q", tt.room, e.Sound, e.Text)
+			}
+		}
+	}
+
+	message := `{"type":"prefs","prefs":{"theme":"xylophone"}}`
+	if err := setup.handle(setter, []byte(message)); err == nil {
+		t.Errorf("%s: accepted an unknown theme", message)
+	}
+}
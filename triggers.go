@@ -0,0 +1,258 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/merenbach/sound-machine/jukebox"
+)
+
+// How long a trigger waits to fire again in a room, unless it says.
+const defaultTriggerCooldown = time.Minute
+
+// Trigger plays a sound when a chat message matches a phrase or pattern.
+type Trigger struct {
+	Name string `json:"name"`
+
+	// Phrase matches messages containing these words, ignoring case.
+	Phrase string `json:"phrase,omitempty"`
+
+	// Pattern is a regular expression to match messages against, in place
+	// of a phrase.
+	Pattern string `json:"pattern,omitempty"`
+
+	// Sound or macro to play.
+	Sound string `json:"sound"`
+
+	// Rooms the trigger works in; empty means all of them.
+	Rooms []string `json:"rooms,omitempty"`
+
+	// Cooldown is how long after firing before the trigger may fire again
+	// in the same room. Zero means defaultTriggerCooldown.
+	Cooldown duration `json:"cooldown,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// compile checks a trigger and prepares its expression.
+func (tr *Trigger) compile() error {
+	if !validLabel.MatchString(tr.Name) {
+		return fmt.Errorf("invalid trigger name %q", tr.Name)
+	}
+	if tr.Sound == "" {
+		return fmt.Errorf("trigger %s has no sound", tr.Name)
+	}
+	for _, room := range tr.Rooms {
+		if !validRoom.MatchString(room) {
+			return fmt.Errorf("invalid room %q", room)
+		}
+	}
+	switch {
+	case tr.Phrase != "" && tr.Pattern != "":
+		return fmt.Errorf("trigger %s has both a phrase and a pattern", tr.Name)
+	case tr.Phrase != "":
+		phrase := strings.TrimSpace(tr.Phrase)
+		if phrase == "" {
+			return fmt.Errorf("trigger %s has an empty phrase", tr.Name)
+		}
+		words := strings.Fields(phrase)
+		for i, w := range words {
+			words[i] = regexp.QuoteMeta(w)
+		}
+		// Word boundaries only hold next to word characters, so a phrase
+		// such as "+1" or "ship it!" is bounded only where it has them.
+		expr := strings.Join(words, `\s+`)
+		if isWordChar(phrase[0]) {
+			expr = `\b` + expr
+		}
+		if isWordChar(phrase[len(phrase)-1]) {
+			expr += `\b`
+		}
+		tr.re = regexp.MustCompile(`(?i)` + expr)
+	case tr.Pattern != "":
+		re, err := regexp.Compile(tr.Pattern)
+		if err != nil {
+			return fmt.Errorf("trigger %s: %v", tr.Name, err)
+		}
+		tr.re = re
+	default:
+		return fmt.Errorf("trigger %s has no phrase or pattern", tr.Name)
+	}
+	return nil
+}
+
+// isWordChar reports whether a byte is an ASCII word character, the only
+// kind that \b treats as one.
+func isWordChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// appliesTo reports whether the trigger works in a room.
+func (tr *Trigger) appliesTo(room string) bool {
+	if len(tr.Rooms) == 0 {
+		return true
+	}
+	for _, r := range tr.Rooms {
+		if r == room {
+			return true
+		}
+	}
+	return false
+}
+
+// Triggers holds the chat triggers, shared by all rooms.
+type Triggers struct {
+	library *Library
+
+	mu       sync.Mutex
+	triggers map[string]*Trigger
+
+	// When each trigger last fired, by room and trigger name.
+	fired map[string]time.Time
+}
+
+// newTriggers checks the triggers given in the config.
+func newTriggers(library *Library, defs []*Trigger) (*Triggers, error) {
+	t := &Triggers{
+		library:  library,
+		triggers: make(map[string]*Trigger),
+		fired:    make(map[string]time.Time),
+	}
+	for _, tr := range defs {
+		if err := tr.compile(); err != nil {
+			return nil, err
+		}
+		if _, ok := t.triggers[tr.Name]; ok {
+			return nil, fmt.Errorf("duplicate trigger %s", tr.Name)
+		}
+		t.triggers[tr.Name] = tr
+		library.expect(tr.Sound, "trigger "+tr.Name)
+	}
+	return t, nil
+}
+
+// all returns every trigger, sorted by name.
+func (t *Triggers) all() []*Trigger {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	triggers := make([]*Trigger, 0, len(t.triggers))
+	for _, tr := range t.triggers {
+		triggers = append(triggers, tr)
+	}
+	sort.Slice(triggers, func(i, j int) bool { return triggers[i].Name < triggers[j].Name })
+	return triggers
+}
+
+// get returns a trigger by name.
+func (t *Triggers) get(name string) (*Trigger, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr, ok := t.triggers[name]
+	return tr, ok
+}
+
+// define checks a trigger against the library and adds or replaces it.
+func (t *Triggers) define(tr *Trigger) error {
+	if err := tr.compile(); err != nil {
+		return err
+	}
+	if _, err := t.library.resolve(tr.Sound); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.triggers[tr.Name] = tr
+	return nil
+}
+
+// remove deletes a trigger, reporting whether it existed.
+func (t *Triggers) remove(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.triggers[name]
+	delete(t.triggers, name)
+	return ok
+}
+
+// match returns the triggers a chat message in a room sets off that are not
+// cooling down, sorted by name.
+func (t *Triggers) match(room, text string, now time.Time) []*Trigger {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var matched []*Trigger
+	for _, tr := range t.triggers {
+		if tr.appliesTo(room) && tr.re.MatchString(text) && !t.cooling(room, tr, now) {
+			matched = append(matched, tr)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Name < matched[j].Name })
+	return matched
+}
+
+// cooling reports whether a trigger fired in a room too recently to fire
+// again. The caller must hold t.mu.
+func (t *Triggers) cooling(room string, tr *Trigger, now time.Time) bool {
+	cooldown := time.Duration(tr.Cooldown)
+	if cooldown == 0 {
+		cooldown = defaultTriggerCooldown
+	}
+	last, ok := t.fired[room+"/"+tr.Name]
+	return ok && now.Sub(last) < cooldown
+}
+
+// fire starts a trigger's cooldown in a room, reporting false if another
+// message set it off in the meantime.
+func (t *Triggers) fire(room string, tr *Trigger, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cooling(room, tr, now) {
+		return false
+	}
+	t.fired[room+"/"+tr.Name] = now
+	return true
+}
+
+// triggered returns the plays set off by a chat message. A trigger's
+// cooldown starts only once it has a sound to play in a room that can take
+// it.
+func (h *Hub) triggered(e *jukebox.Event) []*jukebox.Event {
+	if h.accepting(jukebox.PlayOptions{}) != nil {
+		return nil
+	}
+	now := time.Now()
+	var events []*jukebox.Event
+	for _, tr := range h.triggers.match(h.room, e.Text, now) {
+		resolved, err := h.library.resolve(tr.Sound)
+		if err != nil {
+			log.Println("Trigger", tr.Name, "failed:", err)
+			continue
+		}
+		if !h.triggers.fire(h.room, tr, now) {
+			continue
+		}
+		for _, p := range resolved {
+			p.Text = "triggered by " + tr.Name
+		}
+		events = append(events, resolved...)
+	}
+	return events
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTriggerPhrases(t *testing.T) {
+	tests := []struct {
+		phrase string
+		text   string
+		want   bool
+	}{
+		{phrase: "ship it", text: "let's ship it!", want: true},
+		{phrase: "ship it", text: "SHIP   IT", want: true},
+		{phrase: "ship it", text: "shipit", want: false},
+		{phrase: "ship it", text: "worship itself", want: false},
+		{phrase: "ship it!", text: "ok, ship it!", want: true},
+		{phrase: "ship it!", text: "ship it", want: false},
+		{phrase: "+1", text: "+1", want: true},
+		{phrase: "+1", text: "looks good +1 from me", want: true},
+		{phrase: "+1", text: "+10", want: false},
+		{phrase: " lgtm ", text: "LGTM.", want: true},
+		{phrase: "lgtm", text: "lgtmx", want: false},
+		{phrase: "c++", text: "written in c++ again", want: true},
+		{phrase: "c++", text: "abc++", want: false},
+	}
+	for _, tt := range tests {
+		tr := &Trigger{Name: "t", Phrase: tt.phrase, Sound: "tada"}
+		if err := tr.compile(); err != nil {
+			t.Fatal(err)
+		}
+		if got := tr.re.MatchString(tt.text); got != tt.want {
+			t.Errorf("phrase %q on %q = %v, want %v", tt.phrase, tt.text, got, tt.want)
+		}
+	}
+
+	if err := (&Trigger{Name: "t", Phrase: "  ", Sound: "tada"}).compile(); err == nil {
+		t.Errorf("accepted a blank phrase")
+	}
+}
+
+func TestTriggerCooldowns(t *testing.T) {
+	library := testLibrary(t)
+	triggers, err := newTriggers(library, []*Trigger{
+		{Name: "shipit", Phrase: "ship it", Sound: "tada"},
+		{Name: "plusone", Phrase: "+1", Sound: "bell", Cooldown: duration(time.Nanosecond)},
+		{Name: "broken", Phrase: "broken", Sound: "xylophone"},
+		{Name: "ops", Pattern: `^deploy(ed)?\b`, Sound: "celebrate", Rooms: []string{"ops"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs, err := newPrefStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rooms := newRooms(library, map[string]RoomSettings{"quiet": {RequireSpeaker: true}}, prefs, triggers)
+
+	tests := []struct {
+		room    string
+		connect string
+		text    string
+		want    []string
+	}{
+		{room: defaultRoom, text: "ship it", want: []string{"chat:", "play:tada"}},
+		{room: defaultRoom, text: "ship it again", want: []string{"chat:"}},
+		{room: "ops", text: "ship it", want: []string{"chat:", "play:tada"}},
+		{room: defaultRoom, text: "+1", want: []string{"chat:", "play:bell"}},
+		{room: defaultRoom, text: "+1 +1", want: []string{"chat:", "play:bell"}},
+		{room: defaultRoom, text: "broken", want: []string{"chat:"}},
+		{room: defaultRoom, text: "deployed", want: []string{"chat:"}},
+		{room: "ops", text: "deployed v2", want: []string{"chat:", "play:tada", "play:bell", "play:bell"}},
+		{room: "quiet", text: "ship it", want: []string{"chat:"}},
+		{room: "quiet", connect: "role=speaker", text: "ship it +1", want: []string{"chat:", "play:bell", "play:tada"}},
+	}
+	for _, tt := range tests {
+		h, err := rooms.get(tt.room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.connect != "" {
+			connect(t, h, tt.connect)
+		}
+		settle(h)
+		before := len(h.since(0))
+		if err := h.handle(nil, []byte(`{"type":"chat","text":"`+tt.text+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+		settle(h)
+		if got := summarize(h.since(0)[before:]); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q in %s: heard %q, want %q", tt.text, tt.room, got, tt.want)
+		}
+	}
+
+	triggers.mu.Lock()
+	defer triggers.mu.Unlock()
+	if _, ok := triggers.fired[defaultRoom+"/broken"]; ok {
+		t.Errorf("a trigger with no sound to play started its cooldown")
+	}
+}
+
+func TestTriggerSoundsChecked(t *testing.T) {
+	library := testLibrary(t)
+	sounds := library.sounds
+	library.sounds = nil
+	_, err := newTriggers(library, []*Trigger{
+		{Name: "shipit", Phrase: "ship it", Sound: "tada"},
+		{Name: "party", Phrase: "party", Sound: "celebrate"},
+		{Name: "broken", Phrase: "broken", Sound: "xylophone"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	library.mu.Lock()
+	defer library.mu.Unlock()
+	library.sounds = sounds
+	problems := library.checkExpected()
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], `trigger broken plays "xylophone", which will fail: unknown sound`) {
+		t.Errorf("got problems %q", problems)
+	}
+}
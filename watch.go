@@ -0,0 +1,254 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// How often watched files are checked for new lines.
+	watchPeriod = time.Second
+
+	// How long a log rule waits to fire again, unless it says.
+	defaultRuleCooldown = 10 * time.Second
+
+	// Longest line read from a log file; anything past it is dropped.
+	maxLogLine = 64 * 1024
+)
+
+// Watch tails a log file and plays sounds for lines matching its rules.
+type Watch struct {
+	File  string     `json:"file"`
+	Rules []*LogRule `json:"rules"`
+}
+
+// LogRule plays a sound when a log line matches a regular expression.
+type LogRule struct {
+	Pattern string `json:"pattern"`
+
+	// Sound or macro to play.
+	Sound string `json:"sound"`
+
+	// Text to send with the play, which may refer to the pattern's capture
+	// groups as $1 or ${name}. Empty means the matching line.
+	Text string `json:"text,omitempty"`
+
+	// Where the sound plays.
+	Target
+
+	// Cooldown is the least time between plays from this rule. Matches in
+	// between are counted and mentioned with the next play. Zero means
+	// defaultRuleCooldown.
+	Cooldown duration `json:"cooldown,omitempty"`
+
+	re *regexp.Regexp
+
+	mu         sync.Mutex
+	fired      time.Time
+	suppressed int
+}
+
+// compile checks a rule and prepares its expression.
+func (rule *LogRule) compile() error {
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return fmt.Errorf("log rule %q: %v", rule.Pattern, err)
+	}
+	if rule.Sound == "" {
+		return fmt.Errorf("log rule %q has no sound", rule.Pattern)
+	}
+	rule.re = re
+	return rule.Target.validate()
+}
+
+// match returns the text to play a line with, or false if the rule does not
+// match it or is cooling down.
+func (rule *LogRule) match(line string, now time.Time) (string, bool) {
+	m := rule.re.FindStringSubmatchIndex(line)
+	if m == nil {
+		return "", false
+	}
+	rule.mu.Lock()
+	defer rule.mu.Unlock()
+	cooldown := time.Duration(rule.Cooldown)
+	if cooldown == 0 {
+		cooldown = defaultRuleCooldown
+	}
+	if !rule.fired.IsZero() && now.Sub(rule.fired) < cooldown {
+		rule.suppressed++
+		return "", false
+	}
+	rule.fired = now
+
+	text := line
+	if rule.Text != "" {
+		text = string(rule.re.ExpandString(nil, rule.Text, line, m))
+	}
+	if rule.suppressed > 0 {
+		text += fmt.Sprintf(" (and %d more)", rule.suppressed)
+		rule.suppressed = 0
+	}
+	return clip(text), true
+}
+
+// checkWatches validates the watches in the config, and has the library check
+// their sounds once it is loaded.
+func checkWatches(library *Library, defs []*Watch) error {
+	for _, w := range defs {
+		if w.File == "" {
+			return fmt.Errorf("watch has no file")
+		}
+		for _, rule := range w.Rules {
+			if err := rule.compile(); err != nil {
+				return err
+			}
+			library.expect(rule.Sound, fmt.Sprintf("log rule %q", rule.Pattern))
+		}
+	}
+	return nil
+}
+
+// run tails a watched file until the process exits, playing sounds through
+// notify for the lines that match.
+func (w *Watch) run(notify func(rule *LogRule, text string)) {
+	t := &tailer{path: w.File}
+	ticker := time.NewTicker(watchPeriod)
+	defer ticker.Stop()
+	var failing bool
+	for range ticker.C {
+		err := t.poll(func(line string) {
+			now := time.Now()
+			for _, rule := range w.Rules {
+				if text, ok := rule.match(line, now); ok {
+					notify(rule, text)
+				}
+			}
+		})
+		// Log a missing or unreadable file once, not every second.
+		if err != nil && !failing {
+			log.Println("Could not watch", w.File+":", err)
+		}
+		failing = err != nil
+	}
+}
+
+// tailer follows a file as it grows, the way "tail -F" does. It starts at
+// the end of the file, reopens it when it is rotated and starts over when
+// it is truncated.
+type tailer struct {
+	path string
+
+	file   *os.File
+	reader *bufio.Reader
+
+	// A line read without its newline yet.
+	partial []byte
+
+	// Whether the file has been opened before, so a new file should be
+	// read from the start.
+	seen bool
+}
+
+// poll reads any complete lines added since the last poll.
+func (t *tailer) poll(line func(string)) error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		if t.file == nil {
+			// Read the file from the start once it turns up.
+			t.seen = true
+		}
+		return err
+	}
+
+	if t.file != nil {
+		current, err := t.file.Stat()
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(current, info) {
+			// Rotated: finish the old file, then move to the new one.
+			// Nothing more is read from the old file, so a line left
+			// without its newline is as complete as it will get.
+			if err := t.read(line); err != nil {
+				return err
+			}
+			if len(t.partial) > 0 {
+				line(string(bytes.TrimRight(t.partial, "\r\n")))
+			}
+			t.close()
+		} else if pos, err := t.file.Seek(0, io.SeekCurrent); err == nil && info.Size() < pos-int64(t.reader.Buffered()) {
+			// Truncated: start over.
+			if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			t.reader.Reset(t.file)
+			t.partial = nil
+		}
+	}
+
+	if t.file == nil {
+		f, err := os.Open(t.path)
+		if err != nil {
+			return err
+		}
+		if !t.seen {
+			if _, err := f.Seek(0, io.SeekEnd); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		t.file, t.reader, t.seen = f, bufio.NewReader(f), true
+	}
+	return t.read(line)
+}
+
+// read passes on every complete line up to the end of the file.
+func (t *tailer) read(line func(string)) error {
+	for {
+		chunk, err := t.reader.ReadSlice('\n')
+		// Keep the start of an over-long line and drop the rest of it.
+		if room := maxLogLine - len(t.partial); len(chunk) > room {
+			chunk = chunk[:room]
+		}
+		t.partial = append(t.partial, chunk...)
+		switch err {
+		case nil:
+			line(string(bytes.TrimRight(t.partial, "\r\n")))
+			t.partial = t.partial[:0]
+		case bufio.ErrBufferFull:
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// close closes the file being followed.
+func (t *tailer) close() {
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.file, t.reader, t.partial = nil, nil, nil
+}
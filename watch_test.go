@@ -0,0 +1,199 @@
+// Copyright 2018 Andrew Merenbach
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendFile adds text to the end of a file, creating it if need be.
+func appendFile(t *testing.T, path, text string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "before we started\n")
+
+	tests := []struct {
+		name    string
+		change  func()
+		want    []string
+		failing bool
+	}{
+		{
+			name:   "starts at the end",
+			change: func() {},
+		},
+		{
+			name:   "appended lines",
+			change: func() { appendFile(t, path, "one\ntwo\r\n") },
+			want:   []string{"one", "two"},
+		},
+		{
+			name:   "partial line waits",
+			change: func() { appendFile(t, path, "thr") },
+		},
+		{
+			name:   "partial line completed",
+			change: func() { appendFile(t, path, "ee\nfo") },
+			want:   []string{"three"},
+		},
+		{
+			name: "truncated",
+			change: func() {
+				if err := ioutil.WriteFile(path, []byte("new\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"new"},
+		},
+		{
+			name: "rotated",
+			change: func() {
+				appendFile(t, path, "last\n")
+				if err := os.Rename(path, path+".1"); err != nil {
+					t.Fatal(err)
+				}
+				appendFile(t, path, "fresh\n")
+			},
+			want: []string{"last", "fresh"},
+		},
+		{
+			name: "rotated with a partial line",
+			change: func() {
+				appendFile(t, path, "cut off")
+				if err := os.Rename(path, path+".2"); err != nil {
+					t.Fatal(err)
+				}
+				appendFile(t, path, "next\n")
+			},
+			want: []string{"cut off", "next"},
+		},
+		{
+			name:    "missing",
+			change:  func() { os.Remove(path) },
+			failing: true,
+		},
+		{
+			name:   "back from the start",
+			change: func() { appendFile(t, path, "back\n") },
+			want:   []string{"back"},
+		},
+		{
+			name:   "long line",
+			change: func() { appendFile(t, path, strings.Repeat("x", 2*maxLogLine)+"\nshort\n") },
+			want:   []string{strings.Repeat("x", maxLogLine), "short"},
+		},
+		{
+			name:   "long partial line waits",
+			change: func() { appendFile(t, path, strings.Repeat("x", maxLogLine-10)) },
+		},
+		{
+			name:   "long line keeps its start",
+			change: func() { appendFile(t, path, strings.Repeat("y", 2*maxLogLine)+"z\n") },
+			want:   []string{strings.Repeat("x", maxLogLine-10) + strings.Repeat("y", 10)},
+		},
+	}
+	tl := &tailer{path: path}
+	defer tl.close()
+	for _, tt := range tests {
+		tt.change()
+		var got []string
+		err := tl.poll(func(line string) { got = append(got, line) })
+		if (err != nil) != tt.failing {
+			t.Errorf("%s: poll returned %v", tt.name, err)
+		}
+		if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("%s: got %.40q, want %.40q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLogRuleMatch(t *testing.T) {
+	rule := &LogRule{Pattern: `deployed (?P<app>\w+) to (\w+)`, Sound: "tada", Text: "${app} is live in $2"}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	long := "deployed " + strings.Repeat("a", maxChatLength) + " to prod"
+
+	tests := []struct {
+		line  string
+		after time.Duration
+		want  string
+		ok    bool
+	}{
+		{line: "nothing to see"},
+		{line: "deployed api to prod", want: "api is live in prod", ok: true},
+		{line: "deployed web to prod", after: time.Second},
+		{line: "deployed db to staging", after: 2 * time.Second},
+		{line: "deployed web to staging", after: defaultRuleCooldown, want: "web is live in staging (and 2 more)", ok: true},
+		{line: long, after: 2 * defaultRuleCooldown, want: clip(strings.Repeat("a", maxChatLength) + " is live in prod"), ok: true},
+		{line: long, after: 2*defaultRuleCooldown + time.Second},
+		{line: long, after: 3 * defaultRuleCooldown, want: clip(strings.Repeat("a", maxChatLength) + " is live in prod (and 1 more)"), ok: true},
+	}
+	for i, tt := range tests {
+		got, ok := rule.match(tt.line, start.Add(tt.after))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%d: match(%.40q) = %.40q, %v; want %.40q, %v", i, tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestLogRuleSoundsChecked(t *testing.T) {
+	library := testLibrary(t)
+	sounds := library.sounds
+	library.sounds = nil
+	err := checkWatches(library, []*Watch{{
+		File: "app.log",
+		Rules: []*LogRule{
+			{Pattern: "deployed", Sound: "celebrate"},
+			{Pattern: "panic", Sound: "xylophone"},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	library.mu.Lock()
+	defer library.mu.Unlock()
+	library.sounds = sounds
+	problems := library.checkExpected()
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], fmt.Sprintf("log rule %q plays \"xylophone\", which will fail: unknown sound", "panic")) {
+		t.Errorf("got problems %q", problems)
+	}
+}